@@ -22,11 +22,15 @@ package pd
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // general vars
@@ -36,11 +40,17 @@ var (
 
 // general constants
 const (
-	PathMaps     = "maps"          // path of maps (relative to base path)
-	PathOrders   = "orders"        // path of orders (relative to base path)
-	FileMetadata = "metadata.json" // file holds meta data
-	FileMapstate = "mapstate.json" // file holds map state
-	FileMapfile  = "printmaps.zip" // file holds map data
+	PathMaps      = "maps"           // path of maps (relative to base path)
+	PathOrders    = "orders"         // path of orders (relative to base path)
+	PathLeases    = "leases"         // path of orders claimed by a build service (relative to base path)
+	FileMetadata  = "metadata.json"  // file holds meta data
+	FileMapstate  = "mapstate.json"  // file holds map state
+	FileMapfile   = "printmaps.zip"  // file holds map data
+	FileCallbacks = "callbacks.json" // file holds callback delivery attempts
+	FileUserFiles = "userfiles.json" // file holds details (checksum, type, upload time) of the user files
+	FileCancel    = "cancel.request" // file signals the build service to cancel the running build
+	PathRevisions = "revisions"      // path of meta data revisions (relative to map directory)
+	PathUploads   = "uploads"        // path of unfinished chunked uploads (relative to map directory)
 )
 
 // JSON identation constants
@@ -49,6 +59,26 @@ const (
 	IndexString  = "    "
 )
 
+// patterns of meta data values passed to the mapnik driver (verified by web and build service)
+var (
+	projectionPattern = regexp.MustCompile(`^[0-9]{1,6}$`)
+	hideLayersPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_-]*(,[a-zA-Z0-9_][a-zA-Z0-9_-]*)*$`) // no leading '-' (option)
+)
+
+/*
+IsValidProjection verifies the projection (EPSG code, digits only)
+*/
+func IsValidProjection(projection string) bool {
+	return projectionPattern.MatchString(projection)
+}
+
+/*
+IsValidHideLayers verifies the layers to hide (comma separated layer names without spaces, empty = none)
+*/
+func IsValidHideLayers(hideLayers string) bool {
+	return hideLayers == "" || hideLayersPattern.MatchString(hideLayers)
+}
+
 // JSONAPI constants
 const (
 	JSONAPIMediaType = "application/vnd.api+json; charset=utf-8"
@@ -109,8 +139,62 @@ type Metadata struct {
 	// user defined data objects (optional)
 	UserObjects []UserObject `yaml:"UserObjects"`
 
+	// notification (http post of the final map state) after build completion (optional)
+	CallbackURL    string `json:",omitempty" yaml:"CallbackURL"`
+	CallbackSecret string `json:",omitempty" yaml:"CallbackSecret"` // key for hmac-sha256 signature
+
 	// uploaded user files (read-only value)
-	UserFiles string `json:",omitempty" yaml:"-"`
+	UserFiles UserFiles `json:",omitempty" yaml:"-"`
+
+	// owner of the map (read-only value, owner name of the api key used at creation)
+	Owner string `json:",omitempty" yaml:"-"`
+
+	// revision of the meta data (read-only value, incremented with each change, part of the ETag)
+	Revision int `json:",omitempty" yaml:"-"`
+}
+
+// UserFile describes an uploaded user file
+type UserFile struct {
+	Name     string
+	Size     int64
+	Checksum string `json:",omitempty"` // sha256 (hex)
+	Type     string `json:",omitempty"` // detected content type
+	Uploaded string // upload time
+}
+
+// UserFiles is the list of uploaded user files
+type UserFiles []UserFile
+
+// PrintmapsUserFiles is used for the list of uploaded user files (response object)
+type PrintmapsUserFiles struct {
+	Data struct {
+		Type       string
+		ID         string
+		Attributes struct {
+			UserFiles UserFiles
+		}
+	}
+}
+
+// UploadSession describes a chunked (resumable) upload of a user file
+type UploadSession struct {
+	Name     string
+	Size     int64  // total size in bytes
+	Checksum string `json:",omitempty"` // expected sha256 (hex), verified after the last chunk
+
+	MapID   string `json:",omitempty" yaml:"-"`
+	Offset  int64  `yaml:"-"` // bytes received, the next chunk must start here
+	Created string `json:",omitempty" yaml:"-"`
+	Expires string `json:",omitempty" yaml:"-"` // unfinished uploads are discarded after expiration
+}
+
+// PrintmapsUpload is used for a chunked upload (request and response object)
+type PrintmapsUpload struct {
+	Data struct {
+		Type       string
+		ID         string
+		Attributes UploadSession
+	}
 }
 
 // PrintmapsState is used for the Printmaps process state (response object)
@@ -152,6 +236,7 @@ type BoxWGS84 struct {
 
 // Mapstate is used to represent the current state of a map creation process
 type Mapstate struct {
+	MapCreated            string `json:",omitempty"`
 	MapMetadataWritten    string
 	MapOrderSubmitted     string
 	MapBuildStarted       string
@@ -164,6 +249,145 @@ type Mapstate struct {
 	MapBuildBoxWGS84      BoxWGS84
 }
 
+// map build status values (derived from the map state)
+const (
+	BuildStatusCreated    = "created"    // meta data written, no build order
+	BuildStatusOrdered    = "ordered"    // build order submitted, build not started
+	BuildStatusStarted    = "started"    // build started, not completed
+	BuildStatusSuccessful = "successful" // build completed successfully
+	BuildStatusFailed     = "failed"     // build completed with failure
+	BuildStatusCancelled  = "cancelled"  // build order cancelled (waiting or running build)
+)
+
+// BuildCancelled is the value of MapBuildSuccessful of a cancelled build (besides "yes" and "no")
+const BuildCancelled = "cancelled"
+
+// MapSummary is used for a short description of a map (list entry)
+type MapSummary struct {
+	Fileformat  string
+	Scale       int
+	PrintWidth  float64
+	PrintHeight float64
+	Latitude    float64
+	Longitude   float64
+	Style       string
+	Owner       string `json:",omitempty"`
+	BuildStatus string
+	Mapstate    Mapstate
+}
+
+// PrintmapsListEntry is used for a single map in a list of maps
+type PrintmapsListEntry struct {
+	Type       string
+	ID         string
+	Attributes MapSummary
+}
+
+// PrintmapsList is used for a (paginated) list of maps (response object)
+type PrintmapsList struct {
+	Data []PrintmapsListEntry
+	Meta struct {
+		Total      int
+		PageNumber int
+		PageSize   int
+	}
+	Links struct {
+		Self string
+		Prev string `json:",omitempty"`
+		Next string `json:",omitempty"`
+	}
+}
+
+// CallbackAttempt describes a single delivery attempt of a build completion callback
+type CallbackAttempt struct {
+	MapBuildCompleted string // identifies the build
+	Attempt           int
+	Time              string
+	URL               string
+	StatusCode        int    `json:",omitempty"`
+	Error             string `json:",omitempty"`
+	Duration          string
+	Delivered         bool
+}
+
+// PrintmapsCallbacks is used for the callback delivery attempts (response object)
+type PrintmapsCallbacks struct {
+	Data struct {
+		Type       string
+		ID         string
+		Attributes struct {
+			Attempts []CallbackAttempt
+		}
+	}
+}
+
+// MetadataRevision is a stored revision of the meta data
+type MetadataRevision struct {
+	Revision int
+	Time     string
+	Author   string    // owner of the api key ("anonymous" without api key)
+	ClientIP string    `json:",omitempty"` // reported to admins only
+	Action   string    // create, update, upload, replace, delete, rollback, clone
+	Detail   string    `json:",omitempty"`
+	Metadata *Metadata `json:",omitempty"` // omitted in the revision list
+}
+
+// PrintmapsRevisions is used for the revision history of the meta data (response object)
+type PrintmapsRevisions struct {
+	Data struct {
+		Type       string
+		ID         string
+		Attributes struct {
+			Current   int // current revision
+			Revisions []MetadataRevision
+		}
+	}
+}
+
+// PrintmapsRevisionDiff is used for the differences between two revisions (response object)
+type PrintmapsRevisionDiff struct {
+	Data struct {
+		Type       string
+		ID         string
+		Attributes struct {
+			From    int
+			To      int
+			Changes []JSONChange
+		}
+	}
+}
+
+/*
+UnmarshalJSON decodes the list of user files (the comma separated string of former releases is ignored)
+*/
+func (userFiles *UserFiles) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*userFiles = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*[]UserFile)(userFiles))
+}
+
+/*
+BuildStatus derives the build status from the map state
+*/
+func BuildStatus(mapstate Mapstate) string {
+	switch {
+	case mapstate.MapOrderSubmitted == "":
+		return BuildStatusCreated
+	case mapstate.MapBuildSuccessful == BuildCancelled:
+		return BuildStatusCancelled
+	case mapstate.MapBuildStarted == "":
+		return BuildStatusOrdered
+	case mapstate.MapBuildCompleted == "":
+		return BuildStatusStarted
+	case mapstate.MapBuildSuccessful == "yes":
+		return BuildStatusSuccessful
+	default:
+		return BuildStatusFailed
+	}
+}
+
 /*
 WriteMetadata writes the map meta data to a file
 */
@@ -205,29 +429,121 @@ func ReadMetadata(pmData *PrintmapsData, id string) error {
 	}
 
 	// list of uploaded user files
+	userFiles, err := DescribeUserFiles(id)
+	if err != nil {
+		return err
+	}
+	pmData.Data.Attributes.UserFiles = userFiles
+
+	return nil
+}
+
+/*
+ListUserFiles lists the uploaded user files of the map (all files except the service files and temporary files)
+*/
+func ListUserFiles(id string) ([]os.FileInfo, error) {
+	var userFiles []os.FileInfo
 
 	path := filepath.Join(PathWorkdir, PathMaps, id)
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		log.Printf("error <%v> at ioutil.ReadDir(), path = <%v>", err, path)
-		return err
+		return nil, err
 	}
 
-	fileList := ""
-	format := "%s,%d"
 	for _, fileInfo := range files {
 		if fileInfo.IsDir() == false {
-			if !(fileInfo.Name() == FileMetadata || fileInfo.Name() == FileMapstate || fileInfo.Name() == FileMapfile) {
-				fileList = fileList + fmt.Sprintf(format, fileInfo.Name(), fileInfo.Size())
-				format = ",%s,%d"
+			if !IsServiceFile(fileInfo.Name()) && !strings.HasPrefix(fileInfo.Name(), ".") {
+				userFiles = append(userFiles, fileInfo)
 			}
 		}
 	}
-	if fileList != "" {
-		pmData.Data.Attributes.UserFiles = fileList
+
+	return userFiles, nil
+}
+
+/*
+IsServiceFile verifies if the file name is reserved for a file or directory of the service
+*/
+func IsServiceFile(name string) bool {
+	switch name {
+	case FileMetadata, FileMapstate, FileMapfile, FileCallbacks, FileUserFiles, FileCancel, PathRevisions, PathUploads:
+		return true
 	}
+	return false
+}
 
-	return nil
+/*
+DescribeUserFiles lists the uploaded user files with details (details missing in the index are omitted)
+*/
+func DescribeUserFiles(id string) (UserFiles, error) {
+	var userFiles UserFiles
+
+	files, err := ListUserFiles(id)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := ReadUserFileIndex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileInfo := range files {
+		userFile := UserFile{
+			Name:     fileInfo.Name(),
+			Size:     fileInfo.Size(),
+			Uploaded: fileInfo.ModTime().UTC().Format(time.RFC3339),
+		}
+		for _, entry := range index {
+			if entry.Name == userFile.Name && entry.Size == userFile.Size {
+				userFile.Checksum = entry.Checksum
+				userFile.Type = entry.Type
+				userFile.Uploaded = entry.Uploaded
+			}
+		}
+		userFiles = append(userFiles, userFile)
+	}
+
+	return userFiles, nil
+}
+
+/*
+WriteUserFileIndex writes the details of the uploaded user files
+*/
+func WriteUserFileIndex(id string, userFiles UserFiles) error {
+	data, err := json.MarshalIndent(userFiles, IndentPrefix, IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return err
+	}
+
+	file := filepath.Join(PathWorkdir, PathMaps, id, FileUserFiles)
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+/*
+ReadUserFileIndex reads the details of the uploaded user files (empty if no file was uploaded yet)
+*/
+func ReadUserFileIndex(id string) (UserFiles, error) {
+	var userFiles UserFiles
+
+	file := filepath.Join(PathWorkdir, PathMaps, id, FileUserFiles)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return userFiles, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &userFiles)
+	if err != nil {
+		log.Printf("error <%v> at json.Unmarshal()", err)
+		return nil, err
+	}
+
+	return userFiles, nil
 }
 
 /*
@@ -273,6 +589,201 @@ func ReadMapstate(pmState *PrintmapsState, id string) error {
 	return nil
 }
 
+/*
+WriteCallbacks writes (updates) the callback delivery attempts
+*/
+func WriteCallbacks(pmCallbacks PrintmapsCallbacks) error {
+	data, err := json.MarshalIndent(pmCallbacks, IndentPrefix, IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return err
+	}
+
+	file := filepath.Join(PathWorkdir, PathMaps, pmCallbacks.Data.ID, FileCallbacks)
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+/*
+ReadCallbacks reads the callback delivery attempts
+*/
+func ReadCallbacks(pmCallbacks *PrintmapsCallbacks, id string) error {
+	file := filepath.Join(PathWorkdir, PathMaps, id, FileCallbacks)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, pmCallbacks)
+	if err != nil {
+		log.Printf("error <%v> at json.Unmarshal()", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+WriteRevision writes (archives) a revision of the meta data
+*/
+func WriteRevision(id string, revision MetadataRevision) error {
+	path := filepath.Join(PathWorkdir, PathMaps, id, PathRevisions)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Printf("error <%v> at os.MkdirAll(), path = <%s>", err, path)
+		return err
+	}
+
+	data, err := json.MarshalIndent(revision, IndentPrefix, IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return err
+	}
+
+	file := filepath.Join(path, strconv.Itoa(revision.Revision)+".json")
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+/*
+ReadRevision reads a revision of the meta data
+*/
+func ReadRevision(revision *MetadataRevision, id string, number int) error {
+	file := filepath.Join(PathWorkdir, PathMaps, id, PathRevisions, strconv.Itoa(number)+".json")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, revision)
+	if err != nil {
+		log.Printf("error <%v> at json.Unmarshal()", err)
+		return err
+	}
+
+	return nil
+}
+
+/*
+ListRevisions lists all revisions of the meta data (ascending, without meta data)
+*/
+func ListRevisions(id string) ([]MetadataRevision, error) {
+	var revisions []MetadataRevision
+
+	path := filepath.Join(PathWorkdir, PathMaps, id, PathRevisions)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return revisions, nil
+		}
+		return nil, err
+	}
+
+	for _, fileInfo := range files {
+		number, err := strconv.Atoi(strings.TrimSuffix(fileInfo.Name(), ".json"))
+		if err != nil || fileInfo.IsDir() {
+			continue
+		}
+		var revision MetadataRevision
+		if err := ReadRevision(&revision, id, number); err != nil {
+			return nil, err
+		}
+		revision.Metadata = nil
+		revisions = append(revisions, revision)
+	}
+
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	return revisions, nil
+}
+
+/*
+WriteUploadSession writes (updates) the state of a chunked upload
+*/
+func WriteUploadSession(pmUpload PrintmapsUpload) error {
+	path := filepath.Join(PathWorkdir, PathMaps, pmUpload.Data.Attributes.MapID, PathUploads)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Printf("error <%v> at os.MkdirAll(), path = <%s>", err, path)
+		return err
+	}
+
+	data, err := json.MarshalIndent(pmUpload, IndentPrefix, IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return err
+	}
+
+	file := filepath.Join(path, pmUpload.Data.ID+".json")
+	return ioutil.WriteFile(file, data, 0666)
+}
+
+/*
+ReadUploadSession reads the state of a chunked upload (the offset is derived from the received data)
+*/
+func ReadUploadSession(pmUpload *PrintmapsUpload, mapID string, uploadID string) error {
+	file := filepath.Join(PathWorkdir, PathMaps, mapID, PathUploads, uploadID+".json")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, pmUpload)
+	if err != nil {
+		log.Printf("error <%v> at json.Unmarshal()", err)
+		return err
+	}
+
+	pmUpload.Data.Attributes.Offset = 0
+	fileInfo, err := os.Stat(UploadDataFile(mapID, uploadID))
+	if err == nil {
+		pmUpload.Data.Attributes.Offset = fileInfo.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+/*
+RemoveUploadSession removes the state and the received data of a chunked upload
+*/
+func RemoveUploadSession(mapID string, uploadID string) error {
+	if err := os.Remove(UploadDataFile(mapID, uploadID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file := filepath.Join(PathWorkdir, PathMaps, mapID, PathUploads, uploadID+".json")
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+ListUploadSessions lists the IDs of the unfinished chunked uploads of a map
+*/
+func ListUploadSessions(mapID string) ([]string, error) {
+	var uploadIDs []string
+
+	path := filepath.Join(PathWorkdir, PathMaps, mapID, PathUploads)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return uploadIDs, nil
+		}
+		return nil, err
+	}
+
+	for _, fileInfo := range files {
+		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".json") {
+			uploadIDs = append(uploadIDs, strings.TrimSuffix(fileInfo.Name(), ".json"))
+		}
+	}
+	return uploadIDs, nil
+}
+
+/*
+UploadDataFile returns the file receiving the data of a chunked upload
+*/
+func UploadDataFile(mapID string, uploadID string) string {
+	return filepath.Join(PathWorkdir, PathMaps, mapID, PathUploads, uploadID+".part")
+}
+
 /*
 CreateDirectories creates the necessary directories
 */
@@ -292,6 +803,61 @@ func CreateDirectories() {
 			log.Fatalf("fatal error <%v> at os.MkdirAll(), path = <%s>", err, path)
 		}
 	}
+
+	// create 'leases' directory if necessary
+	path = filepath.Join(PathWorkdir, PathLeases)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			log.Fatalf("fatal error <%v> at os.MkdirAll(), path = <%s>", err, path)
+		}
+	}
+}
+
+/*
+CountBuildOrders counts the build orders waiting in the orders directory
+*/
+func CountBuildOrders() (int, error) {
+	path := filepath.Join(PathWorkdir, PathOrders)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Printf("error <%v> at ioutil.ReadDir(), path = <%v>", err, path)
+		return 0, err
+	}
+
+	count := 0
+	for _, fileInfo := range files {
+		if !fileInfo.IsDir() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+/*
+RequestBuildCancel signals the build service to cancel the running build of a map
+*/
+func RequestBuildCancel(mapID string) error {
+	file := filepath.Join(PathWorkdir, PathMaps, mapID, FileCancel)
+	return ioutil.WriteFile(file, []byte(time.Now().Format(time.RFC3339)+"\n"), 0666)
+}
+
+/*
+IsBuildCancelRequested verifies if the cancellation of the running build of a map is requested
+*/
+func IsBuildCancelRequested(mapID string) bool {
+	_, err := os.Stat(filepath.Join(PathWorkdir, PathMaps, mapID, FileCancel))
+	return err == nil
+}
+
+/*
+RemoveBuildCancel removes the cancel request of a map (if any)
+*/
+func RemoveBuildCancel(mapID string) error {
+	file := filepath.Join(PathWorkdir, PathMaps, mapID, FileCancel)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 /*
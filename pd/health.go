@@ -0,0 +1,122 @@
+/*
+Purpose:
+- Printmaps Health: Health and readiness reports (shared by webservice and buildservice).
+
+Description:
+- A report consists of named checks. The report fails if at least one check fails.
+*/
+
+package pd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// health check status values
+const (
+	HealthStatusOK     = "ok"
+	HealthStatusFailed = "failed"
+)
+
+// HealthCheck describes the result of a single check
+type HealthCheck struct {
+	Name    string
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+// HealthReport is used for the health / readiness report (response object)
+type HealthReport struct {
+	Status string
+	Checks []HealthCheck
+	Failed []string `json:",omitempty"` // names of the failed checks
+}
+
+/*
+AddCheck adds the result of a check (err = nil: check ok) to the report.
+*/
+func (report *HealthReport) AddCheck(name string, err error) {
+	check := HealthCheck{Name: name, Status: HealthStatusOK}
+	if err != nil {
+		check.Status = HealthStatusFailed
+		check.Message = err.Error()
+		report.Failed = append(report.Failed, name)
+	}
+	report.Checks = append(report.Checks, check)
+}
+
+/*
+WriteHealthReport sends the report (status code 200 = ok, 503 = at least one check failed).
+*/
+func WriteHealthReport(writer http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	report.Status = HealthStatusOK
+	if len(report.Failed) > 0 {
+		status = http.StatusServiceUnavailable
+		report.Status = HealthStatusFailed
+	}
+
+	content, err := json.MarshalIndent(report, IndentPrefix, IndexString)
+	if err != nil {
+		message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.WriteHeader(status)
+	writer.Write(content)
+}
+
+/*
+CheckDirWritable verifies that a file can be created in the directory
+*/
+func CheckDirWritable(path string) error {
+	file, err := ioutil.TempFile(path, ".healthcheck_")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	file.Close()
+	return os.Remove(name)
+}
+
+/*
+CheckDirReadable verifies that the directory exists and can be read
+*/
+func CheckDirReadable(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+/*
+CheckFileExists verifies that the file exists and is a regular file
+*/
+func CheckFileExists(path string) error {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", path)
+	}
+	return nil
+}
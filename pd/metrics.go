@@ -0,0 +1,294 @@
+/*
+Purpose:
+- Printmaps Metrics: Counters, histograms and gauges in Prometheus text exposition format.
+
+Description:
+- Minimal implementation (no third-party dependencies) shared by webservice and buildservice.
+- All metrics are registered in a package-wide registry when created.
+*/
+
+package pd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsContentType is the media type of the Prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DurationBuckets are histogram buckets for durations in seconds (http requests)
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsCollector writes a metric family in text format
+type metricsCollector interface {
+	writeMetrics(writer io.Writer)
+}
+
+// metrics registry
+var (
+	metricsMutex      sync.Mutex
+	metricsCollectors []metricsCollector
+)
+
+/*
+registerMetrics adds a collector to the registry.
+*/
+func registerMetrics(collector metricsCollector) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricsCollectors = append(metricsCollectors, collector)
+}
+
+/*
+WriteMetrics writes all registered metrics in text exposition format.
+*/
+func WriteMetrics(writer io.Writer) {
+	metricsMutex.Lock()
+	collectors := append([]metricsCollector(nil), metricsCollectors...)
+	metricsMutex.Unlock()
+
+	for _, collector := range collectors {
+		collector.writeMetrics(writer)
+	}
+}
+
+/*
+ServeMetrics is a http handler which serves all registered metrics.
+*/
+func ServeMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", MetricsContentType)
+	writer.WriteHeader(http.StatusOK)
+	WriteMetrics(writer)
+}
+
+// Counter is a cumulative metric (with optional labels)
+type Counter struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]float64 // key = joined label values
+}
+
+/*
+NewCounter creates and registers a counter.
+*/
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	registerMetrics(counter)
+	return counter
+}
+
+/*
+Inc increments the counter by 1.
+*/
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+/*
+Add adds the given (non-negative) value to the counter.
+*/
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	counter.mutex.Lock()
+	counter.values[key] += value
+	counter.mutex.Unlock()
+}
+
+/*
+writeMetrics implements the metricsCollector interface.
+*/
+func (counter *Counter) writeMetrics(writer io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", counter.name, counter.help)
+	fmt.Fprintf(writer, "# TYPE %s counter\n", counter.name)
+	for _, key := range sortedKeys(counter.values) {
+		labels := formatLabels(counter.labelNames, key, "", "")
+		fmt.Fprintf(writer, "%s%s %s\n", counter.name, labels, formatValue(counter.values[key]))
+	}
+}
+
+// Histogram samples observations in configurable buckets (with optional labels)
+type Histogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64 // upper bounds (ascending, without +Inf)
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries // key = joined label values
+}
+
+// histogramSeries holds the observations of a single label combination
+type histogramSeries struct {
+	counts []uint64 // per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+/*
+NewHistogram creates and registers a histogram.
+*/
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	sortedBuckets := append([]float64(nil), buckets...)
+	sort.Float64s(sortedBuckets)
+	histogram := &Histogram{name: name, help: help, labelNames: labelNames, buckets: sortedBuckets, series: make(map[string]*histogramSeries)}
+	registerMetrics(histogram)
+	return histogram
+}
+
+/*
+Observe adds a single observation to the histogram.
+*/
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	series, found := histogram.series[key]
+	if !found {
+		series = &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	for index, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			series.counts[index]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+/*
+writeMetrics implements the metricsCollector interface.
+*/
+func (histogram *Histogram) writeMetrics(writer io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", histogram.name, histogram.help)
+	fmt.Fprintf(writer, "# TYPE %s histogram\n", histogram.name)
+
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := histogram.series[key]
+		var cumulative uint64
+		for index, upperBound := range histogram.buckets {
+			cumulative += series.counts[index]
+			labels := formatLabels(histogram.labelNames, key, "le", formatValue(upperBound))
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, labels, cumulative)
+		}
+		labels := formatLabels(histogram.labelNames, key, "le", "+Inf")
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, labels, series.count)
+		labels = formatLabels(histogram.labelNames, key, "", "")
+		fmt.Fprintf(writer, "%s_sum%s %s\n", histogram.name, labels, formatValue(series.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", histogram.name, labels, series.count)
+	}
+}
+
+// GaugeFunc is a gauge whose value is determined at collection time
+type GaugeFunc struct {
+	name     string
+	help     string
+	function func() float64
+}
+
+/*
+NewGaugeFunc creates and registers a gauge (value provided by the given function).
+*/
+func NewGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{name: name, help: help, function: function}
+	registerMetrics(gauge)
+	return gauge
+}
+
+/*
+writeMetrics implements the metricsCollector interface.
+*/
+func (gauge *GaugeFunc) writeMetrics(writer io.Writer) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", gauge.name, gauge.help)
+	fmt.Fprintf(writer, "# TYPE %s gauge\n", gauge.name)
+	fmt.Fprintf(writer, "%s %s\n", gauge.name, formatValue(gauge.function()))
+}
+
+// separator of joined label values (never part of a label value)
+const labelSeparator = "\xff"
+
+/*
+sortedKeys returns the keys of a map in ascending order.
+*/
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+formatLabels formats the label set of a series (e.g. {route="/maps",status="200"}), with an optional extra label.
+*/
+func formatLabels(labelNames []string, key string, extraName string, extraValue string) string {
+	var pairs []string
+	if len(labelNames) > 0 {
+		labelValues := strings.Split(key, labelSeparator)
+		for index, labelName := range labelNames {
+			labelValue := ""
+			if index < len(labelValues) {
+				labelValue = labelValues[index]
+			}
+			pairs = append(pairs, labelName+"=\""+escapeLabelValue(labelValue)+"\"")
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/*
+escapeLabelValue escapes backslash, double-quote and line feed.
+*/
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+/*
+formatValue formats a sample value.
+*/
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
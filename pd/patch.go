@@ -0,0 +1,518 @@
+/*
+Purpose:
+- Printmaps Patch: Partial updates of json documents.
+
+Description:
+- MergePatch applies a JSON Merge Patch (RFC 7396).
+- ApplyJSONPatch applies a JSON Patch (RFC 6902).
+- CreateMergePatch creates the JSON Merge Patch which transforms one document into another.
+- DiffJSON lists the differences between two documents (structured diff).
+- Like encoding/json object member names are matched case-insensitively (exact match preferred),
+  therefore a patch with "style" modifies the existing member "Style".
+*/
+
+package pd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// media types of partial updates
+const (
+	MergePatchMediaType = "application/merge-patch+json"
+	JSONPatchMediaType  = "application/json-patch+json"
+)
+
+// JSONPatchOperation is a single operation of a JSON Patch document
+type JSONPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONChange describes a single difference between two json documents
+type JSONChange struct {
+	Path string      // json pointer (RFC 6901) of the changed value
+	Op   string      // added, removed, changed
+	From interface{} `json:",omitempty"`
+	To   interface{} `json:",omitempty"`
+}
+
+/*
+MergePatch applies a JSON Merge Patch (RFC 7396) to a json document
+*/
+func MergePatch(document []byte, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+	patchValue, err := decodeJSON(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %v", err)
+	}
+
+	return json.Marshal(mergeValue(target, patchValue))
+}
+
+/*
+mergeValue merges a (decoded) patch value into a (decoded) target value
+*/
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for name, value := range patchObject {
+		member := lookupMember(targetObject, name)
+		if value == nil {
+			delete(targetObject, member)
+			continue
+		}
+		targetObject[member] = mergeValue(targetObject[member], value)
+	}
+	return targetObject
+}
+
+/*
+ApplyJSONPatch applies a JSON Patch (RFC 6902) to a json document
+*/
+func ApplyJSONPatch(document []byte, patch []byte) ([]byte, error) {
+	var operations []JSONPatchOperation
+
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("invalid json patch: %v", err)
+	}
+
+	for index, operation := range operations {
+		target, err = applyOperation(target, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %v", index, operation.Op, operation.Path, err)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+/*
+applyOperation applies a single JSON Patch operation
+*/
+func applyOperation(target interface{}, operation JSONPatchOperation) (interface{}, error) {
+	var value interface{}
+	var err error
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, fmt.Errorf("value missing")
+		}
+		if value, err = decodeJSON(*operation.Value); err != nil {
+			return nil, fmt.Errorf("invalid value: %v", err)
+		}
+	case "move", "copy":
+		if value, err = getPointer(target, operation.From); err != nil {
+			return nil, err
+		}
+		if operation.Op == "copy" {
+			// the copy must not share objects or arrays with the source
+			value = cloneJSON(value)
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown operation")
+	}
+
+	switch operation.Op {
+	case "add", "copy":
+		return setPointer(target, operation.Path, value, true)
+	case "replace":
+		if _, err := getPointer(target, operation.Path); err != nil {
+			return nil, err
+		}
+		return setPointer(target, operation.Path, value, false)
+	case "remove":
+		return removePointer(target, operation.Path)
+	case "move":
+		if strings.HasPrefix(operation.Path, operation.From+"/") {
+			return nil, fmt.Errorf("can't move a value into one of its children")
+		}
+		if target, err = removePointer(target, operation.From); err != nil {
+			return nil, err
+		}
+		return setPointer(target, operation.Path, value, true)
+	default: // test
+		current, err := getPointer(target, operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalJSON(current, value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return target, nil
+	}
+}
+
+/*
+CreateMergePatch creates the JSON Merge Patch (RFC 7396) which transforms the original into the modified document
+*/
+func CreateMergePatch(original []byte, modified []byte) ([]byte, error) {
+	originalValue, err := decodeJSON(original)
+	if err != nil {
+		return nil, fmt.Errorf("invalid original document: %v", err)
+	}
+	modifiedValue, err := decodeJSON(modified)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modified document: %v", err)
+	}
+
+	// a modified document which is not an object replaces the original
+	if _, ok := modifiedValue.(map[string]interface{}); !ok {
+		return json.Marshal(modifiedValue)
+	}
+
+	patch := diffValue(originalValue, modifiedValue)
+	if patch == nil {
+		patch = map[string]interface{}{}
+	}
+	return json.Marshal(patch)
+}
+
+/*
+diffValue returns the merge patch between two (decoded) values (nil = no difference)
+*/
+func diffValue(original interface{}, modified interface{}) interface{} {
+	originalObject, originalIsObject := original.(map[string]interface{})
+	modifiedObject, modifiedIsObject := modified.(map[string]interface{})
+	if !originalIsObject || !modifiedIsObject {
+		if equalJSON(original, modified) {
+			return nil
+		}
+		return modified
+	}
+
+	patch := make(map[string]interface{})
+	for name, originalMember := range originalObject {
+		modifiedMember, found := modifiedObject[name]
+		if !found || modifiedMember == nil {
+			if originalMember != nil {
+				patch[name] = nil
+			}
+			continue
+		}
+		if memberPatch := diffValue(originalMember, modifiedMember); memberPatch != nil {
+			patch[name] = memberPatch
+		}
+	}
+	for name, modifiedMember := range modifiedObject {
+		if _, found := originalObject[name]; !found && modifiedMember != nil {
+			patch[name] = modifiedMember
+		}
+	}
+
+	if len(patch) == 0 {
+		return nil
+	}
+	return patch
+}
+
+/*
+DiffJSON lists the differences between two json documents (arrays are compared element by element)
+*/
+func DiffJSON(from []byte, to []byte) ([]JSONChange, error) {
+	fromValue, err := decodeJSON(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+	toValue, err := decodeJSON(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+
+	changes := []JSONChange{}
+	diffChanges(fromValue, toValue, "", &changes)
+	return changes, nil
+}
+
+/*
+diffChanges appends the differences between two (decoded) values to the list of changes
+*/
+func diffChanges(from interface{}, to interface{}, pointer string, changes *[]JSONChange) {
+	fromObject, fromIsObject := from.(map[string]interface{})
+	toObject, toIsObject := to.(map[string]interface{})
+	if fromIsObject && toIsObject {
+		names := make([]string, 0, len(fromObject)+len(toObject))
+		for name := range fromObject {
+			names = append(names, name)
+		}
+		for name := range toObject {
+			if _, found := fromObject[name]; !found {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fromMember, fromFound := fromObject[name]
+			toMember, toFound := toObject[name]
+			memberPointer := pointer + "/" + escapePointer(name)
+			switch {
+			case !fromFound || (fromMember == nil && toMember != nil):
+				*changes = append(*changes, JSONChange{Path: memberPointer, Op: "added", To: toMember})
+			case !toFound || (toMember == nil && fromMember != nil):
+				*changes = append(*changes, JSONChange{Path: memberPointer, Op: "removed", From: fromMember})
+			default:
+				diffChanges(fromMember, toMember, memberPointer, changes)
+			}
+		}
+		return
+	}
+
+	fromArray, fromIsArray := from.([]interface{})
+	toArray, toIsArray := to.([]interface{})
+	if fromIsArray && toIsArray {
+		for index := 0; index < len(fromArray) || index < len(toArray); index++ {
+			elementPointer := pointer + "/" + strconv.Itoa(index)
+			switch {
+			case index >= len(fromArray):
+				*changes = append(*changes, JSONChange{Path: elementPointer, Op: "added", To: toArray[index]})
+			case index >= len(toArray):
+				*changes = append(*changes, JSONChange{Path: elementPointer, Op: "removed", From: fromArray[index]})
+			default:
+				diffChanges(fromArray[index], toArray[index], elementPointer, changes)
+			}
+		}
+		return
+	}
+
+	if !equalJSON(from, to) {
+		*changes = append(*changes, JSONChange{Path: pointer, Op: "changed", From: from, To: to})
+	}
+}
+
+/*
+getPointer returns the value referenced by a json pointer (RFC 6901)
+*/
+func getPointer(target interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := target
+	for _, token := range tokens {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			member := lookupMember(container, token)
+			value, found := container[member]
+			if !found {
+				return nil, fmt.Errorf("path not found: %s", pointer)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			current = container[index]
+		default:
+			return nil, fmt.Errorf("path not found: %s", pointer)
+		}
+	}
+	return current, nil
+}
+
+/*
+setPointer sets (insert = true: adds) the value referenced by a json pointer, returns the modified target
+*/
+func setPointer(target interface{}, pointer string, value interface{}, insert bool) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := getPointer(target, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[lookupMember(container, last)] = value
+		return target, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(container), insert)
+		if err != nil {
+			return nil, err
+		}
+		if insert {
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+		}
+		container[index] = value
+		return setPointer(target, parentPointer, container, false)
+	default:
+		return nil, fmt.Errorf("path not found: %s", pointer)
+	}
+}
+
+/*
+removePointer removes the value referenced by a json pointer, returns the modified target
+*/
+func removePointer(target interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("can't remove the whole document")
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := getPointer(target, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		member := lookupMember(container, last)
+		if _, found := container[member]; !found {
+			return nil, fmt.Errorf("path not found: %s", pointer)
+		}
+		delete(container, member)
+		return target, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		container = append(container[:index], container[index+1:]...)
+		return setPointer(target, parentPointer, container, false)
+	default:
+		return nil, fmt.Errorf("path not found: %s", pointer)
+	}
+}
+
+/*
+splitPointer splits a json pointer into its (unescaped) reference tokens
+*/
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer: %s", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for index, token := range tokens {
+		tokens[index] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+/*
+arrayIndex converts a reference token into an array index ("-" = end of array, only valid for insert)
+*/
+func arrayIndex(token string, length int, insert bool) (int, error) {
+	if token == "-" && insert {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index: %s", token)
+	}
+	if index > length || (index == length && !insert) {
+		return 0, fmt.Errorf("array index out of range: %s", token)
+	}
+	return index, nil
+}
+
+/*
+lookupMember returns the name of the existing object member (case-insensitive match) or the name itself
+*/
+func lookupMember(object map[string]interface{}, name string) string {
+	if _, found := object[name]; found {
+		return name
+	}
+	for member := range object {
+		if strings.EqualFold(member, name) {
+			return member
+		}
+	}
+	return name
+}
+
+/*
+decodeJSON decodes a json document (numbers are kept as json.Number)
+*/
+func decodeJSON(data []byte) (interface{}, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+/*
+cloneJSON returns a deep copy of a (decoded) json value
+*/
+func cloneJSON(value interface{}) interface{} {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(container))
+		for name, member := range container {
+			object[name] = cloneJSON(member)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(container))
+		for index, element := range container {
+			array[index] = cloneJSON(element)
+		}
+		return array
+	default:
+		return value
+	}
+}
+
+/*
+equalJSON compares two (decoded) json values
+*/
+func equalJSON(a interface{}, b interface{}) bool {
+	numberA, okA := a.(json.Number)
+	numberB, okB := b.(json.Number)
+	if okA && okB {
+		floatA, errA := numberA.Float64()
+		floatB, errB := numberB.Float64()
+		if errA == nil && errB == nil {
+			return floatA == floatB
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,199 @@
+// Tests of the partial updates of json documents (examples of RFC 7396 and RFC 6902, appendix A)
+
+package pd
+
+import (
+	"reflect"
+	"testing"
+)
+
+// mergePatchExamples are the examples of RFC 7396, appendix A
+var mergePatchExamples = []struct {
+	original string
+	patch    string
+	result   string
+}{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+}
+
+/*
+assertJSON compares a json document with the expected one (independent of formatting and member order).
+*/
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	gotValue, err := decodeJSON(got)
+	if err != nil {
+		t.Fatalf("invalid json %s: %v", got, err)
+	}
+	wantValue, err := decodeJSON([]byte(want))
+	if err != nil {
+		t.Fatalf("invalid expected json %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	for _, example := range mergePatchExamples {
+		result, err := MergePatch([]byte(example.original), []byte(example.patch))
+		if err != nil {
+			t.Errorf("MergePatch(%s, %s) failed: %v", example.original, example.patch, err)
+			continue
+		}
+		assertJSON(t, result, example.result)
+	}
+}
+
+func TestMergePatchMemberCase(t *testing.T) {
+	result, err := MergePatch([]byte(`{"Style":"osm-carto","Scale":25000}`), []byte(`{"style":"schwarzplan"}`))
+	if err != nil {
+		t.Fatalf("MergePatch() failed: %v", err)
+	}
+	assertJSON(t, result, `{"Style":"schwarzplan","Scale":25000}`)
+}
+
+func TestCreateMergePatch(t *testing.T) {
+	// the created patch transforms the original into the result
+	for _, example := range mergePatchExamples {
+		patch, err := CreateMergePatch([]byte(example.original), []byte(example.result))
+		if err != nil {
+			t.Errorf("CreateMergePatch(%s, %s) failed: %v", example.original, example.result, err)
+			continue
+		}
+		result, err := MergePatch([]byte(example.original), patch)
+		if err != nil {
+			t.Errorf("MergePatch(%s, %s) failed: %v", example.original, patch, err)
+			continue
+		}
+		assertJSON(t, result, example.result)
+	}
+
+	tests := []struct {
+		original string
+		modified string
+		patch    string
+	}{
+		{`{"a":"b","b":"c"}`, `{"b":"c"}`, `{"a":null}`},
+		{`{"a":{"b":"c","d":"e"}}`, `{"a":{"b":"c","d":"f"}}`, `{"a":{"d":"f"}}`},
+		{`{"a":[1,2]}`, `{"a":[1,2,3]}`, `{"a":[1,2,3]}`},
+		{`{"a":1}`, `{"a":1.0}`, `{}`},
+		{`{"a":"b"}`, `{"a":"b"}`, `{}`},
+		{`["a"]`, `["a"]`, `["a"]`},
+		{`{"a":"b"}`, `null`, `null`},
+	}
+	for _, test := range tests {
+		patch, err := CreateMergePatch([]byte(test.original), []byte(test.modified))
+		if err != nil {
+			t.Errorf("CreateMergePatch(%s, %s) failed: %v", test.original, test.modified, err)
+			continue
+		}
+		assertJSON(t, patch, test.patch)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		patch    string
+		result   string // empty = error expected
+	}{
+		// RFC 6902, appendix A
+		{"A.1 adding an object member", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"baz":"qux","foo":"bar"}`},
+		{"A.2 adding an array element", `{"foo":["bar","baz"]}`,
+			`[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`},
+		{"A.3 removing an object member", `{"baz":"qux","foo":"bar"}`,
+			`[{"op":"remove","path":"/baz"}]`,
+			`{"foo":"bar"}`},
+		{"A.4 removing an array element", `{"foo":["bar","qux","baz"]}`,
+			`[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`},
+		{"A.5 replacing a value", `{"baz":"qux","foo":"bar"}`,
+			`[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`},
+		{"A.6 moving a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"A.7 moving an array element", `{"foo":["all","grass","cows","eat"]}`,
+			`[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{"A.8 testing a value: success", `{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{"A.9 testing a value: error", `{"baz":"qux"}`,
+			`[{"op":"test","path":"/baz","value":"bar"}]`,
+			""},
+		{"A.10 adding a nested member object", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`},
+		{"A.11 ignoring unrecognized elements", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+			`{"foo":"bar","baz":"qux"}`},
+		{"A.12 adding to a nonexistent target", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			""},
+		{"A.14 ~ escape ordering", `{"/":9,"~1":10}`,
+			`[{"op":"test","path":"/~01","value":10}]`,
+			`{"/":9,"~1":10}`},
+		{"A.15 comparing strings and numbers", `{"/":9,"~1":10}`,
+			`[{"op":"test","path":"/~01","value":"10"}]`,
+			""},
+		{"A.16 adding an array value", `{"foo":["bar"]}`,
+			`[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			`{"foo":["bar",["abc","def"]]}`},
+
+		// copies are independent of their source
+		{"copy and modify the copy", `{"a":[{"s":"old"}]}`,
+			`[{"op":"copy","from":"/a/0","path":"/a/-"},{"op":"replace","path":"/a/1/s","value":"new"}]`,
+			`{"a":[{"s":"old"},{"s":"new"}]}`},
+		{"copy and modify the source", `{"a":{"b":["c"]}}`,
+			`[{"op":"copy","from":"/a","path":"/x"},{"op":"add","path":"/a/b/-","value":"d"},{"op":"remove","path":"/a/b/0"}]`,
+			`{"a":{"b":["d"]},"x":{"b":["c"]}}`},
+
+		// errors
+		{"unknown operation", `{"foo":"bar"}`, `[{"op":"merge","path":"/foo","value":1}]`, ""},
+		{"value missing", `{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, ""},
+		{"replace missing member", `{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, ""},
+		{"remove whole document", `{"foo":"bar"}`, `[{"op":"remove","path":""}]`, ""},
+		{"move into child", `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, ""},
+		{"array index out of range", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`, ""},
+		{"array index with leading zero", `{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`, ""},
+		{"invalid pointer", `{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, ""},
+		{"failed operation is atomic", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":1},{"op":"test","path":"/baz","value":2}]`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := ApplyJSONPatch([]byte(test.document), []byte(test.patch))
+			if test.result == "" {
+				if err == nil {
+					t.Errorf("ApplyJSONPatch() = %s, want error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyJSONPatch() failed: %v", err)
+			}
+			assertJSON(t, result, test.result)
+		})
+	}
+}
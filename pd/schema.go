@@ -0,0 +1,203 @@
+/*
+Purpose:
+- Printmaps Schema: JSON Schema (OpenAPI 3.0 dialect) derived from the Printmaps data structures.
+
+Description:
+- The schema is generated via reflection, therefore it is always in sync with the data structures.
+- Objects don't allow additional (unknown) properties.
+- Fields excluded from the map definition file (yaml:"-") are read-only values.
+- ValidateJSON validates a json document against a schema. Like encoding/json property names
+  are matched case-insensitively and null is accepted for every value.
+*/
+
+package pd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema describes a json value (subset of JSON Schema as used by OpenAPI 3.0)
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false or *Schema
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+// SchemaViolation describes a single validation error
+type SchemaViolation struct {
+	Pointer string // json pointer (RFC 6901) of the invalid value
+	Message string
+}
+
+/*
+SchemaOf derives the schema from a Go type
+*/
+func SchemaOf(goType reflect.Type) *Schema {
+	switch goType.Kind() {
+	case reflect.Ptr:
+		schema := SchemaOf(goType.Elem())
+		schema.Nullable = true
+		return schema
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		for index := 0; index < goType.NumField(); index++ {
+			field := goType.Field(index)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			name := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				tagName := strings.Split(tag, ",")[0]
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					name = tagName
+				}
+			}
+			property := SchemaOf(field.Type)
+			if field.Tag.Get("yaml") == "-" {
+				property.ReadOnly = true
+			}
+			schema.Properties[name] = property
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Nullable: true, Items: SchemaOf(goType.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", Nullable: true, AdditionalProperties: SchemaOf(goType.Elem())}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	default:
+		return &Schema{}
+	}
+}
+
+/*
+ValidateJSON validates a json document against the schema (undecodable documents are not reported)
+*/
+func ValidateJSON(data []byte, schema *Schema) []SchemaViolation {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+
+	var violations []SchemaViolation
+	validateValue(value, schema, "", &violations)
+	return violations
+}
+
+/*
+validateValue validates a single (decoded) json value
+*/
+func validateValue(value interface{}, schema *Schema, pointer string, violations *[]SchemaViolation) {
+	if value == nil || schema == nil || schema.Type == "" {
+		return
+	}
+
+	report := func(message string) {
+		location := pointer
+		if location == "" {
+			location = "/"
+		}
+		*violations = append(*violations, SchemaViolation{Pointer: location, Message: message})
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			report("object expected")
+			return
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyPointer := pointer + "/" + escapePointer(name)
+			if property := lookupProperty(schema, name); property != nil {
+				validateValue(object[name], property, propertyPointer, violations)
+			} else if additional, ok := schema.AdditionalProperties.(*Schema); ok {
+				validateValue(object[name], additional, propertyPointer, violations)
+			} else {
+				*violations = append(*violations, SchemaViolation{Pointer: propertyPointer, Message: "unknown attribute"})
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			report("array expected")
+			return
+		}
+		for index, item := range array {
+			validateValue(item, schema.Items, pointer+"/"+strconv.Itoa(index), violations)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			report("string expected")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			report("boolean expected")
+		}
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			report("integer expected")
+		} else if _, err := number.Int64(); err != nil {
+			report(fmt.Sprintf("integer expected, got %s", number))
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			report("number expected")
+		}
+	}
+}
+
+/*
+lookupProperty finds a property by name (exact match preferred, otherwise case-insensitive like encoding/json)
+*/
+func lookupProperty(schema *Schema, name string) *Schema {
+	if property, found := schema.Properties[name]; found {
+		return property
+	}
+	for propertyName, property := range schema.Properties {
+		if strings.EqualFold(propertyName, name) {
+			return property
+		}
+	}
+	return nil
+}
+
+/*
+escapePointer escapes a reference token of a json pointer (RFC 6901)
+*/
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,204 @@
+// Sandbox for user defined mapnik styles (symbolizers of user objects)
+
+package pd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// DataSourceTypes are the mapnik data sources usable by user objects (files of the map)
+var DataSourceTypes = []string{"shape", "ogr", "gdal", "geojson", "csv", "raster"}
+
+// styleElements are the elements allowed in the style of an user object (with their allowed child elements)
+var styleElements = map[string][]string{
+	"Filter":                   nil,
+	"ElseFilter":               nil,
+	"AlsoFilter":               nil,
+	"MinScaleDenominator":      nil,
+	"MaxScaleDenominator":      nil,
+	"PointSymbolizer":          nil,
+	"LineSymbolizer":           nil,
+	"LinePatternSymbolizer":    nil,
+	"PolygonSymbolizer":        nil,
+	"PolygonPatternSymbolizer": nil,
+	"MarkersSymbolizer":        nil,
+	"RasterSymbolizer":         nil,
+	"BuildingSymbolizer":       nil,
+	"DotSymbolizer":            nil,
+	"TextSymbolizer":           {"Format", "Layout"},
+	"ShieldSymbolizer":         {"Format", "Layout"},
+	"Format":                   {"Format"},
+	"Layout":                   nil,
+}
+
+// styleTextElements are the elements with text content (expressions)
+var styleTextElements = map[string]bool{
+	"Filter": true, "MinScaleDenominator": true, "MaxScaleDenominator": true,
+	"TextSymbolizer": true, "ShieldSymbolizer": true, "Format": true,
+}
+
+// styleAttributes are the attributes allowed in the style of an user object
+var styleAttributes = map[string]bool{
+	// general
+	"comp-op": true, "opacity": true, "smooth": true, "simplify": true, "simplify-algorithm": true, "clip": true,
+	"offset": true, "geometry-transform": true, "rasterizer": true, "transform": true, "gamma": true, "gamma-method": true,
+	// stroke and fill
+	"stroke": true, "stroke-width": true, "stroke-opacity": true, "stroke-linejoin": true, "stroke-linecap": true,
+	"stroke-dasharray": true, "stroke-dashoffset": true, "stroke-gamma": true, "stroke-gamma-method": true,
+	"stroke-miterlimit": true, "fill": true, "fill-opacity": true, "height": true, "width": true,
+	// markers and patterns
+	"file": true, "spacing": true, "max-error": true, "allow-overlap": true, "ignore-placement": true,
+	"placement": true, "marker-type": true, "avoid-edges": true, "direction": true, "multi-policy": true,
+	"alignment": true, "image-transform": true,
+	// text and shields
+	"face-name": true, "size": true, "character-spacing": true, "line-spacing": true, "text-opacity": true,
+	"halo-fill": true, "halo-radius": true, "halo-opacity": true, "halo-comp-op": true, "halo-transform": true,
+	"halo-rasterizer": true, "text-transform": true, "wrap-width": true, "wrap-before": true, "wrap-character": true,
+	"dx": true, "dy": true, "displacement": true, "label-position-tolerance": true, "minimum-distance": true,
+	"minimum-padding": true, "minimum-path-length": true, "margin": true, "repeat-distance": true,
+	"max-char-angle-delta": true, "orientation": true, "rotate-displacement": true, "horizontal-alignment": true,
+	"vertical-alignment": true, "justify-alignment": true, "text-ratio": true, "upright": true,
+	"largest-bbox-only": true, "placement-type": true, "placements": true, "font-feature-settings": true,
+	"shield-dx": true, "shield-dy": true, "unlock-image": true,
+	// raster
+	"scaling": true, "mode": true, "filter-factor": true, "mesh-size": true, "default-mode": true,
+	"default-color": true, "epsilon": true,
+}
+
+/*
+SanitizeStyle parses the style of an user object (mapnik symbolizers, content of a rule) and rebuilds it from the
+allowed elements and attributes only. File references must be plain file names (map directory or markers).
+The list of violations is empty if the style is accepted.
+*/
+func SanitizeStyle(style string) (string, []string) {
+	var violations []string
+	var output strings.Builder
+	var elements []string
+	enclosed := false
+
+	decoder := xml.NewDecoder(strings.NewReader("<Rule>" + style + "</Rule>"))
+	decoder.Strict = true
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", append(violations, fmt.Sprintf("malformed XML (%v)", err))
+		}
+
+		switch value := token.(type) {
+		case xml.StartElement:
+			if len(elements) == 0 {
+				if enclosed {
+					return "", append(violations, "element <"+value.Name.Local+"> outside of the rule not allowed")
+				}
+				// enclosing rule
+				enclosed = true
+				elements = append(elements, "Rule")
+				continue
+			}
+			parent := elements[len(elements)-1]
+			if reason := verifyStyleElement(value, parent); reason != "" {
+				violations = append(violations, reason)
+				if err := decoder.Skip(); err != nil {
+					return "", append(violations, fmt.Sprintf("malformed XML (%v)", err))
+				}
+				continue
+			}
+			elements = append(elements, value.Name.Local)
+			output.WriteString("\n<" + value.Name.Local)
+			for _, attr := range value.Attr {
+				if reason := verifyStyleAttribute(value.Name.Local, attr); reason != "" {
+					violations = append(violations, reason)
+					continue
+				}
+				output.WriteString(" " + attr.Name.Local + "=\"")
+				xml.EscapeText(&output, []byte(attr.Value))
+				output.WriteString("\"")
+			}
+			output.WriteString(">")
+		case xml.EndElement:
+			if len(elements) == 0 {
+				return "", append(violations, "end element </"+value.Name.Local+"> outside of the rule not allowed")
+			}
+			elements = elements[:len(elements)-1]
+			if len(elements) > 0 {
+				output.WriteString("</" + value.Name.Local + ">")
+			}
+		case xml.CharData:
+			if len(elements) == 0 {
+				// rule closed by the style (break-out)
+				return "", append(violations, "text outside of the rule not allowed")
+			}
+			element := elements[len(elements)-1]
+			if styleTextElements[element] {
+				xml.EscapeText(&output, value)
+			} else if strings.TrimSpace(string(value)) != "" {
+				violations = append(violations, fmt.Sprintf("text not allowed in <%s>", element))
+			}
+		case xml.ProcInst:
+			violations = append(violations, fmt.Sprintf("processing instruction <?%s?> not allowed", value.Target))
+		case xml.Directive:
+			violations = append(violations, "directives (e.g. entity declarations) not allowed")
+		}
+	}
+
+	if len(violations) > 0 {
+		return "", violations
+	}
+	return strings.TrimSpace(output.String()), nil
+}
+
+/*
+verifyStyleElement verifies an element of a style, returns the reason if not allowed.
+*/
+func verifyStyleElement(element xml.StartElement, parent string) string {
+	name := element.Name.Local
+	if element.Name.Space != "" {
+		return fmt.Sprintf("element <%s:%s> not allowed", element.Name.Space, name)
+	}
+	if _, ok := styleElements[name]; !ok {
+		return fmt.Sprintf("element <%s> not allowed", name)
+	}
+	if parent == "Rule" {
+		if name == "Format" || name == "Layout" {
+			return fmt.Sprintf("element <%s> not allowed outside of text symbolizers", name)
+		}
+		return ""
+	}
+	for _, child := range styleElements[parent] {
+		if child == name {
+			return ""
+		}
+	}
+	return fmt.Sprintf("element <%s> not allowed in <%s>", name, parent)
+}
+
+/*
+verifyStyleAttribute verifies an attribute of a style element, returns the reason if not allowed.
+*/
+func verifyStyleAttribute(element string, attr xml.Attr) string {
+	name := attr.Name.Local
+	if attr.Name.Space != "" {
+		name = attr.Name.Space + ":" + name
+	}
+	if attr.Name.Space != "" || !styleAttributes[name] {
+		return fmt.Sprintf("attribute '%s' of <%s> not allowed", name, element)
+	}
+	if name == "file" && !IsPlainFileName(attr.Value) {
+		return fmt.Sprintf("file reference '%s' of <%s> not allowed (plain file name of user file or marker expected)", attr.Value, element)
+	}
+	return ""
+}
+
+/*
+IsPlainFileName verifies that a file name refers to a file in the directory of the map (or the markers directory).
+*/
+func IsPlainFileName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "\\:")
+}
@@ -0,0 +1,91 @@
+// Tests of the sandbox for user defined mapnik styles
+
+package pd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeStyle(t *testing.T) {
+	tests := []struct {
+		name      string
+		style     string
+		want      string // sanitized style (accepted)
+		violation string // part of the first violation (rejected)
+	}{
+		{"line symbolizer", `<LineSymbolizer stroke="#ff0000" stroke-width="2"/>`,
+			`<LineSymbolizer stroke="#ff0000" stroke-width="2"></LineSymbolizer>`, ""},
+		{"filter and text", `<Filter>[type] = 'a'</Filter><TextSymbolizer face-name="DejaVu Sans Book" size="10">[name] &amp; &lt;x&gt;</TextSymbolizer>`,
+			"<Filter>[type] = &#39;a&#39;</Filter>\n<TextSymbolizer face-name=\"DejaVu Sans Book\" size=\"10\">[name] &amp; &lt;x&gt;</TextSymbolizer>", ""},
+		{"text format", `<TextSymbolizer size="10"><Format fill="#000000">[name]</Format></TextSymbolizer>`,
+			"<TextSymbolizer size=\"10\">\n<Format fill=\"#000000\">[name]</Format></TextSymbolizer>", ""},
+		{"marker file", `<PointSymbolizer file="marker.svg"/>`, `<PointSymbolizer file="marker.svg"></PointSymbolizer>`, ""},
+		{"empty", "", "", ""},
+
+		// break-out of the enclosing rule
+		{"rule closed, space", "</Rule> ", "", "outside of the rule"},
+		{"rule closed, text", "</Rule>x", "", "outside of the rule"},
+		{"rule closed, new rule", "</Rule><Rule>", "", "outside of the rule"},
+		{"rule closed, style closed", `</Rule></Style><Layer name="x"><Datasource/></Layer><Style><Rule>`, "", "malformed XML"},
+		{"rule closed, layer", `</Rule><Layer name="x"><Datasource/></Layer><Rule>`, "", "outside of the rule"},
+		{"rule closed, symbolizer", "</Rule><LineSymbolizer/>", "", "outside of the rule"},
+		{"unbalanced end element", "</LineSymbolizer>", "", "malformed XML"},
+		{"unclosed element", "<LineSymbolizer>", "", "malformed XML"},
+
+		// entities and directives
+		{"undefined entity", "&xxe;", "", "malformed XML"},
+		{"entity declaration", `<!DOCTYPE x [<!ENTITY a SYSTEM "file:///etc/passwd">]>`, "", "directives"},
+		{"external entity in text", `<TextSymbolizer>&xxe;</TextSymbolizer>`, "", "malformed XML"},
+		{"character reference", "&#x41;", "", "text not allowed in <Rule>"},
+		{"processing instruction", `<?xml-stylesheet href="x"?>`, "", "processing instruction"},
+		{"xinclude", `<xi:include xmlns:xi="http://www.w3.org/2001/XInclude" href="/etc/passwd"/>`, "", "not allowed"},
+
+		// elements outside of the symbolizers
+		{"datasource", `<Datasource><Parameter name="file">/etc/passwd</Parameter></Datasource>`, "", "element <Datasource> not allowed"},
+		{"layer", `<Layer name="x"><Datasource><Parameter name="type">postgis</Parameter></Datasource></Layer>`, "", "element <Layer> not allowed"},
+		{"parameter", `<Parameter name="file">/etc/passwd</Parameter>`, "", "element <Parameter> not allowed"},
+		{"nested layer", `<TextSymbolizer><Layer name="x"/></TextSymbolizer>`, "", "element <Layer> not allowed"},
+		{"format outside of text", `<Format fill="#000000"/>`, "", "outside of text symbolizers"},
+		{"symbolizer in symbolizer", `<LineSymbolizer><PolygonSymbolizer/></LineSymbolizer>`, "", "not allowed in <LineSymbolizer>"},
+		{"namespaced element", `<x:LineSymbolizer xmlns:x="urn:x"/>`, "", "not allowed"},
+
+		// file references
+		{"absolute file", `<PointSymbolizer file="/etc/passwd"/>`, "", "file reference"},
+		{"parent file", `<PointSymbolizer file="../maps/other/secret.png"/>`, "", "file reference"},
+		{"nested file", `<PointSymbolizer file="dir/marker.svg"/>`, "", "file reference"},
+		{"hidden file", `<PolygonPatternSymbolizer file=".metadata.json"/>`, "", "file reference"},
+		{"windows file", `<PointSymbolizer file="C:\marker.svg"/>`, "", "file reference"},
+		{"empty file", `<PointSymbolizer file=""/>`, "", "file reference"},
+
+		// attributes
+		{"unknown attribute", `<LineSymbolizer base="x"/>`, "", "attribute 'base'"},
+		{"namespaced attribute", `<PointSymbolizer xlink:href="/etc/passwd"/>`, "", "attribute 'xlink:href'"},
+		{"namespaced file attribute", `<PointSymbolizer xmlns:x="urn:x" x:file="marker.svg"/>`, "", "attribute 'xmlns:x'"},
+		{"text in symbolizer", `<LineSymbolizer>text</LineSymbolizer>`, "", "text not allowed in <LineSymbolizer>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, violations := SanitizeStyle(test.style)
+			if test.violation == "" {
+				if len(violations) > 0 {
+					t.Fatalf("SanitizeStyle() violations = %q, want none", violations)
+				}
+				if got != test.want {
+					t.Errorf("SanitizeStyle() =\n%q\nwant\n%q", got, test.want)
+				}
+				return
+			}
+			if len(violations) == 0 {
+				t.Fatalf("SanitizeStyle() = %q, want violation %q", got, test.violation)
+			}
+			if !strings.Contains(violations[0], test.violation) {
+				t.Errorf("SanitizeStyle() violations = %q, want %q", violations, test.violation)
+			}
+			if got != "" {
+				t.Errorf("SanitizeStyle() = %q with violations, want empty style", got)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -42,7 +43,7 @@ type MapnikData struct {
 /*
 buildMapnikMap builds the map.
 */
-func buildMapnikMap(tempdir string, pmData pd.PrintmapsData, pmState *pd.PrintmapsState) error {
+func buildMapnikMap(job *buildJob, tempdir string, pmData pd.PrintmapsData, pmState *pd.PrintmapsState) error {
 	var err error
 
 	// find mapnik xml file
@@ -62,28 +63,19 @@ func buildMapnikMap(tempdir string, pmData pd.PrintmapsData, pmState *pd.Printma
 	}
 	mapnikXML := filepath.Join(mapnikXMLPath, mapnikXMLFile)
 
-	hideLayersFeature := ""
-	if pmData.Data.Attributes.HideLayers != "" {
-		hideLayersFeature = fmt.Sprintf("--hide-layers '%s'", pmData.Data.Attributes.HideLayers)
-	}
-
 	mapnikMapname := filepath.Join(tempdir, mapBasename+"."+pmData.Data.Attributes.Fileformat)
 
-	pixelPerInch := 72 // pdf, svg
-	if pmData.Data.Attributes.Fileformat == "png" {
-		pixelPerInch = 300
-	}
-
 	// call mapnik driver in "info mode" (get the build parameters)
-	command := fmt.Sprintf("%s --debug --info --tiles 1 %s --projection '%s' --scale %d --size %f %f --ppi %d --center %f %f %s %s",
-		config.Mapnikdriver,
-		hideLayersFeature, pmData.Data.Attributes.Projection, pmData.Data.Attributes.Scale,
-		pmData.Data.Attributes.PrintWidth, pmData.Data.Attributes.PrintHeight,
-		pixelPerInch,
-		pmData.Data.Attributes.Longitude, pmData.Data.Attributes.Latitude,
-		mapnikXML, mapnikMapname)
+	command, err := mapnikCommand(pmData, true, mapnikXML, mapnikMapname)
+	if err != nil {
+		log.Printf("error <%v> at mapnikCommand(), id = <%s>", err, pmData.Data.ID)
+		return err
+	}
 
-	_, commandOutput, err := runCommand(command)
+	_, commandOutput, err := runCommand(job, command[0], command[1:]...)
+	if isBuildAborted(err) {
+		return err
+	}
 	if err != nil {
 		message := fmt.Sprintf("%v: %s", err, commandOutput)
 		log.Printf("error <%v> at runCommand()", message)
@@ -120,15 +112,16 @@ func buildMapnikMap(tempdir string, pmData pd.PrintmapsData, pmState *pd.Printma
 	}
 
 	// call mapnik driver in "build mode"
-	command = fmt.Sprintf("%s --debug --tiles 1 %s --projection '%s' --scale %d --size %f %f --ppi %d --center %f %f %s %s",
-		config.Mapnikdriver,
-		hideLayersFeature, pmData.Data.Attributes.Projection, pmData.Data.Attributes.Scale,
-		pmData.Data.Attributes.PrintWidth, pmData.Data.Attributes.PrintHeight,
-		pixelPerInch,
-		pmData.Data.Attributes.Longitude, pmData.Data.Attributes.Latitude,
-		mapnikXML, mapnikMapname)
+	command, err = mapnikCommand(pmData, false, mapnikXML, mapnikMapname)
+	if err != nil {
+		log.Printf("error <%v> at mapnikCommand(), id = <%s>", err, pmData.Data.ID)
+		return err
+	}
 
-	_, commandOutput, err = runCommand(command)
+	_, commandOutput, err = runCommand(job, command[0], command[1:]...)
+	if isBuildAborted(err) {
+		return err
+	}
 	if err != nil {
 		message := ""
 		if config.Testmode {
@@ -161,6 +154,70 @@ func buildMapnikMap(tempdir string, pmData pd.PrintmapsData, pmState *pd.Printma
 	return nil
 }
 
+/*
+mapnikCommand builds the command (program and arguments) of the mapnik driver. All values of the meta data are
+validated, each value is passed as separate argument (no shell involved).
+*/
+func mapnikCommand(pmData pd.PrintmapsData, infoMode bool, mapnikXML string, mapnikMapname string) ([]string, error) {
+	attributes := pmData.Data.Attributes
+
+	command := strings.Fields(config.Mapnikdriver)
+	if len(command) == 0 {
+		return nil, errors.New("mapnik driver not configured")
+	}
+
+	var pixelPerInch int
+	switch attributes.Fileformat {
+	case "png":
+		pixelPerInch = 300
+	case "pdf", "svg":
+		pixelPerInch = 72
+	default:
+		return nil, fmt.Errorf("invalid file format <%s>", attributes.Fileformat)
+	}
+	if !pd.IsValidProjection(attributes.Projection) {
+		return nil, fmt.Errorf("invalid projection <%s>", attributes.Projection)
+	}
+	if attributes.Scale <= 0 {
+		return nil, fmt.Errorf("invalid scale <%d>", attributes.Scale)
+	}
+	if !isPositiveNumber(attributes.PrintWidth) || !isPositiveNumber(attributes.PrintHeight) {
+		return nil, fmt.Errorf("invalid print size <%f x %f>", attributes.PrintWidth, attributes.PrintHeight)
+	}
+	if math.IsNaN(attributes.Latitude) || attributes.Latitude < -90.0 || attributes.Latitude > 90.0 ||
+		math.IsNaN(attributes.Longitude) || attributes.Longitude < -180.0 || attributes.Longitude > 180.0 {
+		return nil, fmt.Errorf("invalid center <%f %f>", attributes.Longitude, attributes.Latitude)
+	}
+
+	command = append(command, "--debug")
+	if infoMode {
+		command = append(command, "--info")
+	}
+	command = append(command, "--tiles", "1")
+	if !pd.IsValidHideLayers(attributes.HideLayers) {
+		return nil, fmt.Errorf("invalid layers to hide <%s>", attributes.HideLayers)
+	}
+	if attributes.HideLayers != "" {
+		command = append(command, "--hide-layers", attributes.HideLayers)
+	}
+	command = append(command,
+		"--projection", attributes.Projection,
+		"--scale", strconv.Itoa(attributes.Scale),
+		"--size", fmt.Sprintf("%f", attributes.PrintWidth), fmt.Sprintf("%f", attributes.PrintHeight),
+		"--ppi", strconv.Itoa(pixelPerInch),
+		"--center", fmt.Sprintf("%f", attributes.Longitude), fmt.Sprintf("%f", attributes.Latitude),
+		mapnikXML, mapnikMapname)
+
+	return command, nil
+}
+
+/*
+isPositiveNumber checks if a value is a positive (finite) number.
+*/
+func isPositiveNumber(value float64) bool {
+	return value > 0.0 && !math.IsInf(value, 1)
+}
+
 /*
 createUserMapnikXML creates an individual user mapnik xml file.
 */
@@ -201,7 +258,11 @@ func createUserMapnikXML(pmData pd.PrintmapsData, mapnikData MapnikData) (string
 	}
 
 	// user items
-	includeLines = createUserObjects(includeLines, pmData, mapnikData, pmData.Data.Attributes.PrintWidth, pmData.Data.Attributes.PrintHeight)
+	includeLines, err = createUserObjects(includeLines, pmData, mapnikData, pmData.Data.Attributes.PrintWidth, pmData.Data.Attributes.PrintHeight)
+	if err != nil {
+		log.Printf("error <%v> at createUserObjects(), id = <%s>", err, pmData.Data.ID)
+		return "", err
+	}
 
 	// modify file references
 	includeLines = modifyFileReferences(includeLines, pmData)
@@ -325,15 +386,20 @@ func createRasterMap(lineBuffer []string, mapnikData MapnikData, pmData pd.Print
 createUserObjects creates the user defined data elementes.
 
 OGR:
-  <Parameter name="type">ogr</Parameter>
-  <Parameter name="file">test_point_line.gpx</Parameter>
-  <Parameter name="layer">waypoints</Parameter>
+
+	<Parameter name="type">ogr</Parameter>
+	<Parameter name="file">test_point_line.gpx</Parameter>
+	<Parameter name="layer">waypoints</Parameter>
+
 ShapeFile:
-  <Parameter name="type">shape</Parameter>
-  <Parameter name="file">/path/to/your/shapefile.shp</Parameter>
+
+	<Parameter name="type">shape</Parameter>
+	<Parameter name="file">/path/to/your/shapefile.shp</Parameter>
+
 GDAL:
-  <Parameter name="type">gdal</Parameter>
-  <Parameter name="file">/path/to/your/data/raster.tiff</Parameter>
+
+	<Parameter name="type">gdal</Parameter>
+	<Parameter name="file">/path/to/your/data/raster.tiff</Parameter>
 
 data object has filled elements:
 - Style
@@ -345,16 +411,28 @@ data object has filled elements:
 item object has filled elements:
 - Style
 - WellKnownText
+
+The style is rebuilt from the allowed mapnik symbolizers (sandbox), all other values are escaped.
 */
-func createUserObjects(lineBuffer []string, pmData pd.PrintmapsData, mapnikData MapnikData, width float64, height float64) []string {
+func createUserObjects(lineBuffer []string, pmData pd.PrintmapsData, mapnikData MapnikData, width float64, height float64) ([]string, error) {
 	for index, userObject := range pmData.Data.Attributes.UserObjects {
+		style, violations := pd.SanitizeStyle(userObject.Style)
+		if len(violations) > 0 {
+			return lineBuffer, fmt.Errorf("style of user object %d rejected: %s", index, strings.Join(violations, "; "))
+		}
+		if userObject.WellKnownText == "" {
+			// data object: file of the map only
+			if !isDataSourceType(userObject.Type) || !pd.IsPlainFileName(userObject.File) {
+				return lineBuffer, fmt.Errorf("data source of user object %d rejected (type <%s>, file <%s>)", index, userObject.Type, userObject.File)
+			}
+		}
 		if userObject.WellKnownText != "" {
 			// item object
 			objectName := fmt.Sprintf("userobject-%d", index)
 			lineBuffer = append(lineBuffer, fmt.Sprintf("\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("<Style name='%s'>\n", objectName))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  <Rule>\n"))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("    %s\n", userObject.Style))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("    %s\n", style))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  </Rule>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("</Style>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("\n"))
@@ -364,7 +442,7 @@ func createUserObjects(lineBuffer []string, pmData pd.PrintmapsData, mapnikData
 			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='type'>csv</Parameter>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='inline'>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("id|name|wkt\n"))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("1|%s|%s\n", objectName, transformWellKnownText(userObject.WellKnownText, mapnikData, width, height)))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("1|%s|%s\n", objectName, escapeXML(transformWellKnownText(userObject.WellKnownText, mapnikData, width, height))))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("    </Parameter>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  </Datasource>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("</Layer>\n"))
@@ -374,24 +452,24 @@ func createUserObjects(lineBuffer []string, pmData pd.PrintmapsData, mapnikData
 			lineBuffer = append(lineBuffer, fmt.Sprintf("\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("<Style name='%s'>\n", objectName))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  <Rule>\n"))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("    %s\n", userObject.Style))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("    %s\n", style))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  </Rule>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("</Style>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("\n"))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("<Layer name='%s' srs='%s'>\n", objectName, userObject.SRS))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("<Layer name='%s' srs='%s'>\n", objectName, escapeXML(userObject.SRS)))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  <StyleName>%s</StyleName>\n", objectName))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  <Datasource>\n"))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='type'>%s</Parameter>\n", userObject.Type))
-			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='file'>%s</Parameter>\n", userObject.File))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='type'>%s</Parameter>\n", escapeXML(userObject.Type)))
+			lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='file'>%s</Parameter>\n", escapeXML(userObject.File)))
 			if userObject.Layer != "" {
-				lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='layer'>%s</Parameter>\n", userObject.Layer))
+				lineBuffer = append(lineBuffer, fmt.Sprintf("    <Parameter name='layer'>%s</Parameter>\n", escapeXML(userObject.Layer)))
 			}
 			lineBuffer = append(lineBuffer, fmt.Sprintf("  </Datasource>\n"))
 			lineBuffer = append(lineBuffer, fmt.Sprintf("</Layer>\n"))
 		}
 	}
 
-	return lineBuffer
+	return lineBuffer, nil
 }
 
 /*
@@ -0,0 +1,132 @@
+// Tests of the mapnik driver command (hostile meta data must never reach the driver)
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+testMapData returns valid meta data for the command tests.
+*/
+func testMapData() pd.PrintmapsData {
+	var pmData pd.PrintmapsData
+	pmData.Data.ID = "6f5d9d1c-3c8e-4b0a-9a51-9e4b2f8c7d10"
+	pmData.Data.Attributes.Fileformat = "png"
+	pmData.Data.Attributes.Scale = 25000
+	pmData.Data.Attributes.PrintWidth = 420
+	pmData.Data.Attributes.PrintHeight = 594
+	pmData.Data.Attributes.Latitude = 51.9612
+	pmData.Data.Attributes.Longitude = 7.6257
+	pmData.Data.Attributes.Projection = "3857"
+	return pmData
+}
+
+func TestMapnikCommand(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config.Mapnikdriver = "python3 /opt/nik4/nik4.py"
+
+	tests := []struct {
+		name     string
+		modify   func(attributes *pd.Metadata)
+		infoMode bool
+		want     []string // nil = error expected
+	}{
+		{"valid build mode", func(a *pd.Metadata) {}, false, []string{
+			"python3", "/opt/nik4/nik4.py", "--debug", "--tiles", "1",
+			"--projection", "3857", "--scale", "25000", "--size", "420.000000", "594.000000", "--ppi", "300",
+			"--center", "7.625700", "51.961200", "/styles/my map.xml", "/tmp/build dir/printmaps.png"}},
+		{"valid info mode with hidden layers", func(a *pd.Metadata) {
+			a.HideLayers = "buildings,highway-area_casing"
+			a.Fileformat = "pdf"
+		}, true, []string{
+			"python3", "/opt/nik4/nik4.py", "--debug", "--info", "--tiles", "1", "--hide-layers", "buildings,highway-area_casing",
+			"--projection", "3857", "--scale", "25000", "--size", "420.000000", "594.000000", "--ppi", "72",
+			"--center", "7.625700", "51.961200", "/styles/my map.xml", "/tmp/build dir/printmaps.png"}},
+		{"valid edge of world", func(a *pd.Metadata) {
+			a.Latitude = -90
+			a.Longitude = 180
+		}, false, []string{
+			"python3", "/opt/nik4/nik4.py", "--debug", "--tiles", "1",
+			"--projection", "3857", "--scale", "25000", "--size", "420.000000", "594.000000", "--ppi", "300",
+			"--center", "180.000000", "-90.000000", "/styles/my map.xml", "/tmp/build dir/printmaps.png"}},
+
+		{"hide layers with semicolon", func(a *pd.Metadata) { a.HideLayers = "buildings;rm -rf /" }, false, nil},
+		{"hide layers with command substitution", func(a *pd.Metadata) { a.HideLayers = "$(id)" }, false, nil},
+		{"hide layers with backticks", func(a *pd.Metadata) { a.HideLayers = "`id`" }, false, nil},
+		{"hide layers with double quotes", func(a *pd.Metadata) { a.HideLayers = `buildings" --output "/etc/passwd` }, false, nil},
+		{"hide layers with single quotes", func(a *pd.Metadata) { a.HideLayers = "'buildings'" }, false, nil},
+		{"hide layers with space", func(a *pd.Metadata) { a.HideLayers = "buildings, highways" }, false, nil},
+		{"hide layers with newline", func(a *pd.Metadata) { a.HideLayers = "buildings\n--info" }, false, nil},
+		{"hide layers with option", func(a *pd.Metadata) { a.HideLayers = "--info" }, false, nil},
+		{"hide layers with empty name", func(a *pd.Metadata) { a.HideLayers = "buildings," }, false, nil},
+
+		{"projection with semicolon", func(a *pd.Metadata) { a.Projection = "3857;id" }, false, nil},
+		{"projection with command substitution", func(a *pd.Metadata) { a.Projection = "$(id)" }, false, nil},
+		{"projection with quotes", func(a *pd.Metadata) { a.Projection = `"3857"` }, false, nil},
+		{"projection with space", func(a *pd.Metadata) { a.Projection = "3857 --info" }, false, nil},
+		{"projection with newline", func(a *pd.Metadata) { a.Projection = "3857\n" }, false, nil},
+		{"projection negative", func(a *pd.Metadata) { a.Projection = "-3857" }, false, nil},
+		{"projection too long", func(a *pd.Metadata) { a.Projection = "1234567" }, false, nil},
+		{"projection empty", func(a *pd.Metadata) { a.Projection = "" }, false, nil},
+
+		{"file format with semicolon", func(a *pd.Metadata) { a.Fileformat = "png;id" }, false, nil},
+		{"scale zero", func(a *pd.Metadata) { a.Scale = 0 }, false, nil},
+		{"scale negative", func(a *pd.Metadata) { a.Scale = -25000 }, false, nil},
+
+		{"width NaN", func(a *pd.Metadata) { a.PrintWidth = math.NaN() }, false, nil},
+		{"height NaN", func(a *pd.Metadata) { a.PrintHeight = math.NaN() }, false, nil},
+		{"width +Inf", func(a *pd.Metadata) { a.PrintWidth = math.Inf(1) }, false, nil},
+		{"height -Inf", func(a *pd.Metadata) { a.PrintHeight = math.Inf(-1) }, false, nil},
+		{"width zero", func(a *pd.Metadata) { a.PrintWidth = 0 }, false, nil},
+		{"height negative", func(a *pd.Metadata) { a.PrintHeight = -594 }, false, nil},
+
+		{"latitude NaN", func(a *pd.Metadata) { a.Latitude = math.NaN() }, false, nil},
+		{"longitude NaN", func(a *pd.Metadata) { a.Longitude = math.NaN() }, false, nil},
+		{"latitude above range", func(a *pd.Metadata) { a.Latitude = 90.0001 }, false, nil},
+		{"latitude below range", func(a *pd.Metadata) { a.Latitude = -91 }, false, nil},
+		{"longitude above range", func(a *pd.Metadata) { a.Longitude = 180.5 }, false, nil},
+		{"longitude below range", func(a *pd.Metadata) { a.Longitude = -181 }, false, nil},
+		{"longitude +Inf", func(a *pd.Metadata) { a.Longitude = math.Inf(1) }, false, nil},
+		{"latitude -Inf", func(a *pd.Metadata) { a.Latitude = math.Inf(-1) }, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pmData := testMapData()
+			test.modify(&pmData.Data.Attributes)
+
+			command, err := mapnikCommand(pmData, test.infoMode, "/styles/my map.xml", "/tmp/build dir/printmaps.png")
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("mapnikCommand() = %q, want error", command)
+				}
+				if command != nil {
+					t.Errorf("mapnikCommand() returned command %q with error", command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mapnikCommand() failed: %v", err)
+			}
+			if !reflect.DeepEqual(command, test.want) {
+				t.Errorf("mapnikCommand() =\n%q\nwant\n%q", command, test.want)
+			}
+		})
+	}
+}
+
+func TestMapnikCommandWithoutDriver(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config.Mapnikdriver = "  "
+
+	if command, err := mapnikCommand(testMapData(), false, "map.xml", "printmaps.png"); err == nil {
+		t.Errorf("mapnikCommand() = %q, want error (driver not configured)", command)
+	}
+}
@@ -0,0 +1,373 @@
+// Callback (webhook) delivery after build completion
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// callback defaults (used if not configured)
+const (
+	defaultCallbackAttempts = 5  // max number of delivery attempts
+	defaultCallbackBackoff  = 2  // delay (seconds) before the first retry, doubled for every further retry
+	defaultCallbackTimeout  = 10 // timeout (seconds) of a single delivery attempt
+)
+
+// callbackBackoffUnit is the unit of the configured backoff
+var callbackBackoffUnit = time.Second
+
+// allowed destinations of callbacks (config 'callbackallow')
+var (
+	callbackAllowedHosts    []string     // host names (optionally with leading wildcard '*.')
+	callbackAllowedNetworks []*net.IPNet // networks (internal addresses are allowed within)
+)
+
+// internal networks not covered by the net.IP methods (private, shared and reserved address space)
+var internalNetworks = parseNetworks(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // shared address space (carrier-grade NAT)
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved (incl. broadcast)
+	"fc00::/7",       // unique local
+	"64:ff9b::/96",   // NAT64 (embeds IPv4 addresses)
+)
+
+// blockedCallbackError reports a callback destination which is not allowed (no retry)
+type blockedCallbackError struct {
+	reason string
+}
+
+/*
+Error describes the rejected destination.
+*/
+func (e *blockedCallbackError) Error() string {
+	return "callback destination not allowed: " + e.reason
+}
+
+// pending callback deliveries (awaited on shutdown)
+var pendingCallbacks sync.WaitGroup
+
+// serializes the updates of the callback files
+var callbacksMutex sync.Mutex
+
+/*
+startCallback starts the (asynchronous) delivery of the final map state to the callback url of the map.
+*/
+func startCallback(pmData pd.PrintmapsData, pmState pd.PrintmapsState) {
+	if pmData.Data.Attributes.CallbackURL == "" {
+		return
+	}
+
+	pendingCallbacks.Add(1)
+	go func() {
+		defer pendingCallbacks.Done()
+		deliverCallback(pmData, pmState)
+	}()
+}
+
+/*
+deliverCallback posts the final map state to the callback url (with retries and exponential backoff).
+Every delivery attempt is recorded in the callbacks file of the map.
+*/
+func deliverCallback(pmData pd.PrintmapsData, pmState pd.PrintmapsState) {
+	attempts := config.Callbackattempts
+	if attempts <= 0 {
+		attempts = defaultCallbackAttempts
+	}
+	backoff := time.Duration(config.Callbackbackoff) * callbackBackoffUnit
+	if backoff <= 0 {
+		backoff = defaultCallbackBackoff * callbackBackoffUnit
+	}
+	timeout := time.Duration(config.Callbacktimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout * time.Second
+	}
+
+	body, err := json.MarshalIndent(pmState, pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return
+	}
+
+	client := newCallbackClient(timeout)
+	url := pmData.Data.Attributes.CallbackURL
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		callbackAttempt := pd.CallbackAttempt{
+			MapBuildCompleted: pmState.Data.Attributes.MapBuildCompleted,
+			Attempt:           attempt,
+			Time:              time.Now().Format(time.RFC3339),
+			URL:               url,
+		}
+
+		start := time.Now()
+		retry := false
+		statusCode, err := postCallback(client, url, body, pmData.Data.Attributes.CallbackSecret, attempt)
+		callbackAttempt.Duration = time.Since(start).Round(time.Millisecond).String()
+		callbackAttempt.StatusCode = statusCode
+
+		var blocked *blockedCallbackError
+		switch {
+		case errors.As(err, &blocked):
+			callbackAttempt.Error = blocked.Error()
+		case err != nil:
+			callbackAttempt.Error = err.Error()
+			retry = true
+		case statusCode >= 200 && statusCode <= 299:
+			callbackAttempt.Delivered = true
+		case statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests:
+			callbackAttempt.Error = "unexpected status code (retry)"
+			retry = true
+		default:
+			callbackAttempt.Error = "unexpected status code (no retry)"
+		}
+
+		recordCallbackAttempt(pmData.Data.ID, callbackAttempt)
+
+		if !retry {
+			return
+		}
+		log.Printf("callback delivery failed, id = <%s>, attempt = %d, error = <%s>", pmData.Data.ID, attempt, callbackAttempt.Error)
+
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Printf("callback delivery finally failed, id = <%s>, url = <%s>", pmData.Data.ID, url)
+}
+
+/*
+newCallbackClient creates the http client for callback deliveries. The destination is verified when the
+connection is established (after name resolution, DNS rebinding is ineffective). Redirects are not followed.
+*/
+func newCallbackClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		Proxy: nil, // a proxy would establish the connection to the (unverified) destination
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialCallback(ctx, dialer, network, address)
+		},
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/*
+dialCallback resolves the host and connects to the first allowed address.
+*/
+func dialCallback(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = &blockedCallbackError{reason: "no address of host " + host}
+	for _, ipAddress := range addresses {
+		if verifyErr := verifyCallbackDestination(host, ipAddress.IP); verifyErr != nil {
+			err = verifyErr
+			continue
+		}
+		conn, dialErr := dialer.DialContext(ctx, network, net.JoinHostPort(ipAddress.IP.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
+
+/*
+verifyCallbackDestination verifies the host and the resolved address of a callback against the allowlist.
+Internal addresses are allowed only within a listed network.
+*/
+func verifyCallbackDestination(host string, ip net.IP) error {
+	for _, network := range callbackAllowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	if isInternalIP(ip) {
+		return &blockedCallbackError{reason: fmt.Sprintf("internal address %s of host %s", ip, host)}
+	}
+
+	if len(callbackAllowedHosts) > 0 && !isAllowedCallbackHost(host) {
+		return &blockedCallbackError{reason: fmt.Sprintf("host %s not in allowlist", host)}
+	}
+	return nil
+}
+
+/*
+isInternalIP checks if the address is loopback, private, link-local, unspecified, multicast or reserved.
+*/
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+isAllowedCallbackHost checks if the host name is listed (exactly or by wildcard '*.domain').
+*/
+func isAllowedCallbackHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range callbackAllowedHosts {
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+parseCallbackAllowlist parses the allowed callback destinations (host names and networks in CIDR notation).
+*/
+func parseCallbackAllowlist(entries []string) error {
+	callbackAllowedHosts = nil
+	callbackAllowedNetworks = nil
+
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return err
+			}
+			callbackAllowedNetworks = append(callbackAllowedNetworks, network)
+		case net.ParseIP(entry) != nil:
+			return fmt.Errorf("address <%s> not allowed, use CIDR notation (e.g. %s/32)", entry, entry)
+		default:
+			callbackAllowedHosts = append(callbackAllowedHosts, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return nil
+}
+
+/*
+parseNetworks parses a list of networks in CIDR notation (panics on invalid entries).
+*/
+func parseNetworks(entries ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+/*
+postCallback sends a single callback request and returns the http status code.
+The body is signed (hmac-sha256) if a secret is given.
+*/
+func postCallback(client *http.Client, url string, body []byte, secret string, attempt int) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", pd.JSONAPIMediaType)
+	req.Header.Set("User-Agent", "Printmaps-Buildservice/"+progVersion)
+	req.Header.Set("X-Printmaps-Event", "build.completed")
+	req.Header.Set("X-Printmaps-Attempt", fmt.Sprintf("%d", attempt))
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Printmaps-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// drain (limited) body to allow connection reuse
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return resp.StatusCode, nil
+}
+
+/*
+recordCallbackAttempt appends a delivery attempt to the callbacks file of the map.
+*/
+func recordCallbackAttempt(id string, callbackAttempt pd.CallbackAttempt) {
+	var pmCallbacks pd.PrintmapsCallbacks
+
+	callbacksMutex.Lock()
+	defer callbacksMutex.Unlock()
+
+	// map deleted in the meantime
+	if !pd.IsExistMapDirectory(id) {
+		return
+	}
+
+	if err := pd.ReadCallbacks(&pmCallbacks, id); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error <%v> at pd.ReadCallbacks(), id = <%s>", err, id)
+		}
+	}
+
+	pmCallbacks.Data.Type = "maps"
+	pmCallbacks.Data.ID = id
+	pmCallbacks.Data.Attributes.Attempts = append(pmCallbacks.Data.Attributes.Attempts, callbackAttempt)
+
+	if err := pd.WriteCallbacks(pmCallbacks); err != nil {
+		log.Printf("error <%v> at pd.WriteCallbacks(), id = <%s>", err, id)
+	}
+}
@@ -0,0 +1,280 @@
+// Tests of the callback (webhook) delivery
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// received callback request
+type receivedCallback struct {
+	time      time.Time
+	header    http.Header
+	body      []byte
+	signature string
+}
+
+/*
+setupCallbackTest prepares a working directory with a map and a local receiver answering with the given status codes.
+Loopback addresses are allowed for the receiver unless blocked is set.
+*/
+func setupCallbackTest(t *testing.T, blocked bool, statusCodes ...int) (pd.PrintmapsData, pd.PrintmapsState, *[]receivedCallback) {
+	t.Helper()
+
+	var mutex sync.Mutex
+	var received []receivedCallback
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, receivedCallback{time: time.Now(), header: request.Header.Clone(), body: body})
+		statusCode := http.StatusOK
+		if len(received) <= len(statusCodes) {
+			statusCode = statusCodes[len(received)-1]
+		}
+		if statusCode == http.StatusFound {
+			http.Redirect(writer, request, "/redirected", statusCode)
+			return
+		}
+		writer.WriteHeader(statusCode)
+	}))
+	t.Cleanup(server.Close)
+
+	savedWorkdir, savedConfig, savedUnit := pd.PathWorkdir, config, callbackBackoffUnit
+	t.Cleanup(func() {
+		pd.PathWorkdir, config, callbackBackoffUnit = savedWorkdir, savedConfig, savedUnit
+		parseCallbackAllowlist(config.Callbackallow)
+	})
+
+	pd.PathWorkdir = t.TempDir()
+	config.Callbackattempts = 4
+	config.Callbackbackoff = 20
+	config.Callbacktimeout = 5
+	config.Callbackallow = nil
+	if !blocked {
+		config.Callbackallow = []string{"127.0.0.0/8"}
+	}
+	callbackBackoffUnit = time.Millisecond
+	if err := parseCallbackAllowlist(config.Callbackallow); err != nil {
+		t.Fatalf("parseCallbackAllowlist() failed: %v", err)
+	}
+
+	var pmData pd.PrintmapsData
+	pmData.Data.ID = "6f5d9d1c-3c8e-4b0a-9a51-9e4b2f8c7d10"
+	pmData.Data.Attributes.CallbackURL = server.URL + "/hook"
+	pmData.Data.Attributes.CallbackSecret = "s3cret"
+	if err := os.MkdirAll(filepath.Join(pd.PathWorkdir, pd.PathMaps, pmData.Data.ID), 0755); err != nil {
+		t.Fatalf("os.MkdirAll() failed: %v", err)
+	}
+
+	var pmState pd.PrintmapsState
+	pmState.Data.ID = pmData.Data.ID
+	pmState.Data.Attributes.MapBuildCompleted = "2026-10-17T12:00:00Z"
+	pmState.Data.Attributes.MapBuildSuccessful = "yes"
+
+	return pmData, pmState, &received
+}
+
+/*
+readAttempts reads the recorded delivery attempts of the map.
+*/
+func readAttempts(t *testing.T, id string) []pd.CallbackAttempt {
+	t.Helper()
+
+	var pmCallbacks pd.PrintmapsCallbacks
+	if err := pd.ReadCallbacks(&pmCallbacks, id); err != nil {
+		t.Fatalf("pd.ReadCallbacks() failed: %v", err)
+	}
+	return pmCallbacks.Data.Attributes.Attempts
+}
+
+func TestCallbackSignature(t *testing.T) {
+	pmData, pmState, received := setupCallbackTest(t, false)
+
+	deliverCallback(pmData, pmState)
+
+	if len(*received) != 1 {
+		t.Fatalf("received %d requests, want 1", len(*received))
+	}
+	request := (*received)[0]
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(request.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := request.header.Get("X-Printmaps-Signature"); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := request.header.Get("X-Printmaps-Event"); got != "build.completed" {
+		t.Errorf("event = %q, want build.completed", got)
+	}
+	if got := request.header.Get("Content-Type"); got != pd.JSONAPIMediaType {
+		t.Errorf("content type = %q, want %q", got, pd.JSONAPIMediaType)
+	}
+	if !strings.Contains(string(request.body), pmState.Data.Attributes.MapBuildCompleted) {
+		t.Errorf("body does not contain the map state: %s", request.body)
+	}
+
+	attempts := readAttempts(t, pmData.Data.ID)
+	if len(attempts) != 1 || !attempts[0].Delivered || attempts[0].StatusCode != http.StatusOK {
+		t.Errorf("attempts = %+v, want one delivered attempt", attempts)
+	}
+}
+
+func TestCallbackRetryBackoff(t *testing.T) {
+	pmData, pmState, received := setupCallbackTest(t, false, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK)
+
+	deliverCallback(pmData, pmState)
+
+	if len(*received) != 3 {
+		t.Fatalf("received %d requests, want 3", len(*received))
+	}
+	for index, request := range *received {
+		if got, want := request.header.Get("X-Printmaps-Attempt"), string(rune('1'+index)); got != want {
+			t.Errorf("request %d: attempt header = %q, want %q", index, got, want)
+		}
+	}
+
+	// backoff 20 ms, doubled for the second retry
+	first := (*received)[1].time.Sub((*received)[0].time)
+	second := (*received)[2].time.Sub((*received)[1].time)
+	if first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Errorf("backoff = %v, %v, want at least 20ms, 40ms", first, second)
+	}
+
+	attempts := readAttempts(t, pmData.Data.ID)
+	if len(attempts) != 3 {
+		t.Fatalf("recorded %d attempts, want 3: %+v", len(attempts), attempts)
+	}
+	wantStatus := []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK}
+	for index, attempt := range attempts {
+		if attempt.Attempt != index+1 || attempt.StatusCode != wantStatus[index] || attempt.Delivered != (index == 2) {
+			t.Errorf("attempt %d = %+v", index+1, attempt)
+		}
+		if attempt.MapBuildCompleted != pmState.Data.Attributes.MapBuildCompleted || attempt.URL != pmData.Data.Attributes.CallbackURL {
+			t.Errorf("attempt %d: build or url not recorded: %+v", index+1, attempt)
+		}
+	}
+}
+
+func TestCallbackNoRetry(t *testing.T) {
+	pmData, pmState, received := setupCallbackTest(t, false, http.StatusBadRequest)
+
+	deliverCallback(pmData, pmState)
+
+	if len(*received) != 1 {
+		t.Fatalf("received %d requests, want 1 (no retry on status 400)", len(*received))
+	}
+	attempts := readAttempts(t, pmData.Data.ID)
+	if len(attempts) != 1 || attempts[0].Delivered || attempts[0].StatusCode != http.StatusBadRequest {
+		t.Errorf("attempts = %+v, want one failed attempt", attempts)
+	}
+}
+
+func TestCallbackRedirectNotFollowed(t *testing.T) {
+	pmData, pmState, received := setupCallbackTest(t, false, http.StatusFound)
+
+	deliverCallback(pmData, pmState)
+
+	if len(*received) != 1 {
+		t.Fatalf("received %d requests, want 1 (redirect must not be followed)", len(*received))
+	}
+	attempts := readAttempts(t, pmData.Data.ID)
+	if len(attempts) != 1 || attempts[0].Delivered || attempts[0].StatusCode != http.StatusFound {
+		t.Errorf("attempts = %+v, want one undelivered attempt with status 302", attempts)
+	}
+}
+
+func TestCallbackInternalAddressBlocked(t *testing.T) {
+	pmData, pmState, received := setupCallbackTest(t, true)
+
+	deliverCallback(pmData, pmState)
+
+	if len(*received) != 0 {
+		t.Fatalf("received %d requests, want 0 (loopback address blocked)", len(*received))
+	}
+	attempts := readAttempts(t, pmData.Data.ID)
+	if len(attempts) != 1 || attempts[0].Delivered || !strings.Contains(attempts[0].Error, "not allowed") {
+		t.Errorf("attempts = %+v, want one rejected attempt without retry", attempts)
+	}
+}
+
+func TestVerifyCallbackDestination(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() {
+		config = savedConfig
+		parseCallbackAllowlist(config.Callbackallow)
+	})
+
+	tests := []struct {
+		allow   []string
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{nil, "example.com", "93.184.216.34", true},
+		{nil, "example.com", "2606:2800:220:1::1", true},
+		{nil, "localhost", "127.0.0.1", false},
+		{nil, "localhost", "::1", false},
+		{nil, "metadata", "169.254.169.254", false},
+		{nil, "intranet", "10.1.2.3", false},
+		{nil, "intranet", "172.20.0.1", false},
+		{nil, "intranet", "192.168.1.1", false},
+		{nil, "cgnat", "100.64.0.1", false},
+		{nil, "any", "0.0.0.0", false},
+		{nil, "any", "::", false},
+		{nil, "multicast", "224.0.0.1", false},
+		{nil, "multicast", "ff02::1", false},
+		{nil, "ula", "fd00::1", false},
+		{nil, "linklocal", "fe80::1", false},
+		{nil, "mapped", "::ffff:127.0.0.1", false},
+		{nil, "mapped", "::ffff:10.0.0.1", false},
+		{nil, "broadcast", "255.255.255.255", false},
+		{[]string{"10.1.2.0/24"}, "intranet", "10.1.2.3", true},
+		{[]string{"10.1.2.0/24"}, "intranet", "10.1.3.3", false},
+		{[]string{"hooks.example.com"}, "hooks.example.com", "93.184.216.34", true},
+		{[]string{"hooks.example.com"}, "Hooks.Example.com.", "93.184.216.34", true},
+		{[]string{"hooks.example.com"}, "other.example.com", "93.184.216.34", false},
+		{[]string{"hooks.example.com"}, "hooks.example.com", "127.0.0.1", false},
+		{[]string{"*.example.com"}, "a.b.example.com", "93.184.216.34", true},
+		{[]string{"*.example.com"}, "example.com", "93.184.216.34", false},
+		{[]string{"*.example.com"}, "badexample.com", "93.184.216.34", false},
+	}
+
+	for _, test := range tests {
+		if err := parseCallbackAllowlist(test.allow); err != nil {
+			t.Fatalf("parseCallbackAllowlist(%v) failed: %v", test.allow, err)
+		}
+		err := verifyCallbackDestination(test.host, net.ParseIP(test.ip))
+		if (err == nil) != test.allowed {
+			t.Errorf("allow %v, host %s, ip %s: error = %v, want allowed = %v", test.allow, test.host, test.ip, err, test.allowed)
+		}
+	}
+}
+
+func TestParseCallbackAllowlist(t *testing.T) {
+	savedConfig := config
+	t.Cleanup(func() {
+		config = savedConfig
+		parseCallbackAllowlist(config.Callbackallow)
+	})
+
+	for _, entries := range [][]string{{"10.0.0.0/33"}, {"10.1.2.3"}, {"::1"}} {
+		if err := parseCallbackAllowlist(entries); err == nil {
+			t.Errorf("parseCallbackAllowlist(%v) succeeded, want error", entries)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Health and readiness handler
+
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+revealHealth reports the liveness of this service (process is running).
+*/
+func revealHealth(writer http.ResponseWriter, _ *http.Request) {
+	var report pd.HealthReport
+
+	report.AddCheck("listener", nil)
+	pd.WriteHealthReport(writer, report)
+}
+
+/*
+revealReadiness reports the readiness of this service (able to build maps).
+*/
+func revealReadiness(writer http.ResponseWriter, _ *http.Request) {
+	var report pd.HealthReport
+
+	report.AddCheck("workdir", pd.CheckDirWritable(pd.PathWorkdir))
+	report.AddCheck("maps directory", pd.CheckDirWritable(filepath.Join(pd.PathWorkdir, pd.PathMaps)))
+	report.AddCheck("orders directory", pd.CheckDirWritable(filepath.Join(pd.PathWorkdir, pd.PathOrders)))
+	report.AddCheck("leases directory", pd.CheckDirWritable(filepath.Join(pd.PathWorkdir, pd.PathLeases)))
+	report.AddCheck("mapnikdriver", checkMapnikdriver(config.Mapnikdriver))
+	report.AddCheck("markersdir", pd.CheckDirReadable(config.Markersdir))
+
+	for _, style := range config.Styles {
+		report.AddCheck("style "+style.Name, pd.CheckFileExists(filepath.Join(style.XMLPath, style.XMLFile)))
+	}
+
+	pd.WriteHealthReport(writer, report)
+}
+
+/*
+checkMapnikdriver verifies the mapnik driver command (e.g. 'python /path/nik4-printmaps.py'):
+the program must be executable, all further path arguments must exist.
+*/
+func checkMapnikdriver(mapnikdriver string) error {
+	fields := strings.Fields(mapnikdriver)
+	if len(fields) == 0 {
+		return exec.ErrNotFound
+	}
+
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return err
+	}
+
+	for _, field := range fields[1:] {
+		if strings.Contains(field, "/") && !strings.HasPrefix(field, "-") {
+			if err := pd.CheckFileExists(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+// Crash-safe build queue (claimed orders under a lease with heartbeat, recovery of interrupted builds)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// lease defaults (used if not configured)
+const (
+	defaultLeaseHeartbeat = 30  // interval (seconds) of the heartbeat of a running build
+	defaultLeaseTimeout   = 180 // lease without heartbeat for this time (seconds) is stale
+	defaultBuildAttempts  = 3   // max number of attempts of an interrupted build
+)
+
+// tempdirPrefix is the prefix of the temporary build directories
+const tempdirPrefix = "printmaps_tempdir_"
+
+// hostname identifies the owner of a lease (together with the process identifier)
+var hostname, _ = os.Hostname()
+
+// Lease describes a claimed build order (the order is held as 'leases/<id>.json' until the build is finished)
+type Lease struct {
+	ID        string
+	Host      string
+	Pid       int
+	Tempdir   string
+	Ordered   string // order submission of the map state (the attempts of a new order start again)
+	Attempt   int
+	Claimed   string
+	Heartbeat string
+}
+
+/*
+leaseOrderFile returns the file of the claimed build order.
+*/
+func leaseOrderFile(id string) string {
+	return filepath.Join(pd.PathWorkdir, pd.PathLeases, id+".json")
+}
+
+/*
+leaseFile returns the file of the lease.
+*/
+func leaseFile(id string) string {
+	return filepath.Join(pd.PathWorkdir, pd.PathLeases, id+".lease")
+}
+
+/*
+leaseHeartbeat returns the heartbeat interval of a lease.
+*/
+func leaseHeartbeat() time.Duration {
+	if config.Leaseheartbeat <= 0 {
+		return defaultLeaseHeartbeat * time.Second
+	}
+	return time.Duration(config.Leaseheartbeat) * time.Second
+}
+
+/*
+leaseTimeout returns the time after which a lease without heartbeat is stale.
+*/
+func leaseTimeout() time.Duration {
+	if config.Leasetimeout <= 0 {
+		return defaultLeaseTimeout * time.Second
+	}
+	return time.Duration(config.Leasetimeout) * time.Second
+}
+
+/*
+buildAttempts returns the max number of attempts of an interrupted build.
+*/
+func buildAttempts() int {
+	if config.Buildattempts <= 0 {
+		return defaultBuildAttempts
+	}
+	return config.Buildattempts
+}
+
+/*
+claimBuildOrder creates the lease and moves the build order from the orders into the leases directory.
+The lease is written before the order is moved, a claimed order is never visible without its lease.
+The temporary build directory is recorded in the lease before it is created (see createTempdir).
+Fails if the order was claimed by another build service or cancelled in the meantime.
+*/
+func claimBuildOrder(order string) (*Lease, error) {
+	id := strings.TrimSuffix(order, filepath.Ext(order))
+	source := filepath.Join(pd.PathWorkdir, pd.PathOrders, order)
+	destination := leaseOrderFile(id)
+
+	// order already claimed by another build service (the lease must not be overwritten)
+	if isExistFile(destination) {
+		return nil, os.ErrExist
+	}
+
+	var pmState pd.PrintmapsState
+	if err := pd.ReadMapstate(&pmState, id); err != nil && !os.IsNotExist(err) {
+		log.Printf("error <%v> at readMapstate(), id = <%s>", err, id)
+	}
+
+	now := time.Now()
+	lease := &Lease{
+		ID:        id,
+		Host:      hostname,
+		Pid:       os.Getpid(),
+		Tempdir:   filepath.Join(pd.PathWorkdir, fmt.Sprintf("%s%s_%d", tempdirPrefix, id, now.UnixNano())),
+		Ordered:   pmState.Data.Attributes.MapOrderSubmitted,
+		Attempt:   1,
+		Claimed:   now.Format(time.RFC3339),
+		Heartbeat: now.Format(time.RFC3339),
+	}
+	// attempts of a requeued order are continued
+	if previous, err := readLease(id); err == nil && previous.Ordered == lease.Ordered {
+		lease.Attempt = previous.Attempt + 1
+	}
+	if err := writeLease(lease); err != nil {
+		log.Printf("error <%v> at writeLease(), id = <%s>", err, id)
+		return nil, err
+	}
+
+	// the rename operation fails under some rare circumstances (heavy io load, Ubuntu 16.04 LTS)
+	// in case of a failure the rename operation will be repeated after 10 seconds
+	// a failed claim leaves the lease as it is (held by the build service which claimed the order,
+	// or removed by the recovery if the order is gone)
+	if err := os.Rename(source, destination); err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		log.Printf("first attempt - critical error <%v> at os.Rename(), source = <%v>, destination = <%v>", err, source, destination)
+		time.Sleep(9876 * time.Millisecond)
+		if err2 := os.Rename(source, destination); err2 != nil {
+			log.Printf("second attempt - critical error <%v> at os.Rename(), source = <%v>, destination = <%v>", err2, source, destination)
+			return nil, err2
+		}
+	}
+
+	// the lease may have been overwritten by another build service claiming the same order
+	if err := writeLease(lease); err != nil {
+		log.Printf("error <%v> at writeLease(), id = <%s>", err, id)
+	}
+
+	return lease, nil
+}
+
+/*
+createTempdir creates the temporary build directory recorded in the lease.
+*/
+func createTempdir(lease *Lease) error {
+	if err := os.Mkdir(lease.Tempdir, 0700); err != nil {
+		log.Printf("error <%v> at os.Mkdir(), dir = <%s>", err, lease.Tempdir)
+		return err
+	}
+	return nil
+}
+
+/*
+writeLease writes the lease (atomic).
+*/
+func writeLease(lease *Lease) error {
+	data, err := json.MarshalIndent(lease, pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		return err
+	}
+
+	file := leaseFile(lease.ID)
+	if err := ioutil.WriteFile(file+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+/*
+readLease reads the lease of a build order.
+*/
+func readLease(id string) (*Lease, error) {
+	data, err := ioutil.ReadFile(leaseFile(id))
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+/*
+startHeartbeat renews the lease periodically while the build is running. The returned function stops the heartbeat.
+*/
+func startHeartbeat(lease *Lease) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leaseHeartbeat())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lease.Heartbeat = time.Now().Format(time.RFC3339)
+				if err := writeLease(lease); err != nil {
+					log.Printf("error <%v> at writeLease(), id = <%s>", err, lease.ID)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+/*
+releaseLease removes the claimed build order and the lease (build finished).
+The order is removed first, a lease without order is ignored by the recovery.
+*/
+func releaseLease(id string) {
+	if err := os.Remove(leaseOrderFile(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error <%v> at os.Remove(), file = <%s>", err, leaseOrderFile(id))
+	}
+	if err := os.Remove(leaseFile(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error <%v> at os.Remove(), file = <%s>", err, leaseFile(id))
+	}
+}
+
+/*
+isStaleLease checks if the build of a claimed order is orphaned (owner not running or heartbeat expired).
+A claimed order without lease (former releases, lease not writable) is only recovered on start.
+*/
+func isStaleLease(lease *Lease, startup bool) bool {
+	if lease == nil {
+		return startup
+	}
+
+	if lease.Host == hostname {
+		if lease.Pid == os.Getpid() {
+			// process identifier of a former build service reused by this one
+			return startup
+		}
+		if !isProcessAlive(lease.Pid) {
+			return true
+		}
+	}
+
+	heartbeat, err := time.Parse(time.RFC3339, lease.Heartbeat)
+	return err != nil || time.Since(heartbeat) > leaseTimeout()
+}
+
+/*
+isProcessAlive checks if a process (on this host) is running.
+*/
+func isProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+/*
+recoverBuildOrders detects the claimed orders of interrupted builds (crash, reboot, forced shutdown) and
+requeues them or marks them as failed (max attempts reached). Leases of finished builds are removed.
+*/
+func recoverBuildOrders(startup bool) {
+	path := filepath.Join(pd.PathWorkdir, pd.PathLeases)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Printf("error <%v> at ioutil.ReadDir(), path = <%v>", err, path)
+		return
+	}
+
+	for _, fileInfo := range files {
+		name := fileInfo.Name()
+		id := strings.TrimSuffix(name, filepath.Ext(name))
+		if _, running := runningBuilds.Load(id); running {
+			continue
+		}
+
+		switch filepath.Ext(name) {
+		case ".json":
+			lease, err := readLease(id)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("error <%v> at readLease(), id = <%s>", err, id)
+			}
+			if isStaleLease(lease, startup) {
+				recoverBuildOrder(id, lease)
+			}
+		case ".lease":
+			// lease without claimed or waiting order (build finished, order cancelled)
+			if !isExistFile(leaseOrderFile(id)) && !isExistFile(filepath.Join(pd.PathWorkdir, pd.PathOrders, id+".json")) {
+				if err := os.Remove(filepath.Join(path, name)); err != nil && !os.IsNotExist(err) {
+					log.Printf("error <%v> at os.Remove(), file = <%s>", err, name)
+				}
+			}
+		}
+	}
+}
+
+/*
+recoverBuildOrder requeues the claimed order of an interrupted build or marks the build as failed (or cancelled).
+*/
+func recoverBuildOrder(id string, lease *Lease) {
+	var pmData pd.PrintmapsData
+	var pmState pd.PrintmapsState
+
+	attempt := 1
+	if lease != nil {
+		attempt = lease.Attempt
+		removeTempdir(lease.Tempdir)
+	}
+
+	// map deleted in the meantime
+	if !pd.IsExistMapDirectory(id) {
+		log.Printf("interrupted build of deleted map removed, id = <%s>", id)
+		releaseLease(id)
+		return
+	}
+
+	if err := readOrder(&pmData, leaseOrderFile(id)); err != nil {
+		log.Printf("error <%v> at readOrder(), interrupted build removed, id = <%s>", err, id)
+		releaseLease(id)
+		return
+	}
+	if err := pd.ReadMapstate(&pmState, id); err != nil && !os.IsNotExist(err) {
+		log.Printf("error <%v> at readMapstate(), id = <%s>", err, id)
+		return
+	}
+
+	switch {
+	case pmState.Data.Attributes.MapBuildCompleted != "":
+		// build service terminated after the completion of the build
+		releaseLease(id)
+	case isExistFile(filepath.Join(pd.PathWorkdir, pd.PathOrders, id+".json")):
+		// map ordered again in the meantime
+		log.Printf("interrupted build replaced by new order, id = <%s>", id)
+		releaseLease(id)
+	case pd.IsBuildCancelRequested(id):
+		log.Printf("interrupted build cancelled, id = <%s>", id)
+		setBuildResult(pmData, pmState, BuildResult{BuildSuccessful: pd.BuildCancelled, BuildMessage: errCancelled.Error()})
+		releaseLease(id)
+		if err := pd.RemoveBuildCancel(id); err != nil {
+			log.Printf("error <%v> at pd.RemoveBuildCancel(), id = <%s>", err, id)
+		}
+	case attempt >= buildAttempts():
+		log.Printf("interrupted build failed after %d attempt(s), id = <%s>", attempt, id)
+		message := fmt.Sprintf("map build failed after %d attempt(s) (build interrupted, e.g. by crash of build service)", attempt)
+		setBuildResult(pmData, pmState, BuildResult{BuildSuccessful: "no", BuildMessage: message})
+		releaseLease(id)
+	default:
+		// requeue (the lease holds the number of attempts)
+		log.Printf("interrupted build requeued (attempt %d of %d), id = <%s>", attempt, buildAttempts(), id)
+		pmState.Data.Attributes.MapBuildStarted = ""
+		pmState.Data.Attributes.MapBuildCompleted = ""
+		pmState.Data.Attributes.MapBuildSuccessful = ""
+		pmState.Data.Attributes.MapBuildMessage = fmt.Sprintf("map build interrupted (attempt %d of %d), order requeued", attempt, buildAttempts())
+		if err := pd.WriteMapstate(pmState); err != nil {
+			log.Printf("error <%v> at writeMapstate(), id = <%s>", err, id)
+			return
+		}
+		if lease == nil {
+			lease = &Lease{ID: id, Ordered: pmState.Data.Attributes.MapOrderSubmitted, Attempt: attempt}
+		}
+		lease.Host, lease.Pid, lease.Tempdir = "", 0, ""
+		if err := writeLease(lease); err != nil {
+			log.Printf("error <%v> at writeLease(), id = <%s>", err, id)
+		}
+		source := leaseOrderFile(id)
+		destination := filepath.Join(pd.PathWorkdir, pd.PathOrders, id+".json")
+		if err := os.Rename(source, destination); err != nil {
+			log.Printf("error <%v> at os.Rename(), source = <%v>, destination = <%v>", err, source, destination)
+		}
+	}
+}
+
+/*
+recoverTempdirs removes the orphaned temporary build directories (not held by a lease).
+Build orders left in temporary directories (former releases) are recovered.
+*/
+func recoverTempdirs() {
+	// the directories are listed before the leases: the directory of a build is recorded in its lease
+	// before it is created, a directory created in the meantime is held by a lease read afterwards
+	tempdirs, err := filepath.Glob(filepath.Join(pd.PathWorkdir, tempdirPrefix+"*"))
+	if err != nil {
+		log.Printf("error <%v> at filepath.Glob()", err)
+		return
+	}
+
+	// temporary directories of running builds (other build services)
+	held := make(map[string]bool)
+	files, err := filepath.Glob(filepath.Join(pd.PathWorkdir, pd.PathLeases, "*.lease"))
+	if err != nil {
+		log.Printf("error <%v> at filepath.Glob()", err)
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".lease")
+		if lease, err := readLease(id); err == nil && lease.Tempdir != "" {
+			held[lease.Tempdir] = true
+		}
+	}
+
+	for _, tempdir := range tempdirs {
+		if held[tempdir] {
+			continue
+		}
+
+		// build order moved into the temporary directory (former releases)
+		orders, _ := filepath.Glob(filepath.Join(tempdir, "*.json"))
+		for _, order := range orders {
+			id := strings.TrimSuffix(filepath.Base(order), ".json")
+			if !pd.IsExistMapDirectory(id) || isExistFile(leaseOrderFile(id)) {
+				continue
+			}
+			log.Printf("build order found in orphaned directory <%s>, id = <%s>", tempdir, id)
+			if err := os.Rename(order, leaseOrderFile(id)); err != nil {
+				log.Printf("error <%v> at os.Rename(), source = <%v>, destination = <%v>", err, order, leaseOrderFile(id))
+				continue
+			}
+			recoverBuildOrder(id, nil)
+		}
+
+		removeTempdir(tempdir)
+	}
+}
+
+/*
+removeTempdir removes a temporary build directory (kept in test mode).
+*/
+func removeTempdir(tempdir string) {
+	if tempdir == "" || config.Testmode || !strings.HasPrefix(filepath.Base(tempdir), tempdirPrefix) {
+		return
+	}
+	if err := os.RemoveAll(tempdir); err != nil {
+		log.Printf("error <%v> at os.RemoveAll(), dir = <%s>", err, tempdir)
+	}
+}
+
+/*
+isExistFile checks if a file exists.
+*/
+func isExistFile(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
@@ -49,6 +49,7 @@ Workflow (abstracted):
 - zip final map
 - move final map to dest dir
 - update map state
+- notify callback url (if requested)
 - delete temp dir
 
 Contact (eMail):
@@ -71,13 +72,16 @@ Links:
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -101,10 +105,27 @@ type Config struct {
 	Maxprocs     int
 	Graceperiod  int
 	Metrics      bool
+	Httpaddr     string
 	Testmode     bool
 	Mapnikdriver string
 	Markersdir   string
-	Styles       []struct {
+
+	Buildtimeout          int
+	Buildcputime          int
+	Buildtimeoutscaling   bool
+	Buildtimeoutmaxfactor float64
+	Prlimit               string
+	Buildattempts         int
+
+	Leaseheartbeat int
+	Leasetimeout   int
+
+	Callbackattempts int
+	Callbackbackoff  int
+	Callbacktimeout  int
+	Callbackallow    []string
+
+	Styles []struct {
 		Name    string
 		XMLPath string
 		XMLFile string
@@ -171,9 +192,30 @@ func main() {
 	log.Printf("config maxprocs = %d", config.Maxprocs)
 	log.Printf("config graceperiod = %d", config.Graceperiod)
 	log.Printf("config metrics = %t", config.Metrics)
+	log.Printf("config httpaddr = %s", config.Httpaddr)
 	log.Printf("config testmode = %t", config.Testmode)
 	log.Printf("config mapnikdriver = %s", config.Mapnikdriver)
 	log.Printf("config markersdir = %s", config.Markersdir)
+	log.Printf("config buildtimeout = %d", config.Buildtimeout)
+	log.Printf("config buildcputime = %d", config.Buildcputime)
+	log.Printf("config buildtimeoutscaling = %t", config.Buildtimeoutscaling)
+	log.Printf("config buildtimeoutmaxfactor = %.1f", config.Buildtimeoutmaxfactor)
+	log.Printf("config prlimit = %s", config.Prlimit)
+	if config.Buildcputime > 0 {
+		if prlimitProgram, err = exec.LookPath(prlimit()); err != nil {
+			log.Fatalf("fatal error <%v> at exec.LookPath(), program = <%s> (required for buildcputime)", err, prlimit())
+		}
+	}
+	log.Printf("config buildattempts = %d", config.Buildattempts)
+	log.Printf("config leaseheartbeat = %d", config.Leaseheartbeat)
+	log.Printf("config leasetimeout = %d", config.Leasetimeout)
+	log.Printf("config callbackattempts = %d", config.Callbackattempts)
+	log.Printf("config callbackbackoff = %d", config.Callbackbackoff)
+	log.Printf("config callbacktimeout = %d", config.Callbacktimeout)
+	log.Printf("config callbackallow = %v", config.Callbackallow)
+	if err := parseCallbackAllowlist(config.Callbackallow); err != nil {
+		log.Fatalf("fatal error <%v> at parseCallbackAllowlist()", err)
+	}
 	for _, style := range config.Styles {
 		log.Printf("config map style: %s, %s, %s", style.Name, style.XMLPath, style.XMLFile)
 	}
@@ -195,9 +237,18 @@ func main() {
 	log.Printf("own process identifier (pid) = %d", pid)
 	log.Printf("shutdown with SIGINT or SIGTERM")
 
-	// create 'maps' and 'orders' directory (if necessary)
+	// create 'maps', 'orders' and 'leases' directory (if necessary)
 	pd.CreateDirectories()
 
+	// recover the builds interrupted by a crash, reboot or forced shutdown
+	recoverTempdirs()
+	recoverBuildOrders(true)
+
+	// start http listener (metrics, liveness, readiness)
+	if config.Httpaddr != "" {
+		startHTTPListener(config.Httpaddr)
+	}
+
 	// start timer trigger
 	timerTrigger := time.Tick(time.Second * 5)
 
@@ -210,6 +261,10 @@ func main() {
 	var workerCount = 0
 	workDoneTrigger := make(chan struct{})
 
+	// forced shutdown kills the processes of all running builds
+	buildContext, killBuilds := context.WithCancel(context.Background())
+	defer killBuilds()
+
 	// fetch work and start worker
 ForeverLoop:
 	for {
@@ -217,7 +272,7 @@ ForeverLoop:
 			nextOrder := nextBuildOrder()
 			if nextOrder != "" {
 				workerCount++
-				go buildMapMaster(nextOrder, workDoneTrigger)
+				go buildMapMaster(buildContext, nextOrder, workDoneTrigger)
 			}
 		}
 
@@ -226,7 +281,9 @@ ForeverLoop:
 		case <-workDoneTrigger:
 			workerCount--
 		case <-timerTrigger:
-			// unblock select
+			// unblock select, cancel the builds requested by the users, recover orphaned builds
+			cancelRequestedBuilds()
+			recoverBuildOrders(false)
 		case <-shutdownTrigger:
 			// initiate shutdown
 			break ForeverLoop
@@ -245,51 +302,81 @@ ForeverLoop:
 		case <-workDoneTrigger:
 			workerCount--
 		case <-timerTrigger:
-			// unblock select
+			// unblock select, cancel the builds requested by the users
+			cancelRequestedBuilds()
 		case <-gracePeriodTrigger:
-			log.Printf("%s (%s) shutdown forced after end of grace period", progName, progPurpose)
-			os.Exit(1)
+			log.Printf("%s (%s) shutdown forced after end of grace period, killing %d build(s) ...", progName, progPurpose, workerCount)
+			killBuilds()
+			forceShutdown(workerCount, workDoneTrigger)
 		}
 	}
 
+	// wait for pending callback deliveries
+	callbacksDone := make(chan struct{})
+	go func() {
+		pendingCallbacks.Wait()
+		close(callbacksDone)
+	}()
+	select {
+	case <-callbacksDone:
+	case <-gracePeriodTrigger:
+		log.Printf("%s (%s) shutdown forced after end of grace period (pending callbacks)", progName, progPurpose)
+		os.Exit(1)
+	}
+
 	log.Printf("%s (%s) gracefully shut down", progName, progPurpose)
 }
 
+/*
+forceShutdown waits a short time for the killed builds to record their state, then exits.
+*/
+func forceShutdown(workerCount int, workDoneTrigger <-chan struct{}) {
+	deadline := time.After(10 * time.Second)
+	for workerCount > 0 {
+		select {
+		case <-workDoneTrigger:
+			workerCount--
+		case <-deadline:
+			log.Printf("%s (%s) %d build(s) not terminated", progName, progPurpose, workerCount)
+			os.Exit(1)
+		}
+	}
+	os.Exit(1)
+}
+
 /*
 buildMapMaster builds a map (master).
 */
-func buildMapMaster(nextOrder string, chanOut chan<- struct{}) {
-	// create temp directory
-	tempdir, err := ioutil.TempDir(pd.PathWorkdir, "printmaps_tempdir_")
+func buildMapMaster(ctx context.Context, nextOrder string, chanOut chan<- struct{}) {
+	atomic.AddInt64(&activeWorkers, 1)
+	defer atomic.AddInt64(&activeWorkers, -1)
+
+	// claim next order (held under a lease until the build is finished)
+	lease, err := claimBuildOrder(nextOrder)
 	if err != nil {
-		log.Fatalf("fatal error <%v> at ioutil.TempDir()", err)
-	}
-
-	// move next order file into temp directory
-	// the rename operation fails under some rare circumstances (heavy io load, Ubuntu 16.04 LTS)
-	// in case of a failure (workaround, unfortunately not working):
-	// - rename operation will be repeated after 10 seconds
-	// - rename operation failure will only be logged
-	source := filepath.Join(pd.PathWorkdir, pd.PathOrders, nextOrder)
-	destination := filepath.Join(tempdir, nextOrder)
-	if err = os.Rename(source, destination); err != nil {
-		log.Printf("first attempt - critical error <%v> at os.Rename(), source = <%v>, destination = <%v>", err, source, destination)
-		time.Sleep(9876 * time.Millisecond)
-		if err2 := os.Rename(source, destination); err2 != nil {
-			log.Printf("second attempt - critical error <%v> at os.Rename(), source = <%v>, destination = <%v>", err2, source, destination)
-			chanOut <- struct{}{}
-			return
-		}
+		chanOut <- struct{}{}
+		return
+	}
+
+	// create temp directory (recorded in the lease)
+	tempdir := lease.Tempdir
+	if err = createTempdir(lease); err != nil {
+		log.Fatalf("fatal error <%v> at createTempdir()", err)
 	}
+	stopHeartbeat := startHeartbeat(lease)
 
 	// build the printable map
+	order := leaseOrderFile(lease.ID)
 	start := time.Now()
-	buildMap(tempdir, nextOrder)
+	finished := buildMap(ctx, tempdir, order)
 	elapsed := time.Since(start)
+	stopHeartbeat()
 
-	// write metrics
-	if config.Metrics {
-		writeMetrics(tempdir, nextOrder, elapsed)
+	// an interrupted build (shutdown) keeps the lease, the order is recovered on the next start
+	if finished {
+		// write metrics
+		writeMetrics(order, elapsed)
+		releaseLease(lease.ID)
 	}
 
 	if !config.Testmode {
@@ -304,18 +391,17 @@ func buildMapMaster(nextOrder string, chanOut chan<- struct{}) {
 }
 
 /*
-buildMap builds a map.
+buildMap builds a map. Returns false if the build was interrupted by the shutdown of the build service.
 */
-func buildMap(tempdir string, order string) {
+func buildMap(ctx context.Context, tempdir string, file string) bool {
 	var pmData pd.PrintmapsData
 	var pmState pd.PrintmapsState
 	var bResult BuildResult
 
 	// read meta data of map order
-	file := filepath.Join(tempdir, order)
 	if err := readOrder(&pmData, file); err != nil {
 		log.Printf("error <%v> at readOrder(), file = <%s>", err, file)
-		return
+		return true
 	}
 
 	// read state
@@ -323,7 +409,7 @@ func buildMap(tempdir string, order string) {
 		if !os.IsNotExist(err) {
 			log.Printf("error <%v> at readMapstate()", err)
 			log.Printf("pmData = %v", dumpPrintmapsData(pmData))
-			return
+			return true
 		}
 	}
 
@@ -336,33 +422,56 @@ func buildMap(tempdir string, order string) {
 		log.Printf("error <%v> at writeMapstate()", err)
 		// log.Printf("pmData = %v", dumpPrintmapsData(pmData))
 		// log.Printf("pmState = %v", dumpPrintmapsState(pmState))
-		return
+		return true
 	}
 
-	// build mapnik map
-	if err := buildMapnikMap(tempdir, pmData, &pmState); err != nil {
-		bResult.BuildSuccessful = "no"
+	// build mapnik map (within the time limits of the build)
+	job, cancel := newBuildJob(ctx, pmData)
+	defer cancel()
+
+	// register build for cancel requests of the user (a request before the start cancels the build immediately)
+	runningBuilds.Store(pmData.Data.ID, job)
+	defer runningBuilds.Delete(pmData.Data.ID)
+	defer func() {
+		if err := pd.RemoveBuildCancel(pmData.Data.ID); err != nil {
+			log.Printf("error <%v> at pd.RemoveBuildCancel(), id = <%s>", err, pmData.Data.ID)
+		}
+	}()
+	if pd.IsBuildCancelRequested(pmData.Data.ID) {
+		job.cancelBuild()
+	}
+
+	if err := buildMapnikMap(job, tempdir, pmData, &pmState); err != nil {
+		if err == errShutdown {
+			return false
+		}
+		bResult.BuildSuccessful = buildOutcome(err)
 		bResult.BuildMessage = err.Error()
-		setBuildResult(pmState, bResult)
+		setBuildResult(pmData, pmState, bResult)
 		// log.Printf("error <%v> at buildMapnikMap()", err)
 		// log.Printf("pmData = %v", dumpPrintmapsData(pmData))
 		// log.Printf("pmState = %v", dumpPrintmapsState(pmState))
-		return
+		return true
 	}
 
 	// zip map into standard download file (-j = junk directory names)
 	zipfile := filepath.Join(tempdir, pd.FileMapfile)
 	mapfile := filepath.Join(tempdir, mapBasename+"."+pmData.Data.Attributes.Fileformat)
-	command := fmt.Sprintf("zip -j %s %s", zipfile, mapfile)
-	_, _, err := runCommand(command)
+	_, _, err := runCommand(job, "zip", "-j", zipfile, mapfile)
+	if err == errShutdown {
+		return false
+	}
 	if err != nil {
-		bResult.BuildSuccessful = "no"
+		bResult.BuildSuccessful = buildOutcome(err)
 		bResult.BuildMessage = "error zipping map file"
-		setBuildResult(pmState, bResult)
+		if isBuildAborted(err) {
+			bResult.BuildMessage = err.Error()
+		}
+		setBuildResult(pmData, pmState, bResult)
 		log.Printf("error <%v> at runCommand()", err)
 		// log.Printf("pmData = %v", dumpPrintmapsData(pmData))
 		// log.Printf("pmState = %v", dumpPrintmapsState(pmState))
-		return
+		return true
 	}
 
 	// move map from temp directory to download location
@@ -370,23 +479,24 @@ func buildMap(tempdir string, order string) {
 	if err := os.Rename(zipfile, destination); err != nil {
 		bResult.BuildSuccessful = "no"
 		bResult.BuildMessage = "error moving zipped map to download location"
-		setBuildResult(pmState, bResult)
+		setBuildResult(pmData, pmState, bResult)
 		log.Printf("error <%v> at os.Rename(), source = <%v>, destination = <%v>", err, zipfile, destination)
 		// log.Printf("pmData = %v", dumpPrintmapsData(pmData))
 		// log.Printf("pmState = %v", dumpPrintmapsState(pmState))
-		return
+		return true
 	}
 
 	// everything ok
 	bResult.BuildSuccessful = "yes"
 	bResult.BuildMessage = "map build successful"
-	setBuildResult(pmState, bResult)
+	setBuildResult(pmData, pmState, bResult)
+	return true
 }
 
 /*
-setBuildResult sets the result state of the map build process.
+setBuildResult sets the result state of the map build process (and notifies the callback url).
 */
-func setBuildResult(pmState pd.PrintmapsState, bResult BuildResult) error {
+func setBuildResult(pmData pd.PrintmapsData, pmState pd.PrintmapsState, bResult BuildResult) error {
 	// write (update) state (map build completed)
 	pmState.Data.Attributes.MapBuildCompleted = time.Now().Format(time.RFC3339)
 	pmState.Data.Attributes.MapBuildSuccessful = bResult.BuildSuccessful
@@ -396,6 +506,7 @@ func setBuildResult(pmState pd.PrintmapsState, bResult BuildResult) error {
 		return err
 	}
 
+	startCallback(pmData, pmState)
 	return nil
 }
 
@@ -445,14 +556,13 @@ func readOrder(pmData *pd.PrintmapsData, file string) error {
 }
 
 /*
-writeMetrics writes a simple metrics string into the log.
+writeMetrics records the build metrics and writes a simple metrics string into the log (if configured).
 */
-func writeMetrics(tempdir string, order string, elapsed time.Duration) {
+func writeMetrics(file string, elapsed time.Duration) {
 	var pmData pd.PrintmapsData
 	var pmState pd.PrintmapsState
 
 	// read meta data of map order
-	file := filepath.Join(tempdir, order)
 	if err := readOrder(&pmData, file); err != nil {
 		log.Printf("error <%v> at readOrder(), file = <%s>", err, file)
 		return
@@ -476,6 +586,11 @@ func writeMetrics(tempdir string, order string, elapsed time.Duration) {
 			filesize = fileinfo.Size()
 		}
 	}
+	observeBuild(pmData, pmState, filesize, elapsed)
+	if !config.Metrics {
+		return
+	}
+
 	filesizeMB := float64(filesize) / (1024.0 * 1024.0)
 
 	// format mapsize
@@ -0,0 +1,82 @@
+// Metrics (Prometheus text exposition format)
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// number of running build processes (workers)
+var activeWorkers int64
+
+// histogram buckets for build durations in seconds
+var buildDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// histogram buckets for map artifact sizes in bytes
+var artifactSizeBuckets = []float64{1 << 20, 5 << 20, 10 << 20, 25 << 20, 50 << 20, 100 << 20, 250 << 20, 500 << 20, 1 << 30}
+
+// buildservice metrics
+var (
+	metricsBuilds = pd.NewCounter("printmaps_buildservice_builds_total",
+		"Number of map builds by style, scale bucket, format and result.", "style", "scale", "format", "result")
+	metricsBuildDuration = pd.NewHistogram("printmaps_buildservice_build_duration_seconds",
+		"Duration of map builds by style, scale bucket, format and result.", buildDurationBuckets, "style", "scale", "format", "result")
+	metricsArtifactSize = pd.NewHistogram("printmaps_buildservice_artifact_size_bytes",
+		"Size of successfully built map files (zip) by format.", artifactSizeBuckets, "format")
+	_ = pd.NewGaugeFunc("printmaps_buildservice_build_orders_queued",
+		"Number of build orders waiting in the orders directory.", queuedBuildOrders)
+	_ = pd.NewGaugeFunc("printmaps_buildservice_workers_active",
+		"Number of running build processes.", func() float64 { return float64(atomic.LoadInt64(&activeWorkers)) })
+	_ = pd.NewGaugeFunc("printmaps_buildservice_workers_max",
+		"Max number of parallel build processes (config maxprocs).", func() float64 { return float64(config.Maxprocs) })
+)
+
+/*
+observeBuild records the metrics of a finished map build.
+*/
+func observeBuild(pmData pd.PrintmapsData, pmState pd.PrintmapsState, filesize int64, elapsed time.Duration) {
+	result := "failed"
+	if pmState.Data.Attributes.MapBuildSuccessful == "yes" {
+		result = "successful"
+		metricsArtifactSize.Observe(float64(filesize), pmData.Data.Attributes.Fileformat)
+	}
+
+	attributes := pmData.Data.Attributes
+	scale := scaleBucket(attributes.Scale)
+	metricsBuilds.Inc(attributes.Style, scale, attributes.Fileformat, result)
+	metricsBuildDuration.Observe(elapsed.Seconds(), attributes.Style, scale, attributes.Fileformat, result)
+}
+
+/*
+scaleBucket classifies the map scale (keeps the number of label values small).
+*/
+func scaleBucket(scale int) string {
+	switch {
+	case scale <= 10000:
+		return "<=10000"
+	case scale <= 25000:
+		return "<=25000"
+	case scale <= 50000:
+		return "<=50000"
+	case scale <= 100000:
+		return "<=100000"
+	case scale <= 250000:
+		return "<=250000"
+	default:
+		return ">250000"
+	}
+}
+
+/*
+queuedBuildOrders returns the number of build orders waiting in the orders directory.
+*/
+func queuedBuildOrders() float64 {
+	count, err := pd.CountBuildOrders()
+	if err != nil {
+		return -1
+	}
+	return float64(count)
+}
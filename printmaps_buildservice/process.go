@@ -0,0 +1,273 @@
+// limits of build processes (wall-clock and CPU timeout, process groups)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// referenceArea is the print area (DIN A4, mm²) the configured build timeouts apply to (if scaled by map area)
+const referenceArea = 210.0 * 297.0
+
+// defaultTimeoutMaxFactor is the max scaling factor of the build timeouts (DIN A0, used if not configured)
+const defaultTimeoutMaxFactor = 16.0
+
+// prlimitProgram is the resolved path of the program applying the CPU limit
+var prlimitProgram string
+
+// errors of aborted builds
+var (
+	errShutdown  = errors.New("map build interrupted (shutdown of build service)")
+	errCancelled = errors.New("map build cancelled by user")
+)
+
+// runningBuilds holds the jobs of the running builds (key = map ID)
+var runningBuilds sync.Map
+
+// buildJob holds the limits of a map build
+type buildJob struct {
+	ctx       context.Context    // canceled on wall-clock timeout, user request or forced shutdown
+	cancel    context.CancelFunc // cancels the build
+	cancelled int32              // build cancelled by user (atomic)
+	timeout   int                // wall-clock timeout in seconds (0 = unlimited)
+	cputime   int                // CPU timeout in seconds per process (0 = unlimited)
+}
+
+// timeoutError reports a build process terminated because of a timeout
+type timeoutError struct {
+	seconds int
+	cpu     bool
+}
+
+/*
+Error describes the timeout.
+*/
+func (e *timeoutError) Error() string {
+	if e.cpu {
+		return fmt.Sprintf("map build timed out after %d s (CPU time)", e.seconds)
+	}
+	return fmt.Sprintf("map build timed out after %d s", e.seconds)
+}
+
+/*
+newBuildJob sets up the limits of a map build (optionally scaled by the print area of the map).
+The returned cancel function must be called at the end of the build.
+*/
+func newBuildJob(ctx context.Context, pmData pd.PrintmapsData) (*buildJob, context.CancelFunc) {
+	factor := 1.0
+	if config.Buildtimeoutscaling {
+		area := pmData.Data.Attributes.PrintWidth * pmData.Data.Attributes.PrintHeight
+		if area > referenceArea {
+			factor = math.Min(area/referenceArea, timeoutMaxFactor())
+		}
+	}
+
+	job := &buildJob{
+		timeout: int(float64(config.Buildtimeout) * factor),
+		cputime: int(float64(config.Buildcputime) * factor),
+	}
+	ctx, job.cancel = context.WithCancel(ctx)
+	release := job.cancel
+	if job.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, time.Duration(job.timeout)*time.Second)
+		release = func() {
+			cancelTimeout()
+			job.cancel()
+		}
+	}
+	job.ctx = ctx
+
+	return job, release
+}
+
+/*
+timeoutMaxFactor returns the max scaling factor of the build timeouts.
+*/
+func timeoutMaxFactor() float64 {
+	if config.Buildtimeoutmaxfactor < 1 {
+		return defaultTimeoutMaxFactor
+	}
+	return config.Buildtimeoutmaxfactor
+}
+
+/*
+prlimit returns the program applying the CPU limit.
+*/
+func prlimit() string {
+	if config.Prlimit == "" {
+		return "prlimit"
+	}
+	return config.Prlimit
+}
+
+/*
+cancelBuild cancels the build on user request (kills the running build process).
+*/
+func (job *buildJob) cancelBuild() {
+	atomic.StoreInt32(&job.cancelled, 1)
+	job.cancel()
+}
+
+/*
+cancelRequestedBuilds cancels the running builds requested by the users (signaled by the webservice).
+*/
+func cancelRequestedBuilds() {
+	runningBuilds.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		if pd.IsBuildCancelRequested(id) {
+			log.Printf("cancel of running build requested, id = <%s>", id)
+			value.(*buildJob).cancelBuild()
+		}
+		return true
+	})
+}
+
+/*
+runCommand runs a program with the given arguments (passed directly, without shell) within the limits of the build.
+The program runs in its own process group, the whole group is killed on timeout or forced shutdown.
+*/
+func runCommand(job *buildJob, program string, args ...string) (commandExitStatus int, commandOutput []byte, err error) {
+	if err = job.ctx.Err(); err != nil {
+		return -1, nil, job.failure(err)
+	}
+
+	// output is read from an own pipe, cmd.Wait() must not wait for background children holding the pipe open
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		log.Printf("error <%v> at os.Pipe()", err)
+		return -1, nil, err
+	}
+	defer reader.Close()
+	if job.cputime > 0 {
+		// the limit is set before the program starts (inherited by all children)
+		cpuLimit := fmt.Sprintf("--cpu=%d:%d", job.cputime, job.cputime+1)
+		args = append([]string{cpuLimit, "--", program}, args...)
+		program = prlimitProgram
+	}
+	cmd := exec.Command(program, args...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		log.Printf("error <%v> at cmd.Start()", err)
+		log.Printf("command (not successful) = <%s>", strings.Join(cmd.Args, " "))
+		return -1, nil, err
+	}
+	pgid := cmd.Process.Pid
+
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, reader)
+		close(copied)
+	}()
+
+	// kill the process group on timeout or forced shutdown
+	done := make(chan struct{})
+	killed := make(chan error, 1)
+	go func() {
+		select {
+		case <-job.ctx.Done():
+			if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+				log.Printf("error <%v> at syscall.Kill(), pgid = <%d>", err, pgid)
+			}
+			killed <- job.ctx.Err()
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+	// remaining processes of the group (e.g. background children)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	<-copied
+	commandOutput = output.Bytes()
+
+	var waitStatus syscall.WaitStatus
+	if cmd.ProcessState != nil {
+		waitStatus = cmd.ProcessState.Sys().(syscall.WaitStatus)
+	}
+	select {
+	case reason := <-killed:
+		err = job.failure(reason)
+	default:
+		// soft limit: SIGXCPU, hard limit: SIGKILL
+		used := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		if job.cputime > 0 && waitStatus.Signaled() &&
+			(waitStatus.Signal() == syscall.SIGXCPU || used >= time.Duration(job.cputime)*time.Second) {
+			err = &timeoutError{seconds: job.cputime, cpu: true}
+		}
+	}
+
+	if err != nil {
+		// command was not successful
+		if waitStatus.Exited() {
+			log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
+		}
+		log.Printf("error <%v> at cmd.Wait()", err)
+		log.Printf("command (not successful) = <%s>", strings.Join(cmd.Args, " "))
+		if len(commandOutput) > 0 {
+			log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
+		}
+	} else if config.Testmode {
+		// command was successful
+		log.Printf("command (successful) = <%s>", strings.Join(cmd.Args, " "))
+		log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
+		if len(commandOutput) > 0 {
+			log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
+		}
+	}
+
+	commandExitStatus = waitStatus.ExitStatus()
+	return
+}
+
+/*
+failure maps the reason of a canceled build context to the build error.
+*/
+func (job *buildJob) failure(reason error) error {
+	if atomic.LoadInt32(&job.cancelled) == 1 {
+		return errCancelled
+	}
+	if reason == context.DeadlineExceeded {
+		return &timeoutError{seconds: job.timeout}
+	}
+	return errShutdown
+}
+
+/*
+buildOutcome returns the build result (MapBuildSuccessful) of a failed build.
+*/
+func buildOutcome(err error) string {
+	if err == errCancelled {
+		return pd.BuildCancelled
+	}
+	return "no"
+}
+
+/*
+isBuildAborted checks if a build process was terminated because of a timeout, user request or shutdown.
+*/
+func isBuildAborted(err error) bool {
+	var timeout *timeoutError
+	return errors.As(err, &timeout) || err == errShutdown || err == errCancelled
+}
@@ -3,57 +3,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
 	"io/ioutil"
 	"log"
-	"os/exec"
+	"net/http"
 	"path/filepath"
 	"sort"
-	"strings"
-	"syscall"
 
 	"github.com/printmaps/printmaps/pd"
 )
 
-/*
-runCommand runs a command / program.
-*/
-func runCommand(command string) (commandExitStatus int, commandOutput []byte, err error) {
-
-	program := "/bin/bash"
-	args := []string{"-c", command}
-	cmd := exec.Command(program, args...)
-
-	commandOutput, err = cmd.CombinedOutput()
-
-	var waitStatus syscall.WaitStatus
-	if err != nil {
-		// command was not successful
-		if exitError, ok := err.(*exec.ExitError); ok {
-			// command fails because of an unsuccessful exit code
-			waitStatus = exitError.Sys().(syscall.WaitStatus)
-			log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
-		}
-		log.Printf("error <%v> at cmd.CombinedOutput()", err)
-		log.Printf("command (not successful) = <%s>", strings.Join(cmd.Args, " "))
-		if len(commandOutput) > 0 {
-			log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
-		}
-	} else {
-		// command was successful
-		waitStatus = cmd.ProcessState.Sys().(syscall.WaitStatus)
-		if config.Testmode {
-			log.Printf("command (successful) = <%s>", strings.Join(cmd.Args, " "))
-			log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
-			if len(commandOutput) > 0 {
-				log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
-			}
-		}
-	}
-
-	commandExitStatus = waitStatus.ExitStatus()
-	return
-}
-
 /*
 nextBuildOrder returns the name of the oldest build order file.
 */
@@ -79,3 +39,41 @@ func nextBuildOrder() string {
 
 	return ""
 }
+
+/*
+startHTTPListener starts the http listener (metrics, liveness, readiness).
+*/
+func startHTTPListener(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", pd.ServeMetrics)
+	mux.HandleFunc("/healthz", revealHealth)
+	mux.HandleFunc("/readyz", revealReadiness)
+
+	go func() {
+		log.Printf("listen for http requests on %s ...", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("fatal error <%v> at http.ListenAndServe()", err)
+		}
+	}()
+}
+
+/*
+escapeXML escapes a value for the use as XML text or attribute value.
+*/
+func escapeXML(value string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
+
+/*
+isDataSourceType checks if the mapnik data source is allowed for user objects.
+*/
+func isDataSourceType(dataSource string) bool {
+	for _, item := range pd.DataSourceTypes {
+		if item == dataSource {
+			return true
+		}
+	}
+	return false
+}
@@ -75,18 +75,24 @@ package main
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/StefanSchroeder/Golang-Ellipsoid/ellipsoid"
 	"github.com/davecgh/go-spew/spew"
@@ -110,12 +116,16 @@ var (
 // MapConfig represents the map configuration
 type MapConfig struct {
 	ServiceURL  string      `yaml:"ServiceURL"`
+	APIKey      string      `yaml:"APIKey"`
 	Metadata    pd.Metadata `yaml:"Metadata,inline"`
 	UploadFiles []string    `yaml:"UserFiles"`
 }
 
 var mapConfig MapConfig
 
+// environment variable with api key (overrides the api key in the map definition file)
+const apiKeyEnvironmentVariable = "PRINTMAPS_APIKEY"
+
 // map identifier
 var mapID string
 
@@ -123,8 +133,23 @@ var mapID string
 var (
 	mapDefinitionFile = "map.yaml"
 	mapIDFile         = "map.id"
+	mapRevisionFile   = "map.revision"
+	mapfileETagFile   = "printmaps.etag"
+	mapUploadsFile    = "map.uploads"
 )
 
+// size of a single chunk of a resumable upload
+const uploadChunkSize = 8 * 1024 * 1024
+
+// uploadState describes an unfinished resumable upload
+type uploadState struct {
+	MapID    string
+	UploadID string
+	Size     int64
+	ModTime  string // the upload is restarted if the local file was modified
+	Checksum string
+}
+
 // http client
 var netClient = &http.Client{}
 
@@ -163,6 +188,11 @@ func main() {
 
 	fmt.Printf("\nurl = %v\n", mapConfig.ServiceURL)
 
+	// api key (optional)
+	if apiKey := os.Getenv(apiKeyEnvironmentVariable); apiKey != "" {
+		mapConfig.APIKey = apiKey
+	}
+
 	// read map id
 	if _, err := os.Stat(mapIDFile); err == nil {
 		filedata, err := os.ReadFile(mapIDFile)
@@ -182,12 +212,17 @@ func main() {
 	} else if action == "update" {
 		checkMapDefinitionFile()
 		checkMapIDFile()
-		update()
+		onlyChanged := len(os.Args) > 2 && strings.ToLower(os.Args[2]) == "--only"
+		update(onlyChanged)
 	} else if action == "upload" {
 		checkMapDefinitionFile()
 		checkMapIDFile()
 		for _, file := range mapConfig.UploadFiles {
-			upload(file)
+			if strings.EqualFold(filepath.Ext(file), ".zip") {
+				uploadArchive(file)
+			} else {
+				upload(file)
+			}
 		}
 	} else if action == "state" {
 		checkMapDefinitionFile()
@@ -197,6 +232,14 @@ func main() {
 		checkMapDefinitionFile()
 		checkMapIDFile()
 		order()
+	} else if action == "cancel" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		cancel()
+	} else if action == "wait" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		wait()
 	} else if action == "download" {
 		checkMapDefinitionFile()
 		checkMapIDFile()
@@ -205,12 +248,31 @@ func main() {
 		checkMapDefinitionFile()
 		checkMapIDFile()
 		fetch(action)
+	} else if action == "callbacks" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		fetch(action)
+	} else if action == "revisions" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		fetch(action)
+	} else if action == "files" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		fetch(action)
+	} else if action == "clone" {
+		checkMapDefinitionFile()
+		checkMapIDFile()
+		clone()
 	} else if action == "delete" {
 		checkMapDefinitionFile()
 		checkMapIDFile()
 		delete()
 	} else if action == "capabilities" {
 		fetch(action)
+	} else if action == "list" {
+		checkMapDefinitionFile()
+		list()
 	} else if action == "unzip" {
 		unzip()
 	} else if action == "passepartout" {
@@ -283,8 +345,8 @@ func printUsage() {
 	fmt.Printf("  %s create\n", progName)
 
 	fmt.Printf("\nActions:\n")
-	fmt.Printf("  Primary      : create, update, upload, order, state, download\n")
-	fmt.Printf("  Secondary    : data, delete, capabilities\n")
+	fmt.Printf("  Primary      : create, update, upload, order, state, wait, download\n")
+	fmt.Printf("  Secondary    : data, files, callbacks, revisions, clone, cancel, delete, capabilities, list\n")
 	fmt.Printf("  Helper       : unzip\n")
 	fmt.Printf("  Helper       : passepartout, rectangle, cropmarks\n")
 	fmt.Printf("  Helper       : latlongrid, utmgrid\n")
@@ -294,14 +356,21 @@ func printUsage() {
 
 	fmt.Printf("\nRemarks:\n")
 	fmt.Printf("  create       : creates the meta data for a new map\n")
-	fmt.Printf("  update       : updates the meta data of an existing map\n")
-	fmt.Printf("  upload       : uploads a list of user supplied files\n")
+	fmt.Printf("  update       : updates the meta data of an existing map (--only: sends only the changed elements)\n")
+	fmt.Printf("  upload       : uploads a list of user supplied files (chunked, resumable, zip archives are extracted)\n")
 	fmt.Printf("  order        : places a map build order\n")
 	fmt.Printf("  state        : fetches the current state of the map\n")
-	fmt.Printf("  download     : downloads a successful build map\n")
+	fmt.Printf("  wait         : waits (event stream) until the map build is completed\n")
+	fmt.Printf("  download     : downloads a successful build map (resumable)\n")
 	fmt.Printf("  data         : fetches the current meta data of the map\n")
+	fmt.Printf("  files        : fetches the list of uploaded user files (size, checksum, type)\n")
+	fmt.Printf("  callbacks    : fetches the delivery attempts of the build callback\n")
+	fmt.Printf("  revisions    : fetches the revision history of the meta data\n")
+	fmt.Printf("  clone        : clones the map incl. user files (optional into a new directory)\n")
+	fmt.Printf("  cancel       : cancels the map build order (waiting or running build)\n")
 	fmt.Printf("  delete       : deletes all artifacts (files) of the map\n")
 	fmt.Printf("  capabilities : fetches the capabilities of the map service\n")
+	fmt.Printf("  list         : lists the maps (filtered, sorted, paginated)\n")
 	fmt.Printf("  unzip        : unzips the downloaded map file\n")
 	fmt.Printf("  passepartout : calculates wkt passe-partout from base values\n")
 	fmt.Printf("  rectangle    : calculates wkt rectangle from base values\n")
@@ -318,11 +387,17 @@ func printUsage() {
 	fmt.Printf("\nFiles:\n")
 	fmt.Printf("  %-13s: unique map identifier\n", mapIDFile)
 	fmt.Printf("  %-13s: map definition parameters\n", mapDefinitionFile)
+	fmt.Printf("  %-13s: last known revision (ETag) of the meta data\n", mapRevisionFile)
+	fmt.Printf("  %-13s: entity tag of the downloaded map file\n", mapfileETagFile)
+	fmt.Printf("  %-13s: unfinished uploads (resumed by repeating 'upload')\n", mapUploadsFile)
+
+	fmt.Printf("\nEnvironment:\n")
+	fmt.Printf("  %-17s: api key (overrides 'APIKey' in '%s')\n", apiKeyEnvironmentVariable, mapDefinitionFile)
 
 	fmt.Printf("\nHow to start:\n")
 	fmt.Printf("  - Download and unzip the 'template' map from 'printmaps-osm.de'.\n")
 	fmt.Printf("  - Build the 'template' map by running the actions:\n")
-	fmt.Printf("    'create', 'upload', 'order', 'state', 'download', 'unzip'\n")
+	fmt.Printf("    'create', 'upload', 'order', 'wait', 'download', 'unzip'\n")
 	fmt.Printf("  - View the map with an appropriate application.\n")
 	fmt.Printf("  - Modify the map definition file '%s' to your needs.\n", mapDefinitionFile)
 	fmt.Printf("\n")
@@ -359,6 +434,7 @@ func create() {
 
 	req.Header.Add("Content-Type", "application/vnd.api+json; charset=utf-8")
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
 
 	printRequest(req, true)
 
@@ -387,31 +463,50 @@ func create() {
 	if err != nil {
 		log.Fatalf("error <%v> at os.WriteFile()", err)
 	}
+	saveRevision(resp)
 }
 
 /*
-update updates an existing map
+update updates an existing map (onlyChanged = true: sends only the changed meta data elements)
 */
-func update() {
+func update(onlyChanged bool) {
 	pmData := pd.PrintmapsData{}
 	pmData.Data.Type = "maps"
 	pmData.Data.ID = mapID
 	pmData.Data.Attributes = mapConfig.Metadata
 
 	requestURL := mapConfig.ServiceURL + "metadata"
+	contentType := "application/vnd.api+json; charset=utf-8"
 
 	data, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
 	if err != nil {
 		log.Fatalf("error <%v> at json.MarshalIndent()", err)
 	}
 
+	if onlyChanged {
+		// JSON Merge Patch: difference between the current (server) and the local meta data
+		current := fetchCurrentMetadata()
+		data, err = pd.CreateMergePatch(current, data)
+		if err != nil {
+			log.Fatalf("error <%v> at pd.CreateMergePatch()", err)
+		}
+		if string(data) == "{}" {
+			fmt.Printf("\nmeta data unchanged, nothing to update\n")
+			return
+		}
+		requestURL = mapConfig.ServiceURL + "metadata/" + mapID
+		contentType = pd.MergePatchMediaType
+	}
+
 	req, err := http.NewRequest("PATCH", requestURL, bytes.NewReader(data))
 	if err != nil {
 		log.Fatalf("error <%v> at http.NewRequest()", err)
 	}
 
-	req.Header.Add("Content-Type", "application/vnd.api+json; charset=utf-8")
+	req.Header.Add("Content-Type", contentType)
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+	addRevision(req)
 
 	printRequest(req, true)
 
@@ -423,45 +518,183 @@ func update() {
 
 	printResponse(resp, true)
 	printSuccess(resp, http.StatusOK)
+	saveRevision(resp)
 }
 
 /*
-upload uploads an user supplied file
+fetchCurrentMetadata fetches the current meta data of the map (without the server managed elements)
 */
-func upload(filename string) {
-	requestURL := mapConfig.ServiceURL + "upload/" + mapID
+func fetchCurrentMetadata() []byte {
+	var pmData pd.PrintmapsData
+
+	requestURL := mapConfig.ServiceURL + "metadata/" + mapID
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		printResponse(resp, true)
+		printSuccess(resp, http.StatusOK)
+		os.Exit(1)
+	}
 
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
+	if err = json.NewDecoder(resp.Body).Decode(&pmData); err != nil {
+		log.Fatalf("error <%v> at json.Decode()", err)
+	}
+	pmData.Data.Attributes.UserFiles = nil
+	pmData.Data.Attributes.Owner = ""
 
-	_, destinationFilename := filepath.Split(filename)
-	fileWriter, err := bodyWriter.CreateFormFile("file", destinationFilename)
+	data, err := json.Marshal(pmData)
 	if err != nil {
-		log.Fatalf("error <%v> at CreateFormFile()", err)
+		log.Fatalf("error <%v> at json.Marshal()", err)
 	}
+	return data
+}
 
-	fh, err := os.Open(filename)
+/*
+upload uploads an user supplied file (streamed from disk in chunks, resumable)
+*/
+func upload(filename string) {
+	file, err := os.Open(filename)
 	if err != nil {
 		log.Fatalf("error <%v> at os.Open(), file = %s", err, filename)
 	}
+	defer file.Close()
 
-	_, err = io.Copy(fileWriter, fh)
+	fileInfo, err := file.Stat()
 	if err != nil {
-		log.Fatalf("error <%v> at io.Copy()", err)
+		log.Fatalf("error <%v> at file.Stat(), file = %s", err, filename)
+	}
+
+	// resume an unfinished upload of the unmodified file
+	uploads := readUploadStates()
+	state, found := uploads[filename]
+	modTime := fileInfo.ModTime().UTC().Format(time.RFC3339Nano)
+	offset := int64(-1)
+	if found && state.MapID == mapID && state.Size == fileInfo.Size() && state.ModTime == modTime {
+		offset = fetchUploadOffset(state.UploadID)
+		if offset >= 0 {
+			fmt.Printf("resuming upload of file '%s' at byte %d ...\n", filename, offset)
+		}
+	}
+	if offset < 0 {
+		state = uploadState{MapID: mapID, Size: fileInfo.Size(), ModTime: modTime, Checksum: fileChecksum(file)}
+		state.UploadID = startUpload(filepath.Base(filename), state.Size, state.Checksum)
+		offset = 0
+		uploads[filename] = state
+		writeUploadStates(uploads)
 	}
 
-	bodyWriter.Close()
+	requestURL := mapConfig.ServiceURL + "uploads/" + mapID + "/" + state.UploadID
+	filesize := float64(state.Size) / (1024.0 * 1024.0)
+	fmt.Printf("uploading file '%s' (%.1f MB) ...\n", filename, filesize)
 
-	req, err := http.NewRequest("POST", requestURL, bodyBuf)
+	for {
+		length := state.Size - offset
+		if length > uploadChunkSize {
+			length = uploadChunkSize
+		}
+
+		req, err := http.NewRequest("PUT", requestURL, io.NewSectionReader(file, offset, length))
+		if err != nil {
+			log.Fatalf("error <%v> at http.NewRequest()", err)
+		}
+		req.ContentLength = length
+		req.Header.Add("Content-Type", "application/octet-stream")
+		req.Header.Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, state.Size))
+		req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+		addAPIKey(req)
+		addRevision(req)
+
+		resp, err := netClient.Do(req)
+		if err != nil {
+			log.Fatalf("error <%v> at http.Do(), repeat action 'upload' to resume", err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			// chunk accepted
+			resp.Body.Close()
+			offset += length
+			fmt.Printf("%.1f MB of %.1f MB uploaded\n", float64(offset)/(1024.0*1024.0), filesize)
+			continue
+		case http.StatusConflict:
+			// server expects a different offset (e.g. chunk received, response lost)
+			expected, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+			resp.Body.Close()
+			if err == nil && expected != offset && expected < state.Size {
+				fmt.Printf("continuing upload at byte %d ...\n", expected)
+				offset = expected
+				continue
+			}
+			log.Fatalf("unexpected offset <%s> of upload, remove '%s' and repeat action 'upload'", resp.Header.Get("Upload-Offset"), mapUploadsFile)
+		}
+
+		// upload completed or failed
+		printResponse(resp, true)
+		printSuccess(resp, http.StatusCreated)
+		saveRevision(resp)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			// the upload is finished (stored or rejected)
+			remaining := make(map[string]uploadState)
+			for name, unfinished := range uploads {
+				if name != filename {
+					remaining[name] = unfinished
+				}
+			}
+			writeUploadStates(remaining)
+		}
+		return
+	}
+}
+
+/*
+uploadArchive uploads a zip archive (e.g. shapefile bundle), extracted by the server (streamed, not resumable)
+*/
+func uploadArchive(filename string) {
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalf("error <%v> at http.NewRequest()", err)
+		log.Fatalf("error <%v> at os.Open(), file = %s", err, filename)
 	}
+	defer file.Close()
 
-	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
-	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+	// multipart form streamed from disk
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", filepath.Base(filename))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
 
-	printRequest(req, false)
+	requestURL := mapConfig.ServiceURL + "upload/" + mapID
+	req, err := http.NewRequest("POST", requestURL, reader)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+	req.Header.Add("Content-Type", form.FormDataContentType())
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+	addRevision(req)
 
+	fmt.Printf("uploading archive '%s' ...\n", filename)
 	resp, err := netClient.Do(req)
 	if err != nil {
 		log.Fatalf("error <%v> at http.Do()", err)
@@ -470,6 +703,136 @@ func upload(filename string) {
 
 	printResponse(resp, true)
 	printSuccess(resp, http.StatusCreated)
+	saveRevision(resp)
+}
+
+/*
+startUpload starts a resumable upload on the server, returns the upload ID
+*/
+func startUpload(name string, size int64, checksum string) string {
+	var pmUpload pd.PrintmapsUpload
+
+	requestURL := mapConfig.ServiceURL + "uploads/" + mapID
+	pmUpload.Data.Type = "uploads"
+	pmUpload.Data.Attributes.Name = name
+	pmUpload.Data.Attributes.Size = size
+	pmUpload.Data.Attributes.Checksum = checksum
+
+	data, err := json.MarshalIndent(pmUpload, pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		log.Fatalf("error <%v> at json.MarshalIndent()", err)
+	}
+
+	req, err := http.NewRequest("POST", requestURL, bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+
+	req.Header.Add("Content-Type", "application/vnd.api+json; charset=utf-8")
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+	addRevision(req)
+
+	printRequest(req, true)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		printResponse(resp, true)
+		printSuccess(resp, http.StatusCreated)
+		saveRevision(resp)
+		os.Exit(1)
+	}
+
+	printResponse(resp, false)
+	pmUpload = pd.PrintmapsUpload{}
+	if err = json.NewDecoder(resp.Body).Decode(&pmUpload); err != nil {
+		log.Fatalf("error <%v> at json.Decode()", err)
+	}
+	return pmUpload.Data.ID
+}
+
+/*
+fetchUploadOffset fetches the offset of an unfinished upload (-1 if the upload is unknown)
+*/
+func fetchUploadOffset(uploadID string) int64 {
+	requestURL := mapConfig.ServiceURL + "uploads/" + mapID + "/" + uploadID
+
+	req, err := http.NewRequest("HEAD", requestURL, nil)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return offset
+}
+
+/*
+fileChecksum calculates the checksum (sha256, hex) of a file
+*/
+func fileChecksum(file *os.File) string {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, math.MaxInt64)); err != nil {
+		log.Fatalf("error <%v> at io.Copy(), file = <%s>", err, file.Name())
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+readUploadStates reads the states of the unfinished uploads (key = local file name)
+*/
+func readUploadStates() map[string]uploadState {
+	uploads := make(map[string]uploadState)
+
+	data, err := os.ReadFile(mapUploadsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("error <%v> at os.ReadFile(), file = <%s>", err, mapUploadsFile)
+		}
+		return uploads
+	}
+	if err = json.Unmarshal(data, &uploads); err != nil {
+		log.Fatalf("error <%v> at json.Unmarshal(), file = <%s>", err, mapUploadsFile)
+	}
+	return uploads
+}
+
+/*
+writeUploadStates writes the states of the unfinished uploads (the file is removed if there are none)
+*/
+func writeUploadStates(uploads map[string]uploadState) {
+	if len(uploads) == 0 {
+		if err := os.Remove(mapUploadsFile); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("error <%v> at os.Remove(), file = <%s>", err, mapUploadsFile)
+		}
+		return
+	}
+
+	data, err := json.MarshalIndent(uploads, pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		log.Fatalf("error <%v> at json.MarshalIndent()", err)
+	}
+	if err = os.WriteFile(mapUploadsFile, data, 0666); err != nil {
+		log.Fatalf("error <%v> at os.WriteFile(), file = <%s>", err, mapUploadsFile)
+	}
 }
 
 /*
@@ -486,6 +849,7 @@ func order() {
 
 	req.Header.Add("Content-Type", "application/vnd.api+json; charset=utf-8")
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
 
 	printRequest(req, true)
 
@@ -508,6 +872,12 @@ func fetch(action string) {
 		requestURL = mapConfig.ServiceURL + "mapstate/" + mapID
 	} else if action == "data" {
 		requestURL = mapConfig.ServiceURL + "metadata/" + mapID
+	} else if action == "callbacks" {
+		requestURL = mapConfig.ServiceURL + "callbacks/" + mapID
+	} else if action == "revisions" {
+		requestURL = mapConfig.ServiceURL + "revisions/" + mapID
+	} else if action == "files" {
+		requestURL = mapConfig.ServiceURL + "files/" + mapID
 	} else if action == "capabilities" {
 		requestURL = mapConfig.ServiceURL + "capabilities/service"
 	} else {
@@ -520,6 +890,7 @@ func fetch(action string) {
 	}
 
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
 
 	printRequest(req, true)
 
@@ -538,10 +909,241 @@ func fetch(action string) {
 }
 
 /*
-download downloads the map
+list lists the maps (optional arguments: name=value pairs for filtering, sorting and paging)
+*/
+func list() {
+	parameters := map[string]string{
+		"style":         "filter[style]",
+		"state":         "filter[state]",
+		"owner":         "filter[owner]",
+		"createdafter":  "filter[createdafter]",
+		"createdbefore": "filter[createdbefore]",
+		"sort":          "sort",
+		"page":          "page[number]",
+		"size":          "page[size]",
+	}
+
+	query := url.Values{}
+	for _, arg := range os.Args[2:] {
+		entries := strings.SplitN(arg, "=", 2)
+		name, found := parameters[strings.ToLower(entries[0])]
+		if len(entries) != 2 || !found {
+			fmt.Printf("\nUsage:\n")
+			fmt.Printf("  %s list  [name=value ...]\n", progName)
+			fmt.Printf("\nExample:\n")
+			fmt.Printf("  %s list  state=successful  createdafter=2025-01-01  sort=date  page=2  size=10\n", progName)
+			fmt.Printf("\nHints:\n")
+			fmt.Printf("  names  : style, state, owner, createdafter, createdbefore, sort, page, size\n")
+			fmt.Printf("  state  : created, ordered, started, successful, failed\n")
+			fmt.Printf("  dates  : 2006-01-02 or 2006-01-02T15:04:05Z07:00\n")
+			fmt.Printf("  sort   : date (oldest first), -date (newest first, default)\n")
+			fmt.Printf("\n")
+			os.Exit(1)
+		}
+		query.Set(name, entries[1])
+	}
+
+	requestURL := strings.TrimSuffix(mapConfig.ServiceURL, "/")
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	printRequest(req, true)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	defer resp.Body.Close()
+
+	printResponse(resp, true)
+	printSuccess(resp, http.StatusOK)
+
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	// short overview
+	var pmList pd.PrintmapsList
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("error <%v> at io.ReadAll()", err)
+	}
+	if err = json.Unmarshal(body, &pmList); err != nil {
+		log.Fatalf("error <%v> at json.Unmarshal()", err)
+	}
+
+	fmt.Printf("\nmaps %d of %d (page %d)\n\n", len(pmList.Data), pmList.Meta.Total, pmList.Meta.PageNumber)
+	for _, entry := range pmList.Data {
+		created := entry.Attributes.Mapstate.MapCreated
+		if created == "" {
+			created = entry.Attributes.Mapstate.MapMetadataWritten
+		}
+		fmt.Printf("%s  %-25s  %-10s  %-20s  %s\n", entry.ID, created, entry.Attributes.BuildStatus, entry.Attributes.Style, entry.Attributes.Owner)
+	}
+}
+
+/*
+wait waits until the map build is completed (subscribes to the map state events)
+*/
+func wait() {
+	requestURL := mapConfig.ServiceURL + "mapstate/" + mapID + "/events"
+	lastEventID := ""
+	var pmState pd.PrintmapsState
+
+	for {
+		req, err := http.NewRequest("GET", requestURL, nil)
+		if err != nil {
+			log.Fatalf("error <%v> at http.NewRequest()", err)
+		}
+
+		req.Header.Add("Accept", "text/event-stream")
+		if lastEventID != "" {
+			req.Header.Add("Last-Event-ID", lastEventID)
+		}
+		addAPIKey(req)
+
+		if lastEventID == "" {
+			printRequest(req, true)
+		}
+
+		resp, err := netClient.Do(req)
+		if err != nil {
+			log.Fatalf("error <%v> at http.Do()", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			printResponse(resp, true)
+			printSuccess(resp, http.StatusOK)
+			resp.Body.Close()
+			return
+		}
+
+		if lastEventID == "" {
+			printResponse(resp, false)
+			fmt.Printf("\nmap state events\n")
+			fmt.Printf("----------------\n\n")
+		}
+
+		// process event stream (fields 'id', 'event', 'data'; empty line terminates an event)
+		// the event id is taken over when the event is dispatched (not on an interrupted event)
+		eventID, event, data := lastEventID, "", ""
+		completed := false
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				eventID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			case line == "" && event == "deleted":
+				fmt.Printf("%s  map deleted\n", time.Now().Format("15:04:05"))
+				resp.Body.Close()
+				return
+			case line == "" && event == "mapstate":
+				if err := json.Unmarshal([]byte(data), &pmState); err != nil {
+					log.Fatalf("error <%v> at json.Unmarshal()", err)
+				}
+				completed = printMapstateEvent(pmState.Data.Attributes)
+			}
+			if line == "" {
+				lastEventID = eventID
+				event, data = "", ""
+			}
+		}
+		resp.Body.Close()
+
+		if completed {
+			break
+		}
+
+		// stream interrupted (e.g. by server restart): reconnect after a short delay
+		if err := scanner.Err(); err != nil {
+			fmt.Printf("%s  event stream interrupted (%v), reconnecting ...\n", time.Now().Format("15:04:05"), err)
+		} else {
+			fmt.Printf("%s  event stream closed, reconnecting ...\n", time.Now().Format("15:04:05"))
+		}
+		time.Sleep(3 * time.Second)
+	}
+
+	fmt.Printf("\naction result\n")
+	fmt.Printf("-------------\n")
+	if pmState.Data.Attributes.MapBuildSuccessful == pd.BuildCancelled {
+		fmt.Printf("\nmap build cancelled, apply the 'order' action to build the map again\n")
+		return
+	}
+	fmt.Printf("\nmap build completed, apply the 'download' action to fetch the map\n")
+}
+
+/*
+cancel cancels the map build order (removes a waiting order or kills the running build)
+*/
+func cancel() {
+	requestURL := mapConfig.ServiceURL + mapID + "/mapfile"
+
+	req, err := http.NewRequest("DELETE", requestURL, nil)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	printRequest(req, true)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	defer resp.Body.Close()
+
+	printResponse(resp, true)
+	if resp.StatusCode == http.StatusAccepted {
+		// running build, cancelled asynchronously by the build service
+		printSuccess(resp, http.StatusAccepted)
+		fmt.Printf("\nrunning map build will be cancelled, apply the 'wait' or 'state' action to follow the map state\n")
+		return
+	}
+	printSuccess(resp, http.StatusOK)
+}
+
+/*
+printMapstateEvent prints a short description of the map state and reports whether the build is completed
+*/
+func printMapstateEvent(mapstate pd.Mapstate) bool {
+	status := pd.BuildStatus(mapstate)
+	fmt.Printf("%s  build status = %s\n", time.Now().Format("15:04:05"), status)
+
+	if mapstate.MapBuildCompleted == "" {
+		return false
+	}
+
+	fmt.Printf("\nMapBuildCompleted  = %s\n", mapstate.MapBuildCompleted)
+	fmt.Printf("MapBuildSuccessful = %s\n", mapstate.MapBuildSuccessful)
+	if mapstate.MapBuildMessage != "" {
+		fmt.Printf("MapBuildMessage    = %s\n", mapstate.MapBuildMessage)
+	}
+	return true
+}
+
+/*
+download downloads the map (resumes a partial download, skips an unchanged map)
 */
 func download() {
 	filename := "printmaps.zip"
+	partialFilename := filename + ".part"
 	requestURL := mapConfig.ServiceURL + "mapfile/" + mapID
 
 	req, err := http.NewRequest("GET", requestURL, nil)
@@ -550,6 +1152,26 @@ func download() {
 	}
 
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	// entity tag of the (complete or partial) local map file
+	etag := ""
+	if filedata, err := os.ReadFile(mapfileETagFile); err == nil {
+		etag = strings.TrimSpace(string(filedata))
+	}
+
+	var offset int64
+	if etag != "" {
+		if _, err := os.Stat(filename); err == nil {
+			// skip download if map is unchanged
+			req.Header.Add("If-None-Match", etag)
+		} else if fileInfo, err := os.Stat(partialFilename); err == nil && fileInfo.Size() > 0 {
+			// resume download if map is unchanged
+			offset = fileInfo.Size()
+			req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Add("If-Range", etag)
+		}
+	}
 
 	printRequest(req, true)
 
@@ -559,32 +1181,134 @@ func download() {
 	}
 	defer resp.Body.Close()
 
-	expectedString := strconv.Itoa(http.StatusOK) + " " + http.StatusText(http.StatusOK)
-	if resp.Status == expectedString {
+	switch resp.StatusCode {
+	case http.StatusNotModified:
 		printResponse(resp, false)
-	} else {
+		fmt.Printf("nothing to do ... map file '%s' is up to date\n", filename)
+		return
+	case http.StatusOK:
+		printResponse(resp, false)
+		offset = 0
+	case http.StatusPartialContent:
+		printResponse(resp, false)
+	default:
 		printResponse(resp, true)
 		printSuccess(resp, http.StatusOK)
 		return
 	}
 
-	filesize := float64(resp.ContentLength) / (1024.0 * 1024.0)
+	// remember entity tag of the map file (required to resume the download)
+	etag = resp.Header.Get("ETag")
+	if err = os.WriteFile(mapfileETagFile, []byte(etag), 0666); err != nil {
+		log.Fatalf("error <%v> at os.WriteFile(), file = <%s>", err, mapfileETagFile)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+		fmt.Printf("resuming download at byte %d ...\n", offset)
+	}
+
+	filesize := float64(offset+resp.ContentLength) / (1024.0 * 1024.0)
 	fmt.Printf("downloading file '%s' (%.1f MB) ... ", filename, filesize)
 
-	file, err := os.Create(filename)
+	file, err := os.OpenFile(partialFilename, flags, 0666)
 	if err != nil {
-		log.Fatalf("error <%v> at os.Create(), file = <%s>", err, filename) // nolint
+		log.Fatalf("error <%v> at os.OpenFile(), file = <%s>", err, partialFilename) // nolint
 	}
-	defer file.Close()
 
 	_, err = io.Copy(file, resp.Body)
 	if err != nil {
-		log.Fatalf("error <%v> at io.Copy()", err)
+		file.Close()
+		log.Fatalf("error <%v> at io.Copy(), repeat action 'download' to resume", err)
+	}
+	if err = file.Close(); err != nil {
+		log.Fatalf("error <%v> at file.Close(), file = <%s>", err, partialFilename)
+	}
+
+	if err = os.Rename(partialFilename, filename); err != nil {
+		log.Fatalf("error <%v> at os.Rename(), file = <%s>", err, partialFilename)
 	}
 
 	fmt.Printf("done\n")
 }
 
+/*
+clone clones the map on the server (meta data and uploaded user files), optional into a new local directory
+*/
+func clone() {
+	directory := ""
+	if len(os.Args) > 2 {
+		directory = os.Args[2]
+		if _, err := os.Stat(directory); err == nil {
+			fmt.Printf("\nUsage:\n")
+			fmt.Printf("  %s clone  [directory]\n", progName)
+			fmt.Printf("\nExample:\n")
+			fmt.Printf("  %s clone  ../map-a1\n", progName)
+			fmt.Printf("\nHint:\n")
+			fmt.Printf("  the directory (receives '%s', '%s', '%s') must not exist\n", mapDefinitionFile, mapIDFile, mapRevisionFile)
+			fmt.Printf("\n")
+			os.Exit(1)
+		}
+	}
+
+	requestURL := mapConfig.ServiceURL + "clone/" + mapID
+
+	req, err := http.NewRequest("POST", requestURL, nil)
+	if err != nil {
+		log.Fatalf("error <%v> at http.NewRequest()", err)
+	}
+
+	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+
+	printRequest(req, true)
+
+	resp, err := netClient.Do(req)
+	if err != nil {
+		log.Fatalf("error <%v> at http.Do()", err)
+	}
+	defer resp.Body.Close()
+
+	printResponse(resp, true)
+	printSuccess(resp, http.StatusCreated)
+
+	if resp.StatusCode != http.StatusCreated {
+		return
+	}
+
+	pmDataResponse := pd.PrintmapsData{}
+	if err = json.NewDecoder(resp.Body).Decode(&pmDataResponse); err != nil {
+		log.Fatalf("error <%v> at json.Decode()", err)
+	}
+	fmt.Printf("\nmap ID of the clone = %s\n", pmDataResponse.Data.ID)
+
+	if directory == "" {
+		return
+	}
+
+	// new directory with map definition, map ID and revision of the clone
+	if err = os.MkdirAll(directory, 0755); err != nil {
+		log.Fatalf("error <%v> at os.MkdirAll(), directory = <%s>", err, directory)
+	}
+	source, err := os.ReadFile(mapDefinitionFile)
+	if err != nil {
+		log.Fatalf("error <%v> at os.ReadFile(), file = <%s>", err, mapDefinitionFile)
+	}
+	if err = os.WriteFile(filepath.Join(directory, mapDefinitionFile), source, 0666); err != nil {
+		log.Fatalf("error <%v> at os.WriteFile()", err)
+	}
+	if err = os.WriteFile(filepath.Join(directory, mapIDFile), []byte(pmDataResponse.Data.ID), 0666); err != nil {
+		log.Fatalf("error <%v> at os.WriteFile()", err)
+	}
+	if entityTag := resp.Header.Get("ETag"); entityTag != "" {
+		if err = os.WriteFile(filepath.Join(directory, mapRevisionFile), []byte(entityTag), 0666); err != nil {
+			log.Fatalf("error <%v> at os.WriteFile()", err)
+		}
+	}
+	fmt.Printf("clone prepared in directory '%s' (modify '%s' and apply '%s update --only')\n", directory, mapDefinitionFile, progName)
+}
+
 /*
 delete deletes a map (server data and local map ID file)
 */
@@ -605,6 +1329,8 @@ func delete() {
 	}
 
 	req.Header.Add("Accept", "application/vnd.api+json; charset=utf-8")
+	addAPIKey(req)
+	addRevision(req)
 
 	printRequest(req, true)
 
@@ -616,6 +1342,15 @@ func delete() {
 
 	printResponse(resp, true)
 	printSuccess(resp, http.StatusNoContent)
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		printRevisionConflict()
+		return
+	}
+
+	// remove local revision file
+	if err = os.Remove(mapRevisionFile); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("error <%v> at os.Remove(), file = <%s>", err, mapRevisionFile)
+	}
 
 	// remove local map ID file
 	fmt.Printf("\nremoving local map ID file '%s' ...\n", mapIDFile)
@@ -626,6 +1361,59 @@ func delete() {
 	fmt.Printf("done\n")
 }
 
+/*
+addRevision adds the last known revision of the meta data (if any) as precondition to the http request
+*/
+func addRevision(req *http.Request) {
+	revision, err := os.ReadFile(mapRevisionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatalf("error <%v> at os.ReadFile(), file = <%s>", err, mapRevisionFile)
+		}
+		return
+	}
+	if entityTag := strings.TrimSpace(string(revision)); entityTag != "" {
+		req.Header.Set("If-Match", entityTag)
+	}
+}
+
+/*
+saveRevision saves the revision of the meta data returned by a successful request
+*/
+func saveRevision(resp *http.Response) {
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		printRevisionConflict()
+		return
+	}
+
+	entityTag := resp.Header.Get("ETag")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || entityTag == "" {
+		return
+	}
+	if err := os.WriteFile(mapRevisionFile, []byte(entityTag), 0666); err != nil {
+		log.Fatalf("error <%v> at os.WriteFile(), file = <%s>", err, mapRevisionFile)
+	}
+}
+
+/*
+printRevisionConflict prints a hint how to resolve a revision conflict
+*/
+func printRevisionConflict() {
+	fmt.Printf("\nthe map was modified by someone else in the meantime (revision conflict)\n")
+	fmt.Printf("- fetch the current meta data with '%s data'\n", progName)
+	fmt.Printf("- merge the changes into '%s'\n", mapDefinitionFile)
+	fmt.Printf("- remove '%s' and repeat the action\n", mapRevisionFile)
+}
+
+/*
+addAPIKey adds the api key (if any) to the http request
+*/
+func addAPIKey(req *http.Request) {
+	if mapConfig.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+mapConfig.APIKey)
+	}
+}
+
 /*
 printRequest prints the http response to stdout
 */
@@ -635,6 +1423,11 @@ func printRequest(req *http.Request, body bool) {
 		log.Fatalf("error <%v> at httputil.DumpRequestOut()", err)
 	}
 
+	// never print the api key
+	if mapConfig.APIKey != "" {
+		dump = bytes.ReplaceAll(dump, []byte(mapConfig.APIKey), []byte("<api key>"))
+	}
+
 	fmt.Printf("\nhttp request\n")
 	fmt.Printf("------------\n")
 	fmt.Printf("\n%s", dump)
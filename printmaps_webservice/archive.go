@@ -0,0 +1,349 @@
+// Upload of zipped user files (e.g. shapefile bundles)
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// limits for extracting archives (protection against zip bombs)
+const (
+	archiveEntriesLimit = 256  // max number of entries
+	archiveRatioLimit   = 1000 // max compression ratio of entries larger than 1 MB
+)
+
+// shapefileExtensions are the required parts of a shapefile
+var shapefileExtensions = []string{".shp", ".shx", ".dbf", ".prj"}
+
+// archiveFile describes a file extracted from an archive
+type archiveFile struct {
+	Name     string // name of user file (without directories of the archive)
+	Tempname string // temporary file in the map directory
+}
+
+/*
+isArchive checks if the user file is a zip archive (extracted on upload).
+*/
+func isArchive(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+/*
+receiveUserArchive receives a zip archive and extracts the contained user files into temporary files (all or nothing).
+The archive itself is not stored. Entries of unknown formats are skipped, shapefiles must be complete.
+The extracted files are stored by commitUserArchive, the caller removes the temporary files (removeArchiveFiles).
+*/
+func receiveUserArchive(reader io.Reader, id string, name string, pmErrorList *pd.PrintmapsErrorList) (files []archiveFile, skipped []string, err error) {
+	tempname, err := receiveUserFile(reader, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tempname)
+
+	fileInfo, err := os.Stat(tempname)
+	if err != nil {
+		log.Printf("error <%v> at os.Stat(), file = <%s>", err, tempname)
+		return nil, nil, err
+	}
+	verifyFileSize(fileInfo.Size(), pmErrorList, id)
+	if len(pmErrorList.Errors) > 0 {
+		return nil, nil, nil
+	}
+
+	archive, err := zip.OpenReader(tempname)
+	if err != nil {
+		appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: malformed archive <%s> (%v)", name, err), id)
+		return nil, nil, nil
+	}
+	defer archive.Close()
+
+	entries, skipped := selectArchiveEntries(archive.File, id, pmErrorList)
+	if len(pmErrorList.Errors) > 0 {
+		return nil, nil, nil
+	}
+	if len(entries) == 0 {
+		appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: archive <%s> contains no accepted files", name), id)
+		return nil, nil, nil
+	}
+	verifyShapefiles(entries, pmErrorList, id)
+
+	// quota and disk space based on the declared sizes (enforced while extracting)
+	newFiles := pd.UserFiles{}
+	total := int64(0)
+	for _, entry := range entries {
+		newFiles = append(newFiles, pd.UserFile{Name: path.Base(entry.Name), Size: int64(entry.UncompressedSize64)})
+		total += int64(entry.UncompressedSize64)
+	}
+	if len(pmErrorList.Errors) == 0 {
+		if err := verifyStorageQuotaFiles(id, newFiles, pmErrorList); err != nil {
+			return nil, nil, err
+		}
+		verifyDiskSpace(total, pmErrorList, id)
+	}
+	if len(pmErrorList.Errors) > 0 {
+		return nil, nil, nil
+	}
+
+	// extract and verify all files before storing any of them
+	for _, entry := range entries {
+		file := archiveFile{Name: path.Base(entry.Name)}
+		file.Tempname, err = extractArchiveEntry(entry, id, pmErrorList)
+		if err != nil {
+			removeArchiveFiles(files)
+			return nil, nil, err
+		}
+		if file.Tempname == "" {
+			removeArchiveFiles(files)
+			return nil, nil, nil
+		}
+		files = append(files, file)
+
+		_, reason, err := verifyUploadedFile(file.Tempname, file.Name)
+		if err != nil {
+			removeArchiveFiles(files)
+			return nil, nil, err
+		}
+		if reason != "" {
+			log.Printf("user file <%s> in archive <%s> rejected: %s", file.Name, name, reason)
+			appendError(pmErrorList, "7002", file.Name+": "+reason, id)
+		}
+	}
+	if len(pmErrorList.Errors) > 0 {
+		removeArchiveFiles(files)
+		return nil, nil, nil
+	}
+
+	return files, skipped, nil
+}
+
+/*
+commitUserArchive stores the extracted files of an archive as user files (the meta data must be locked).
+The storage quota is verified again (user files modified in the meantime by other requests).
+*/
+func commitUserArchive(files []archiveFile, id string, pmErrorList *pd.PrintmapsErrorList) (userFiles []pd.UserFile, err error) {
+	newFiles := pd.UserFiles{}
+	for _, file := range files {
+		fileInfo, err := os.Stat(file.Tempname)
+		if err != nil {
+			log.Printf("error <%v> at os.Stat(), file = <%s>", err, file.Tempname)
+			return nil, err
+		}
+		newFiles = append(newFiles, pd.UserFile{Name: file.Name, Size: fileInfo.Size()})
+	}
+	if err := verifyStorageQuotaFiles(id, newFiles, pmErrorList); err != nil {
+		return nil, err
+	}
+	if len(pmErrorList.Errors) > 0 {
+		return nil, nil
+	}
+
+	for _, file := range files {
+		userFile, err := commitUserFile(file.Tempname, id, file.Name, "", pmErrorList)
+		if err != nil {
+			return userFiles, err
+		}
+		if len(pmErrorList.Errors) > 0 {
+			return userFiles, nil
+		}
+		userFiles = append(userFiles, userFile)
+	}
+
+	return userFiles, nil
+}
+
+/*
+removeArchiveFiles removes the temporary files of an extracted archive (not stored).
+*/
+func removeArchiveFiles(files []archiveFile) {
+	for _, file := range files {
+		if err := os.Remove(file.Tempname); err != nil && !os.IsNotExist(err) {
+			log.Printf("unexpected error <%s> os.Remove(), file = <%s>", err, file.Tempname)
+		}
+	}
+}
+
+/*
+selectArchiveEntries selects the entries of an archive to extract. Unsafe entries (paths outside of the map
+directory, links, suspicious compression) reject the archive, entries of unknown formats are skipped.
+*/
+func selectArchiveEntries(entries []*zip.File, id string, pmErrorList *pd.PrintmapsErrorList) (selected []*zip.File, skipped []string) {
+	if len(entries) > archiveEntriesLimit {
+		appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: max entries per archive = %d", archiveEntriesLimit), id)
+		return nil, nil
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		name := strings.ReplaceAll(entry.Name, "\\", "/")
+		if strings.HasPrefix(name, "/") || strings.Contains(name, ":") || hasParentReference(name) {
+			appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: unsafe path <%s>", entry.Name), id)
+			continue
+		}
+		if entry.Mode()&os.ModeSymlink != 0 {
+			appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: link <%s> not allowed", entry.Name), id)
+			continue
+		}
+		if entry.Mode().IsDir() || strings.HasSuffix(name, "/") {
+			continue
+		}
+
+		// files of the archive are stored without directories, meta data of archivers is ignored
+		base := path.Base(name)
+		if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if !isAcceptedExtension(filepath.Ext(base)) {
+			skipped = append(skipped, entry.Name)
+			continue
+		}
+		if !isValidUserFileName(base) {
+			appendError(pmErrorList, "4005", "invalid user file name: "+base, id)
+			continue
+		}
+		if names[base] {
+			appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: duplicate file name <%s>", base), id)
+			continue
+		}
+		names[base] = true
+
+		if maxFileSize() > 0 && entry.UncompressedSize64 > uint64(maxFileSize()) {
+			appendError(pmErrorList, "7001", fmt.Sprintf("%s: max upload size = %d bytes", base, maxFileSize()), id)
+			continue
+		}
+		if entry.UncompressedSize64 > uint64(megabyte) && entry.UncompressedSize64 > entry.CompressedSize64*archiveRatioLimit {
+			appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: suspicious compression ratio of <%s>", entry.Name), id)
+			continue
+		}
+		entry.Name = name
+		selected = append(selected, entry)
+	}
+
+	return selected, skipped
+}
+
+/*
+hasParentReference checks if a path contains a reference to a parent directory.
+*/
+func hasParentReference(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+isAcceptedExtension checks if the file extension belongs to an accepted format.
+*/
+func isAcceptedExtension(extension string) bool {
+	extension = strings.ToLower(extension)
+	for _, format := range fileFormats {
+		if hasExtension(format, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+verifyShapefiles verifies that each shapefile of the archive is complete (.shp, .shx, .dbf, .prj).
+*/
+func verifyShapefiles(entries []*zip.File, pmErrorList *pd.PrintmapsErrorList, id string) {
+	shapefiles := make(map[string]map[string]bool)
+	for _, entry := range entries {
+		base := path.Base(entry.Name)
+		extension := strings.ToLower(filepath.Ext(base))
+		for _, part := range shapefileExtensions {
+			if extension == part {
+				layer := strings.TrimSuffix(base, filepath.Ext(base))
+				if shapefiles[layer] == nil {
+					shapefiles[layer] = make(map[string]bool)
+				}
+				shapefiles[layer][extension] = true
+			}
+		}
+	}
+
+	for _, layer := range sortedKeys(shapefiles) {
+		var missing []string
+		for _, part := range shapefileExtensions {
+			if !shapefiles[layer][part] {
+				missing = append(missing, part)
+			}
+		}
+		if len(missing) > 0 {
+			appendError(pmErrorList, "7007", fmt.Sprintf("shapefile <%s> incomplete, missing: %s", layer, strings.Join(missing, ", ")), id)
+		}
+	}
+}
+
+/*
+sortedKeys returns the keys of a map in sorted order.
+*/
+func sortedKeys(items map[string]map[string]bool) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+extractArchiveEntry extracts an entry of an archive to a temporary file in the map directory. The declared
+size of the entry is enforced. An empty temporary file name means rejected (see error list).
+*/
+func extractArchiveEntry(entry *zip.File, id string, pmErrorList *pd.PrintmapsErrorList) (string, error) {
+	in, err := entry.Open()
+	if err != nil {
+		appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: entry <%s> not readable (%v)", entry.Name, err), id)
+		return "", nil
+	}
+	defer in.Close()
+
+	directory := filepath.Join(pd.PathWorkdir, pd.PathMaps, id)
+	out, err := ioutil.TempFile(directory, ".upload-*")
+	if err != nil {
+		log.Printf("error <%v> at ioutil.TempFile(), path = <%s>", err, directory)
+		return "", err
+	}
+	tempname := out.Name()
+
+	written, err := io.Copy(out, io.LimitReader(in, int64(entry.UncompressedSize64)+1))
+	out.Close()
+	if err != nil || written != int64(entry.UncompressedSize64) {
+		os.Remove(tempname)
+		log.Printf("error <%v> at io.Copy(), entry = <%s>, %d of %d bytes", err, entry.Name, written, entry.UncompressedSize64)
+		appendError(pmErrorList, "7002", fmt.Sprintf("ZIP: entry <%s> damaged or size differs from declaration", entry.Name), id)
+		return "", nil
+	}
+
+	return tempname, nil
+}
+
+/*
+describeLayers describes the layers of the user files which can be referenced by user objects of type shape or ogr.
+*/
+func describeLayers(userFiles []pd.UserFile) []string {
+	var layers []string
+	for _, userFile := range userFiles {
+		if strings.ToLower(filepath.Ext(userFile.Name)) == ".shp" {
+			layer := strings.TrimSuffix(userFile.Name, filepath.Ext(userFile.Name))
+			layers = append(layers, fmt.Sprintf("- Type: shape, File: %s", userFile.Name))
+			layers = append(layers, fmt.Sprintf("- Type: ogr, File: %s, Layer: %s", userFile.Name, layer))
+		}
+	}
+	return layers
+}
@@ -0,0 +1,134 @@
+// Authentication (api keys) and authorization (map ownership)
+
+package main
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/printmaps/printmaps/pd"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigAPIKey describes an api key
+type ConfigAPIKey struct {
+	Key   string
+	Owner string
+	Admin bool
+}
+
+// general vars
+var (
+	apiKeys []ConfigAPIKey // all configured api keys (config file and key file)
+)
+
+/*
+loadAPIKeys loads the api keys from the config and from the (optional) key file (yaml format).
+*/
+func loadAPIKeys() error {
+	apiKeys = append(apiKeys, config.Apikeys...)
+
+	if config.Apikeyfile != "" {
+		source, err := ioutil.ReadFile(config.Apikeyfile)
+		if err != nil {
+			log.Printf("error <%v> at ioutil.ReadFile(), file = <%s>", err, config.Apikeyfile)
+			return err
+		}
+
+		var fileKeys []ConfigAPIKey
+		if err = yaml.Unmarshal(source, &fileKeys); err != nil {
+			log.Printf("error <%v> at yaml.Unmarshal(), file = <%s>", err, config.Apikeyfile)
+			return err
+		}
+		apiKeys = append(apiKeys, fileKeys...)
+	}
+
+	for _, apiKey := range apiKeys {
+		if apiKey.Key == "" || apiKey.Owner == "" {
+			log.Printf("warning: incomplete api key entry (key or owner missing) for owner <%s> ignored", apiKey.Owner)
+		}
+	}
+
+	return nil
+}
+
+/*
+isAuthEnabled reports whether the api key authentication is enabled (at least one key configured).
+*/
+func isAuthEnabled() bool {
+	return len(apiKeys) > 0
+}
+
+/*
+requestAPIKey returns the api key sent with the request (header "Authorization: Bearer <key>").
+*/
+func requestAPIKey(request *http.Request) string {
+	authorization := strings.TrimSpace(request.Header.Get("Authorization"))
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return ""
+}
+
+/*
+lookupAPIKey searches the api key entry for the given key.
+*/
+func lookupAPIKey(key string) (ConfigAPIKey, bool) {
+	for _, apiKey := range apiKeys {
+		if apiKey.Key == "" || apiKey.Owner == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			return apiKey, true
+		}
+	}
+	return ConfigAPIKey{}, false
+}
+
+/*
+verifyAPIKey verifies the api key of the request and returns the matching api key entry.
+An anonymous request (no key) is accepted as long as keys are not required.
+*/
+func verifyAPIKey(request *http.Request, pmErrorList *pd.PrintmapsErrorList, mapID string) ConfigAPIKey {
+	if !isAuthEnabled() {
+		return ConfigAPIKey{}
+	}
+
+	key := requestAPIKey(request)
+	if key == "" {
+		if config.Apikeyrequired {
+			appendError(pmErrorList, "8001", "api key required (http header field = Authorization: Bearer <key>)", mapID)
+		}
+		return ConfigAPIKey{}
+	}
+
+	if apiKey, found := lookupAPIKey(key); found {
+		return apiKey
+	}
+
+	log.Printf("unknown api key rejected, RemoteAddr %s", request.RemoteAddr)
+	appendError(pmErrorList, "8002", "api key unknown", mapID)
+	return ConfigAPIKey{}
+}
+
+/*
+verifyOwner verifies that the requesting api key is allowed to modify the given map.
+Maps without owner (created anonymously) can be modified by everyone.
+*/
+func verifyOwner(request *http.Request, pmData pd.PrintmapsData, pmErrorList *pd.PrintmapsErrorList) {
+	errorCount := len(pmErrorList.Errors)
+	apiKey := verifyAPIKey(request, pmErrorList, pmData.Data.ID)
+	if len(pmErrorList.Errors) > errorCount {
+		return
+	}
+
+	owner := pmData.Data.Attributes.Owner
+	if owner == "" || apiKey.Admin || apiKey.Owner == owner {
+		return
+	}
+
+	appendError(pmErrorList, "8003", "map is owned by another api key", pmData.Data.ID)
+}
@@ -0,0 +1,95 @@
+// Callbacks handler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// replacement of the callback secret in responses
+const hiddenSecret = "********"
+
+/*
+fetchCallbacks fetches the callback delivery attempts (logged by the build service) for a given map ID.
+*/
+func fetchCallbacks(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmCallbacks pd.PrintmapsCallbacks
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadCallbacks(&pmCallbacks, id); err != nil {
+			if !os.IsNotExist(err) {
+				message := fmt.Sprintf("error <%v> at pd.ReadCallbacks(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			// no delivery attempts (yet)
+			pmCallbacks.Data.Type = "maps"
+			pmCallbacks.Data.ID = id
+			pmCallbacks.Data.Attributes.Attempts = []pd.CallbackAttempt{}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		content, err := json.MarshalIndent(pmCallbacks, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+hideCallbackSecret replaces the callback secret (never sent back to the client).
+*/
+func hideCallbackSecret(pmData *pd.PrintmapsData) {
+	if pmData.Data.Attributes.CallbackSecret != "" {
+		pmData.Data.Attributes.CallbackSecret = hiddenSecret
+	}
+}
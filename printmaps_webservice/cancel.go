@@ -0,0 +1,142 @@
+// Cancel handler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+cancelMapfile cancels the build order of a map. A waiting order is removed from the orders directory (200 OK),
+the build service is signaled to kill a running build (202 Accepted). The map state records the cancellation.
+Routes: DELETE /api/beta2/maps/:id/mapfile and POST /api/beta2/maps/mapfile/delete/:id (Post-as-Delete).
+DELETE /maps/mapfile/:id is not possible, the router rejects the static path beside DELETE /maps/:id.
+*/
+func cancelMapfile(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmData pd.PrintmapsData
+	var pmState pd.PrintmapsState
+	var pmErrorList pd.PrintmapsErrorList
+
+	id := params.ByName("id")
+	status := http.StatusOK
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMapstate(&pmState, id); err != nil && !os.IsNotExist(err) {
+			message := fmt.Sprintf("error <%v> at readMapstate(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		if pmState.Data.Attributes.MapOrderSubmitted == "" || pmState.Data.Attributes.MapBuildCompleted != "" {
+			appendError(&pmErrorList, "6005", "build status = "+pd.BuildStatus(pmState.Data.Attributes), id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// waiting order: remove it (fails if the build service has just fetched it)
+		order := filepath.Join(pd.PathWorkdir, pd.PathOrders, id) + ".json"
+		err := os.Remove(order)
+		switch {
+		case err == nil:
+			pmState.Data.Attributes.MapBuildCompleted = time.Now().Format(time.RFC3339)
+			pmState.Data.Attributes.MapBuildSuccessful = pd.BuildCancelled
+			pmState.Data.Attributes.MapBuildMessage = "map build cancelled by user (order removed before build)"
+			if err := pd.WriteMapstate(pmState); err != nil {
+				message := fmt.Sprintf("error <%v> at writeMapstate(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		case os.IsNotExist(err):
+			// running build: signal the build service (records the cancellation in the map state)
+			if err := pd.RequestBuildCancel(id); err != nil {
+				message := fmt.Sprintf("error <%v> at pd.RequestBuildCancel(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			status = http.StatusAccepted
+		default:
+			message := fmt.Sprintf("error <%v> at os.Remove(), file = <%s>", err, order)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// request ok, response with (updated) map state
+		content, err := json.MarshalIndent(pmState, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(status)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
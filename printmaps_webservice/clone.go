@@ -0,0 +1,243 @@
+// Clone handler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+cloneMap creates a new map as copy (meta data and user files) of a given map ID.
+The optional request body (JSON:API document, JSON Merge Patch or JSON Patch) overrides attributes of the copy.
+Route: POST /api/beta2/maps/clone/:id (not /maps/:id/clone, the router rejects a wildcard
+beside the static POST paths /maps/metadata, /maps/mapfile etc.).
+*/
+func cloneMap(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmDataSource pd.PrintmapsData
+	var pmData pd.PrintmapsData
+	var pmState pd.PrintmapsState
+	var clonedBytes []byte
+
+	verifyAccept(request, &pmErrorList)
+
+	// log client IP (in order to block malicious clients)
+	log.Printf("cloneMap(): RemoteAddr %s", request.RemoteAddr)
+
+	bodyBytes, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		message := fmt.Sprintf("error <%v> at ioutil.ReadAll()", err)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	// overrides are optional
+	mediaType := ""
+	if len(bodyBytes) > 0 {
+		mediaType = verifyPatchContentType(request, &pmErrorList)
+	}
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err = uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	// verify access (the user files of the source map are copied)
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmDataSource, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		} else {
+			verifyOwner(request, pmDataSource, &pmErrorList)
+		}
+	}
+
+	// apply the overrides to the copy of the meta data
+	if len(pmErrorList.Errors) == 0 {
+		pmDataSource.Data.Attributes.UserFiles = nil
+		clonedBytes, err = json.Marshal(pmDataSource)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.Marshal()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		switch mediaType {
+		case "":
+		case pd.JSONPatchMediaType:
+			clonedBytes, err = pd.ApplyJSONPatch(clonedBytes, bodyBytes)
+		default:
+			clonedBytes, err = pd.MergePatch(clonedBytes, bodyBytes)
+		}
+		if err != nil {
+			appendError(&pmErrorList, "2004", "error = "+err.Error(), id)
+		}
+	}
+
+	// the copy is verified as a whole
+	if len(pmErrorList.Errors) == 0 {
+		verifyBody(clonedBytes, "PrintmapsData", &pmErrorList, id)
+		if err = json.Unmarshal(clonedBytes, &pmData); err != nil {
+			appendError(&pmErrorList, "2001", "error = "+err.Error(), id)
+		} else {
+			pmData.Data.ID = id
+			verifyMetadata(pmData, &pmErrorList)
+		}
+	}
+
+	// the user files are copied (free disk space threshold as for uploads)
+	if len(pmErrorList.Errors) == 0 {
+		files, err := pd.ListUserFiles(id)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at pd.ListUserFiles(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		total := int64(0)
+		for _, fileInfo := range files {
+			total += fileInfo.Size()
+		}
+		verifyDiskSpace(total, &pmErrorList, id)
+	}
+
+	// the owner of the copy is derived from the api key (never taken from the source map)
+	var apiKey ConfigAPIKey
+	if len(pmErrorList.Errors) == 0 {
+		apiKey = verifyAPIKey(request, &pmErrorList, id)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// request ok, response with (new) ID and data, persist data
+		universallyUniqueIdentifier, err := uuid.NewV4()
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at uuid.NewV4()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		pmData.Data.ID = universallyUniqueIdentifier.String()
+		pmData.Data.Attributes.Owner = apiKey.Owner
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision = 1
+
+		detail := fmt.Sprintf("cloned from map %s (revision %d)", id, pmDataSource.Data.Attributes.Revision)
+		if err := writeMetadata(request, pmData, "clone", detail); err != nil {
+			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// copy user files
+		if err := copyUserFiles(id, pmData.Data.ID); err != nil {
+			os.RemoveAll(filepath.Join(pd.PathWorkdir, pd.PathMaps, pmData.Data.ID))
+			message := fmt.Sprintf("error <%v> at copyUserFiles(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// write (fresh) state
+		pmState.Data.Type = "maps"
+		pmState.Data.ID = pmData.Data.ID
+		pmState.Data.Attributes.MapCreated = time.Now().Format(time.RFC3339)
+		pmState.Data.Attributes.MapMetadataWritten = pmState.Data.Attributes.MapCreated
+		if err = pd.WriteMapstate(pmState); err != nil {
+			message := fmt.Sprintf("error <%v> at updateMapstate()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// response includes the copied user files
+		if err := pd.ReadMetadata(&pmData, pmData.Data.ID); err != nil {
+			message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, pmData.Data.ID)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		hideCallbackSecret(&pmData)
+		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write(content)
+		log.Printf("cloneMap(): map %s cloned as %s", id, pmData.Data.ID)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+copyUserFiles copies all user files (incl. their details) from one map directory to another.
+*/
+func copyUserFiles(sourceID string, destinationID string) error {
+	files, err := pd.ListUserFiles(sourceID)
+	if err != nil {
+		return err
+	}
+
+	for _, fileInfo := range files {
+		source := filepath.Join(pd.PathWorkdir, pd.PathMaps, sourceID, fileInfo.Name())
+		destination := filepath.Join(pd.PathWorkdir, pd.PathMaps, destinationID, fileInfo.Name())
+		if err := copyFile(source, destination); err != nil {
+			return err
+		}
+	}
+
+	index, err := pd.ReadUserFileIndex(sourceID)
+	if err != nil || len(index) == 0 {
+		return err
+	}
+	return pd.WriteUserFileIndex(destinationID, index)
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -31,12 +32,25 @@ func createMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 	log.Printf("createMetadata(): RemoteAddr %s", request.RemoteAddr)
 
 	// process body
-	if err := json.NewDecoder(request.Body).Decode(&pmData); err != nil {
+	bodyBytes, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		message := fmt.Sprintf("error <%v> at ioutil.ReadAll()", err)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	if err := json.Unmarshal(bodyBytes, &pmData); err != nil {
 		appendError(&pmErrorList, "2001", "error = "+err.Error(), "")
 	} else {
+		verifyBody(bodyBytes, "PrintmapsData", &pmErrorList, "")
 		verifyMetadata(pmData, &pmErrorList)
 	}
 
+	// the owner of the map is derived from the api key (never taken from the request body)
+	apiKey := verifyAPIKey(request, &pmErrorList, "")
+	pmData.Data.Attributes.Owner = apiKey.Owner
+
 	if len(pmErrorList.Errors) == 0 {
 		// request ok, response with (new) ID and data, persist data
 		universallyUniqueIdentifier, err := uuid.NewV4()
@@ -47,14 +61,16 @@ func createMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 			return
 		}
 		pmData.Data.ID = universallyUniqueIdentifier.String()
+		pmData.Data.Attributes.Revision = 1
 
-		if err := pd.WriteMetadata(pmData); err != nil {
+		if err := writeMetadata(request, pmData, "create", ""); err != nil {
 			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
 			http.Error(writer, message, http.StatusInternalServerError)
 			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
 			return
 		}
 
+		hideCallbackSecret(&pmData)
 		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
 		if err != nil {
 			message := fmt.Sprintf("error <%v> at son.MarshalIndent()", err)
@@ -66,7 +82,8 @@ func createMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 		// write state
 		pmState.Data.Type = "maps"
 		pmState.Data.ID = pmData.Data.ID
-		pmState.Data.Attributes.MapMetadataWritten = time.Now().Format(time.RFC3339)
+		pmState.Data.Attributes.MapCreated = time.Now().Format(time.RFC3339)
+		pmState.Data.Attributes.MapMetadataWritten = pmState.Data.Attributes.MapCreated
 		if err = pd.WriteMapstate(pmState); err != nil {
 			message := fmt.Sprintf("error <%v> at updateMapstate()", err)
 			http.Error(writer, message, http.StatusInternalServerError)
@@ -76,6 +93,7 @@ func createMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
 		writer.WriteHeader(http.StatusCreated)
 		writer.Write(content)
 	} else {
@@ -90,7 +108,7 @@ func createMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
@@ -108,9 +126,18 @@ func createMapfile(writer http.ResponseWriter, request *http.Request, _ httprout
 	verifyAccept(request, &pmErrorList)
 
 	// process body (with map ID)
-	err := json.NewDecoder(request.Body).Decode(&pmDataPost)
+	bodyBytes, err := ioutil.ReadAll(request.Body)
 	if err != nil {
+		message := fmt.Sprintf("error <%v> at ioutil.ReadAll()", err)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	if err = json.Unmarshal(bodyBytes, &pmDataPost); err != nil {
 		appendError(&pmErrorList, "2001", "error = "+err.Error(), "")
+	} else {
+		verifyBody(bodyBytes, "PrintmapsData", &pmErrorList, pmDataPost.Data.ID)
 	}
 
 	id := pmDataPost.Data.ID
@@ -140,11 +167,40 @@ func createMapfile(writer http.ResponseWriter, request *http.Request, _ httprout
 				return
 			}
 		}
-		// verify required data
+		// verify access and required data
+		if len(pmErrorList.Errors) == 0 {
+			verifyOwner(request, pmData, &pmErrorList)
+		}
 		verifyRequiredMetadata(pmData, &pmErrorList)
 		if len(pmErrorList.Errors) == 0 {
-			// everything is ok, create build order
+			// referenced files, layers etc. must exist (instead of a failing map build)
+			if err := verifyPreflight(pmData, &pmErrorList); err != nil {
+				message := fmt.Sprintf("error <%v> at verifyPreflight(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+		client, _ := requestClient(request)
+		if len(pmErrorList.Errors) == 0 {
+			// book build order on the daily quota of the client
+			if reserved, message, wait := pmLimiter.reserveBuildQuota(client, mapArea(pmData)); !reserved {
+				log.Printf("daily quota exceeded, client = <%s>, %s", client, message)
+				appendError(&pmErrorList, "9002", message, id)
+				setRetryAfter(writer, wait)
+			}
+		}
+		if len(pmErrorList.Errors) == 0 {
+			// everything is ok, create build order (a stale cancel request must not hit the new build)
+			if err := pd.RemoveBuildCancel(id); err != nil {
+				pmLimiter.refundBuildQuota(client, mapArea(pmData))
+				message := fmt.Sprintf("error <%v> at pd.RemoveBuildCancel(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
 			if err := createMapOrder(pmData); err != nil {
+				pmLimiter.refundBuildQuota(client, mapArea(pmData))
 				message := fmt.Sprintf("error <%v> at createMapOrder(), id = <%s>", err, id)
 				http.Error(writer, message, http.StatusInternalServerError)
 				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
@@ -182,6 +238,7 @@ func createMapfile(writer http.ResponseWriter, request *http.Request, _ httprout
 
 	if len(pmErrorList.Errors) == 0 {
 		// request ok, response with data
+		hideCallbackSecret(&pmData)
 		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
 		if err != nil {
 			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
@@ -192,6 +249,7 @@ func createMapfile(writer http.ResponseWriter, request *http.Request, _ httprout
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
 		writer.WriteHeader(http.StatusAccepted)
 		writer.Write(content)
 	} else {
@@ -206,7 +264,7 @@ func createMapfile(writer http.ResponseWriter, request *http.Request, _ httprout
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
@@ -38,6 +38,11 @@ func deleteMap(writer http.ResponseWriter, request *http.Request, params httprou
 		}
 	}
 
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
 	if len(pmErrorList.Errors) == 0 {
 		if err := pd.ReadMetadata(&pmData, id); err != nil {
 			if os.IsNotExist(err) {
@@ -51,6 +56,14 @@ func deleteMap(writer http.ResponseWriter, request *http.Request, params httprou
 		}
 	}
 
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
 	if len(pmErrorList.Errors) == 0 {
 		// delete map directory
 		path := filepath.Join(pd.PathWorkdir, pd.PathMaps, id)
@@ -74,7 +87,7 @@ func deleteMap(writer http.ResponseWriter, request *http.Request, params httprou
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
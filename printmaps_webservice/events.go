@@ -0,0 +1,150 @@
+// Map state events handler (Server-Sent Events)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// event stream settings
+const (
+	mapstatePollInterval = 1 * time.Second  // interval to check the map state file for modifications
+	keepAliveInterval    = 15 * time.Second // interval to send a comment line (keeps proxies from closing the connection)
+)
+
+// closed on server shutdown, terminates all open event streams
+var shutdownEventStreams = make(chan struct{})
+
+/*
+streamMapstate sends the state of the map creation process as Server-Sent Events.
+An event ("mapstate") is sent initially and each time the map state file is written.
+The stream ends after the build has been completed (successful or failed) or if the map has been deleted.
+*/
+func streamMapstate(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) > 0 {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		message := "streaming not supported by response writer"
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no") // disable response buffering of nginx
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// event id = modification time of the map state file (avoids resending a known state after reconnect)
+	lastEventID := request.Header.Get("Last-Event-ID")
+	file := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, pd.FileMapstate)
+	var lastModTime time.Time
+
+	pollTicker := time.NewTicker(mapstatePollInterval)
+	defer pollTicker.Stop()
+	keepAliveTicker := time.NewTicker(keepAliveInterval)
+	defer keepAliveTicker.Stop()
+
+	for {
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(writer, "event: deleted\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			log.Printf("error <%v> at os.Stat(), file = <%s>", err, file)
+		} else if !fileInfo.ModTime().Equal(lastModTime) {
+			var pmState pd.PrintmapsState
+			if err := pd.ReadMapstate(&pmState, id); err == nil {
+				// state file completely written and readable
+				lastModTime = fileInfo.ModTime()
+				eventID := strconv.FormatInt(lastModTime.UnixNano(), 10)
+				completed := pmState.Data.Attributes.MapBuildCompleted != ""
+				// the final state is always sent before closing (the client may have missed its dispatch)
+				if eventID != lastEventID || completed {
+					if err := writeMapstateEvent(writer, eventID, pmState); err != nil {
+						return
+					}
+					flusher.Flush()
+					lastEventID = eventID
+				}
+				if completed {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-request.Context().Done():
+			return
+		case <-shutdownEventStreams:
+			return
+		case <-keepAliveTicker.C:
+			if _, err := fmt.Fprintf(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-pollTicker.C:
+		}
+	}
+}
+
+/*
+writeMapstateEvent writes the map state as single event (compact json in one data line).
+*/
+func writeMapstateEvent(writer http.ResponseWriter, eventID string, pmState pd.PrintmapsState) error {
+	content, err := json.Marshal(pmState)
+	if err != nil {
+		log.Printf("error <%v> at json.Marshal()", err)
+		return err
+	}
+
+	_, err = fmt.Fprintf(writer, "id: %s\nevent: mapstate\ndata: %s\n\n", eventID, content)
+	return err
+}
@@ -52,6 +52,7 @@ func fetchMetadata(writer http.ResponseWriter, request *http.Request, params htt
 	}
 
 	if len(pmErrorList.Errors) == 0 {
+		hideCallbackSecret(&pmData)
 		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
 		if err != nil {
 			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
@@ -62,6 +63,7 @@ func fetchMetadata(writer http.ResponseWriter, request *http.Request, params htt
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
 		writer.WriteHeader(http.StatusOK)
 		writer.Write(content)
 	} else {
@@ -76,7 +78,7 @@ func fetchMetadata(writer http.ResponseWriter, request *http.Request, params htt
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
@@ -141,13 +143,13 @@ func fetchMapstate(writer http.ResponseWriter, request *http.Request, params htt
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
 
 /*
-fetchMapfile send the map file with the give map ID to the client.
+fetchMapfile sends the map file with the given map ID to the client (resumable and conditional).
 */
 func fetchMapfile(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 	var pmErrorList pd.PrintmapsErrorList
@@ -199,6 +201,8 @@ func fetchMapfile(writer http.ResponseWriter, request *http.Request, params http
 		// verify state
 		if pmState.Data.Attributes.MapOrderSubmitted == "" {
 			appendError(&pmErrorList, "6001", "please submit map build order first", id)
+		} else if pmState.Data.Attributes.MapBuildSuccessful == pd.BuildCancelled {
+			appendError(&pmErrorList, "6004", pmState.Data.Attributes.MapBuildMessage, id)
 		} else if pmState.Data.Attributes.MapBuildStarted == "" {
 			appendError(&pmErrorList, "6002", "please repeat download request later", id)
 		} else if pmState.Data.Attributes.MapBuildCompleted == "" {
@@ -207,17 +211,38 @@ func fetchMapfile(writer http.ResponseWriter, request *http.Request, params http
 	}
 
 	if len(pmErrorList.Errors) == 0 {
-		// verify build completion (successful == yes/no)
-		if pmState.Data.Attributes.MapBuildSuccessful == "no" {
+		// verify build completion (successful == yes/no/cancelled)
+		if pmState.Data.Attributes.MapBuildSuccessful != "yes" {
 			appendError(&pmErrorList, "6004", pmState.Data.Attributes.MapBuildMessage, id)
 		}
 	}
 
 	if len(pmErrorList.Errors) == 0 {
-		// request ok, response with mapfile
+		// request ok, response with mapfile (supports HEAD, Range, If-Range, If-None-Match)
 		filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, pd.FileMapfile)
-		http.ServeFile(writer, request, filename)
-		log.Printf("Map <%s> send to client", filename)
+		file, err := os.Open(filename)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at os.Open(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		defer file.Close()
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at file.Stat(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/zip")
+		writer.Header().Set("ETag", mapfileETag(id, fileInfo))
+		http.ServeContent(writer, request, pd.FileMapfile, fileInfo.ModTime(), file)
+		if request.Method == http.MethodGet {
+			log.Printf("Map <%s> send to client (range = <%s>)", filename, request.Header.Get("Range"))
+		}
 	} else {
 		// request not ok, response with error list
 		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
@@ -230,11 +255,20 @@ func fetchMapfile(writer http.ResponseWriter, request *http.Request, params http
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
 
+/*
+mapfileETag builds a strong entity tag for the map file.
+The build service replaces the map file as a whole (rename), so each build results
+in a new modification time and therefore in a new entity tag.
+*/
+func mapfileETag(id string, fileInfo os.FileInfo) string {
+	return fmt.Sprintf("\"%s-%x-%x\"", id, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
+
 /*
 fetchUIData fetches the UI data (stored as file) for a given map ID.
 */
@@ -289,7 +323,7 @@ func fetchUIData(writer http.ResponseWriter, request *http.Request, params httpr
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
@@ -0,0 +1,670 @@
+// User file handlers (list, download, replace, delete)
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+listUserFiles lists the uploaded user files of a map (name, size, checksum, type, upload time).
+*/
+func listUserFiles(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmUserFiles pd.PrintmapsUserFiles
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// the index is completed for files uploaded before the index existed
+		unlock := lockMetadata(id)
+		userFiles, err := completeUserFileIndex(id)
+		unlock()
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at completeUserFileIndex(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		pmUserFiles.Data.Type = "maps"
+		pmUserFiles.Data.ID = id
+		pmUserFiles.Data.Attributes.UserFiles = userFiles
+		if pmUserFiles.Data.Attributes.UserFiles == nil {
+			pmUserFiles.Data.Attributes.UserFiles = pd.UserFiles{}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		content, err := json.MarshalIndent(pmUserFiles, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+downloadUserFile sends a single uploaded user file (supports HEAD, Range, If-None-Match).
+*/
+func downloadUserFile(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var userFile pd.UserFile
+
+	id := params.ByName("id")
+	name := params.ByName("name")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		userFile, err = findUserFile(id, name, &pmErrorList)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at findUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// request ok, response with user file
+		filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, userFile.Name)
+		file, err := os.Open(filename)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at os.Open(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		defer file.Close()
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at file.Stat(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		contentType := userFile.Type
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		writer.Header().Set("Content-Type", contentType)
+		writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": userFile.Name}))
+		if userFile.Checksum != "" {
+			writer.Header().Set("ETag", "\""+userFile.Checksum+"\"")
+		}
+		http.ServeContent(writer, request, userFile.Name, fileInfo.ModTime(), file)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+replaceUserFile replaces an uploaded user file atomically (multipart/form-data, field 'file').
+*/
+func replaceUserFile(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmData pd.PrintmapsData
+	var pmErrorList pd.PrintmapsErrorList
+	var userFile pd.UserFile
+
+	id := params.ByName("id")
+	name := params.ByName("name")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	// only existing user files can be replaced
+	if len(pmErrorList.Errors) == 0 {
+		if _, err := findUserFile(id, name, &pmErrorList); err != nil {
+			message := fmt.Sprintf("error <%v> at findUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyDiskSpace(request.ContentLength, &pmErrorList, id)
+	}
+
+	// the file is received without holding the lock of the meta data (slow uploads must not block the map)
+	var tempname string
+	if len(pmErrorList.Errors) == 0 {
+		// input file (streamed)
+		file, err := openFilePart(writer, request)
+		if err != nil {
+			fmt.Fprintln(writer, err)
+			return
+		}
+		defer file.Close()
+
+		tempname, err = receiveUserFile(file, id)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at receiveUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		defer os.Remove(tempname)
+	}
+
+	// store the received file (the meta data is modified)
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+
+		// current revision (modified in the meantime by other requests)
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	// the user file may have been deleted in the meantime
+	if len(pmErrorList.Errors) == 0 {
+		if _, err := findUserFile(id, name, &pmErrorList); err != nil {
+			message := fmt.Sprintf("error <%v> at findUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		userFile, err = commitUserFile(tempname, id, name, "", &pmErrorList)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at commitUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// replace request ok, the set of user files is part of the revision
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision++
+		if err := writeMetadata(request, pmData, "replace", "file "+name); err != nil {
+			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		metricsUploads.Inc("accepted")
+		metricsUploadBytes.Add(float64(userFile.Size))
+		writer.Header().Set("ETag", metadataETag(pmData))
+		writer.WriteHeader(http.StatusOK)
+		message := fmt.Sprintf("file <%s, %d bytes> successfully replaced", userFile.Name, userFile.Size)
+		writer.Write([]byte(message))
+		log.Printf("replaceUserFile(): %s", message)
+	} else {
+		// request not ok, response with error list
+		metricsUploads.Inc("rejected")
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+deleteUserFile deletes a single uploaded user file.
+*/
+func deleteUserFile(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmData pd.PrintmapsData
+	var pmErrorList pd.PrintmapsErrorList
+	var userFile pd.UserFile
+
+	id := params.ByName("id")
+	name := params.ByName("name")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		userFile, err = findUserFile(id, name, &pmErrorList)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at findUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// delete user file
+		filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, userFile.Name)
+		if err := os.Remove(filename); err != nil {
+			message := fmt.Sprintf("error <%v> at os.Remove(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		if err := updateUserFileIndex(id, userFile.Name, nil); err != nil {
+			message := fmt.Sprintf("error <%v> at updateUserFileIndex(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// the set of user files is part of the revision
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision++
+		if err := writeMetadata(request, pmData, "delete", "file "+userFile.Name); err != nil {
+			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("ETag", metadataETag(pmData))
+		writer.WriteHeader(http.StatusNoContent)
+		log.Printf("deleteUserFile(): file <%s> of map %s deleted", userFile.Name, id)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+findUserFile looks up an uploaded user file by name (a plain file name, service files are not accessible).
+*/
+func findUserFile(id string, name string, pmErrorList *pd.PrintmapsErrorList) (pd.UserFile, error) {
+	if !isValidUserFileName(name) {
+		appendError(pmErrorList, "4005", "invalid user file name: "+name, id)
+		return pd.UserFile{}, nil
+	}
+
+	userFiles, err := pd.DescribeUserFiles(id)
+	if err != nil {
+		return pd.UserFile{}, err
+	}
+	for _, userFile := range userFiles {
+		if userFile.Name == name {
+			return userFile, nil
+		}
+	}
+
+	appendError(pmErrorList, "4005", "requested user file not found: "+name, id)
+	return pd.UserFile{}, nil
+}
+
+/*
+isValidUserFileName verifies if the name is usable for a user file (plain name, no hidden or service file).
+*/
+func isValidUserFileName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".") && !pd.IsServiceFile(name)
+}
+
+/*
+receiveUserFile writes the content of an uploaded file to a temporary file in the map directory
+(aborted beyond the upload limit).
+*/
+func receiveUserFile(reader io.Reader, id string) (string, error) {
+	path := filepath.Join(pd.PathWorkdir, pd.PathMaps, id)
+	out, err := ioutil.TempFile(path, ".upload-*")
+	if err != nil {
+		log.Printf("error <%v> at ioutil.TempFile(), path = <%s>", err, path)
+		return "", err
+	}
+	tempname := out.Name()
+
+	if maxFileSize() > 0 {
+		reader = io.LimitReader(reader, maxFileSize()+1)
+	}
+	_, err = io.Copy(out, reader)
+	out.Close()
+	if err != nil {
+		os.Remove(tempname)
+		log.Printf("error <%v> at io.Copy(), file = <%s>", err, tempname)
+		return "", err
+	}
+
+	return tempname, nil
+}
+
+/*
+openFilePart opens the form field 'file' of a multipart request as stream (the body isn't buffered on disk).
+The request body is limited to the upload limit (plus the multipart overhead).
+*/
+func openFilePart(writer http.ResponseWriter, request *http.Request) (*multipart.Part, error) {
+	if maxFileSize() > 0 {
+		request.Body = http.MaxBytesReader(writer, request.Body, maxFileSize()+megabyte)
+	}
+
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+/*
+commitUserFile verifies a received file (size, quota, security, optional checksum) and moves it atomically to the user files.
+A rejected file is reported in the error list and removed.
+*/
+func commitUserFile(tempname string, id string, name string, checksum string, pmErrorList *pd.PrintmapsErrorList) (pd.UserFile, error) {
+	userFile := pd.UserFile{Name: name}
+
+	fileInfo, err := os.Stat(tempname)
+	if err != nil {
+		log.Printf("error <%v> at os.Stat(), file = <%s>", err, tempname)
+		return userFile, err
+	}
+	userFile.Size = fileInfo.Size()
+
+	verifyFileSize(userFile.Size, pmErrorList, id)
+	if len(pmErrorList.Errors) > 0 {
+		log.Printf("user file <%s> (%d bytes) exceeds upload limit", name, userFile.Size)
+	} else if err := verifyStorageQuota(id, name, userFile.Size, pmErrorList); err != nil {
+		os.Remove(tempname)
+		return userFile, err
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// verify content of uploaded file against the accepted formats
+		contentType, reason, err := verifyUploadedFile(tempname, name)
+		if err != nil {
+			os.Remove(tempname)
+			return userFile, err
+		}
+		if reason != "" {
+			log.Printf("user file <%s> rejected: %s", name, reason)
+			appendError(pmErrorList, "7002", reason, id)
+		} else {
+			userFile.Checksum, _, err = inspectUserFile(tempname)
+			if err != nil {
+				os.Remove(tempname)
+				return userFile, err
+			}
+			userFile.Type = contentType
+			if checksum != "" && !strings.EqualFold(checksum, userFile.Checksum) {
+				log.Printf("user file <%s> damaged, checksum <%s> expected, <%s> calculated", name, checksum, userFile.Checksum)
+				appendError(pmErrorList, "7003", "calculated checksum (sha256) = "+userFile.Checksum, id)
+			}
+		}
+	}
+	if len(pmErrorList.Errors) > 0 {
+		if err := os.Remove(tempname); err != nil {
+			log.Printf("unexpected error <%s> os.Remove(), file = <%s>", err, tempname)
+		}
+		return userFile, nil
+	}
+	userFile.Uploaded = time.Now().UTC().Format(time.RFC3339)
+
+	filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, name)
+	if err := os.Rename(tempname, filename); err != nil {
+		os.Remove(tempname)
+		log.Printf("error <%v> at os.Rename(), file = <%s>", err, filename)
+		return userFile, err
+	}
+
+	return userFile, updateUserFileIndex(id, name, &userFile)
+}
+
+/*
+inspectUserFile calculates the checksum (sha256) and detects the content type of a file.
+*/
+func inspectUserFile(filename string) (checksum string, contentType string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("error <%v> at os.Open(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	defer file.Close()
+
+	// content type detection considers at most the first 512 bytes
+	head := make([]byte, 512)
+	count, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("error <%v> at io.ReadFull(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	contentType = http.DetectContentType(head[:count])
+
+	hash := sha256.New()
+	hash.Write(head[:count])
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Printf("error <%v> at io.Copy(), file = <%s>", err, filename)
+		return "", "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), contentType, nil
+}
+
+/*
+updateUserFileIndex sets (or removes if nil) the details of a user file in the index.
+*/
+func updateUserFileIndex(id string, name string, userFile *pd.UserFile) error {
+	index, err := pd.ReadUserFileIndex(id)
+	if err != nil {
+		return err
+	}
+
+	userFiles := pd.UserFiles{}
+	for _, entry := range index {
+		if entry.Name != name {
+			userFiles = append(userFiles, entry)
+		}
+	}
+	if userFile != nil {
+		userFiles = append(userFiles, *userFile)
+	}
+
+	return pd.WriteUserFileIndex(id, userFiles)
+}
+
+/*
+completeUserFileIndex adds the missing details (checksum, type) to the index, returns the user files.
+*/
+func completeUserFileIndex(id string) (pd.UserFiles, error) {
+	userFiles, err := pd.DescribeUserFiles(id)
+	if err != nil {
+		return nil, err
+	}
+
+	completed := false
+	for index := range userFiles {
+		if userFiles[index].Checksum != "" {
+			continue
+		}
+		filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, id, userFiles[index].Name)
+		userFiles[index].Checksum, userFiles[index].Type, err = inspectUserFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		completed = true
+	}
+
+	if completed {
+		if err := pd.WriteUserFileIndex(id, userFiles); err != nil {
+			return nil, err
+		}
+	}
+	return userFiles, nil
+}
@@ -0,0 +1,60 @@
+// Health and readiness handler
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+revealHealth reports the liveness of this service (process is running and serving requests).
+*/
+func revealHealth(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	var report pd.HealthReport
+
+	report.AddCheck("listener", nil)
+	pd.WriteHealthReport(writer, report)
+}
+
+/*
+revealReadiness reports the readiness of this service (able to accept map requests).
+*/
+func revealReadiness(writer http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	var report pd.HealthReport
+
+	report.AddCheck("workdir", pd.CheckDirWritable(pd.PathWorkdir))
+	report.AddCheck("maps directory", pd.CheckDirWritable(filepath.Join(pd.PathWorkdir, pd.PathMaps)))
+	report.AddCheck("orders directory", pd.CheckDirWritable(filepath.Join(pd.PathWorkdir, pd.PathOrders)))
+
+	var err error
+	if len(pmFeature.ConfigStyles) == 0 || len(pmFeature.ConfigMapformats) == 0 {
+		err = errors.New("no map styles or map formats loaded from " + config.Capafile)
+	}
+	report.AddCheck("capabilities", err)
+
+	// full planet osm data (world) : config.Polyfile empty
+	if config.Polyfile != "" {
+		err = nil
+		if len(pPolygon.Points) < 3 {
+			err = errors.New("no polygon loaded from " + config.Polyfile)
+		}
+		report.AddCheck("polyfile", err)
+	}
+
+	// uploads are rejected below the disk space threshold
+	if config.Uploads.Mindiskspace > 0 {
+		free, err := freeDiskSpace(pd.PathWorkdir)
+		if err == nil && free < config.Uploads.Mindiskspace*megabyte {
+			err = fmt.Errorf("free disk space %d MB below threshold %d MB", free/megabyte, config.Uploads.Mindiskspace)
+		}
+		report.AddCheck("disk space", err)
+	}
+
+	pd.WriteHealthReport(writer, report)
+}
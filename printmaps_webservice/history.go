@@ -0,0 +1,426 @@
+// Revision history handler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+/*
+fetchRevisions fetches the revision history of the meta data for a given map ID (owner or admin only).
+*/
+func fetchRevisions(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmData pd.PrintmapsData
+	var pmRevisions pd.PrintmapsRevisions
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	// the history reveals the authors and all former meta data
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		revisions, err := pd.ListRevisions(id)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at listRevisions(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// the client addresses are only reported to admins (kept in the stored revisions)
+		if apiKey, _ := lookupAPIKey(requestAPIKey(request)); !apiKey.Admin {
+			for index := range revisions {
+				revisions[index].ClientIP = ""
+			}
+		}
+
+		pmRevisions.Data.Type = "maps"
+		pmRevisions.Data.ID = id
+		pmRevisions.Data.Attributes.Current = pmData.Data.Attributes.Revision
+		pmRevisions.Data.Attributes.Revisions = revisions
+		content, err := json.MarshalIndent(pmRevisions, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+diffRevisions lists the differences between two revisions of the meta data for a given map ID
+(query parameters: from = older revision, default: to - 1; to = newer revision, default: current revision).
+Only the owner (or an admin) of the map is allowed to compare revisions.
+*/
+func diffRevisions(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmData pd.PrintmapsData
+	var pmDiff pd.PrintmapsRevisionDiff
+	var metadataFrom, metadataTo pd.Metadata
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	// the history reveals the authors and all former meta data
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	// revisions to compare
+	to := pmData.Data.Attributes.Revision
+	from := to - 1
+	if len(pmErrorList.Errors) == 0 {
+		to = revisionParameter(request, "to", to, &pmErrorList, id)
+		from = revisionParameter(request, "from", to-1, &pmErrorList, id)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		for _, revision := range []struct {
+			number   int
+			metadata *pd.Metadata
+		}{{from, &metadataFrom}, {to, &metadataTo}} {
+			found, err := readRevisionMetadata(pmData, revision.number, revision.metadata)
+			if err != nil {
+				message := fmt.Sprintf("error <%v> at readRevisionMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			if !found {
+				appendError(&pmErrorList, "4004", fmt.Sprintf("revision %d not found", revision.number), id)
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// a changed callback secret is reported without revealing the values
+		comparableFrom := comparableMetadata(metadataFrom)
+		comparableTo := comparableMetadata(metadataTo)
+		if metadataFrom.CallbackSecret != "" && metadataTo.CallbackSecret != "" && metadataFrom.CallbackSecret != metadataTo.CallbackSecret {
+			comparableTo.CallbackSecret = hiddenSecret + " (changed)"
+		}
+
+		dataFrom, err := json.Marshal(comparableFrom)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.Marshal()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		dataTo, err := json.Marshal(comparableTo)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.Marshal()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		changes, err := pd.DiffJSON(dataFrom, dataTo)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at pd.DiffJSON()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		pmDiff.Data.Type = "maps"
+		pmDiff.Data.ID = id
+		pmDiff.Data.Attributes.From = from
+		pmDiff.Data.Attributes.To = to
+		pmDiff.Data.Attributes.Changes = changes
+		content, err := json.MarshalIndent(pmDiff, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+rollbackRevision restores an older revision (query parameter: revision) as current meta data for a given map ID.
+*/
+func rollbackRevision(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmDataStored pd.PrintmapsData
+	var pmData pd.PrintmapsData
+	var metadata pd.Metadata
+
+	verifyAccept(request, &pmErrorList)
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	// read-modify-write cycle of the meta data must not interleave
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
+	// verify access (owner of the stored map) and revision (If-Match)
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmDataStored, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		} else {
+			verifyOwner(request, pmDataStored, &pmErrorList)
+		}
+		if len(pmErrorList.Errors) == 0 {
+			verifyIfMatch(request, pmDataStored, &pmErrorList)
+		}
+	}
+
+	// revision to restore
+	revision := 0
+	if len(pmErrorList.Errors) == 0 {
+		revision = revisionParameter(request, "revision", 0, &pmErrorList, id)
+		if len(pmErrorList.Errors) == 0 && revision == 0 {
+			appendError(&pmErrorList, "2002", "query parameter 'revision' required", id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		found, err := readRevisionMetadata(pmDataStored, revision, &metadata)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at readRevisionMetadata(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		if !found {
+			appendError(&pmErrorList, "4004", fmt.Sprintf("revision %d not found", revision), id)
+		}
+	}
+
+	// the restored data set must be valid (e.g. style still available)
+	if len(pmErrorList.Errors) == 0 {
+		pmData.Data.Type = "maps"
+		pmData.Data.ID = id
+		pmData.Data.Attributes = metadata
+		pmData.Data.Attributes.Owner = pmDataStored.Data.Attributes.Owner
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision = pmDataStored.Data.Attributes.Revision + 1
+		verifyMetadata(pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// request ok, response with restored data, persist data
+		if err := writeMetadata(request, pmData, "rollback", fmt.Sprintf("revision %d restored", revision)); err != nil {
+			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		hideCallbackSecret(&pmData)
+		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// reset state (the map must be rebuild)
+		if err = resetMapstate(id); err != nil {
+			message := fmt.Sprintf("error <%v> at resetMapstate(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+revisionParameter reads a revision number from the query (default value if not given).
+*/
+func revisionParameter(request *http.Request, name string, defaultValue int, pmErrorList *pd.PrintmapsErrorList, mapID string) int {
+	value := request.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 1 {
+		appendError(pmErrorList, "2002", fmt.Sprintf("query parameter '%s' must be a revision number (>= 1), got '%s'", name, value), mapID)
+		return defaultValue
+	}
+	return revision
+}
+
+/*
+readRevisionMetadata reads the meta data of a revision (the current revision is taken from the meta data itself).
+*/
+func readRevisionMetadata(pmData pd.PrintmapsData, number int, metadata *pd.Metadata) (bool, error) {
+	if number == pmData.Data.Attributes.Revision {
+		*metadata = pmData.Data.Attributes
+		return true, nil
+	}
+
+	var revision pd.MetadataRevision
+	if err := pd.ReadRevision(&revision, pmData.Data.ID, number); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if revision.Metadata == nil {
+		return false, nil
+	}
+	*metadata = *revision.Metadata
+	return true, nil
+}
+
+/*
+comparableMetadata removes the server managed elements and hides the callback secret.
+*/
+func comparableMetadata(metadata pd.Metadata) pd.Metadata {
+	metadata.Revision = 0
+	metadata.Owner = ""
+	metadata.UserFiles = nil
+	if metadata.CallbackSecret != "" {
+		metadata.CallbackSecret = hiddenSecret
+	}
+	return metadata
+}
@@ -0,0 +1,300 @@
+// List handler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// pagination defaults
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	maxPageNumber   = math.MaxInt32 // (number-1) * size must not overflow
+)
+
+// mapListEntry is used to collect the maps (list entry with creation date)
+type mapListEntry struct {
+	id      string
+	created time.Time
+	summary pd.MapSummary
+}
+
+// mapListFilter describes the filter and sort criteria of a list request
+type mapListFilter struct {
+	style         string
+	buildStatus   string
+	owner         string
+	createdAfter  time.Time
+	createdBefore time.Time
+	ascending     bool
+	pageNumber    int
+	pageSize      int
+}
+
+/*
+listMaps lists all maps (paginated, filtered and sorted by creation date).
+Query parameters:
+- filter[style], filter[state], filter[owner], filter[createdafter], filter[createdbefore]
+- sort (date or -date)
+- page[number], page[size]
+*/
+func listMaps(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmList pd.PrintmapsList
+
+	query := request.URL.Query()
+	filter := parseMapListFilter(query, &pmErrorList)
+
+	// only admins are allowed to list the maps of all owners
+	// without authentication the list is disabled (the map ID grants full access to the map)
+	apiKey := verifyAPIKey(request, &pmErrorList, "")
+	if len(pmErrorList.Errors) == 0 && !isAuthEnabled() {
+		appendError(&pmErrorList, "8004", "listing maps requires api keys (authentication disabled)", "")
+	}
+	if len(pmErrorList.Errors) == 0 && !apiKey.Admin {
+		if apiKey.Owner == "" {
+			appendError(&pmErrorList, "8001", "api key required to list maps", "")
+		} else if filter.owner != "" && filter.owner != apiKey.Owner {
+			appendError(&pmErrorList, "8004", "admin api key required to list maps of other owners", "")
+		} else {
+			filter.owner = apiKey.Owner
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		entries, err := collectMaps(filter)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at collectMaps()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			if filter.ascending {
+				return entries[i].created.Before(entries[j].created)
+			}
+			return entries[i].created.After(entries[j].created)
+		})
+
+		pmList.Data = make([]pd.PrintmapsListEntry, 0, filter.pageSize)
+
+		first := (filter.pageNumber - 1) * filter.pageSize
+		for index := first; index < len(entries) && index < first+filter.pageSize; index++ {
+			pmList.Data = append(pmList.Data, pd.PrintmapsListEntry{Type: "maps", ID: entries[index].id, Attributes: entries[index].summary})
+		}
+
+		pmList.Meta.Total = len(entries)
+		pmList.Meta.PageNumber = filter.pageNumber
+		pmList.Meta.PageSize = filter.pageSize
+		pmList.Links.Self = pageLink(request.URL, filter.pageNumber)
+		if filter.pageNumber > 1 {
+			pmList.Links.Prev = pageLink(request.URL, filter.pageNumber-1)
+		}
+		if first+filter.pageSize < len(entries) {
+			pmList.Links.Next = pageLink(request.URL, filter.pageNumber+1)
+		}
+
+		content, err := json.MarshalIndent(pmList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+parseMapListFilter parses the query parameters of a list request.
+*/
+func parseMapListFilter(query url.Values, pmErrorList *pd.PrintmapsErrorList) mapListFilter {
+	filter := mapListFilter{pageNumber: 1, pageSize: defaultPageSize}
+
+	filter.style = query.Get("filter[style]")
+	filter.owner = query.Get("filter[owner]")
+
+	filter.buildStatus = query.Get("filter[state]")
+	switch filter.buildStatus {
+	case "", pd.BuildStatusCreated, pd.BuildStatusOrdered, pd.BuildStatusStarted, pd.BuildStatusSuccessful, pd.BuildStatusFailed, pd.BuildStatusCancelled:
+	default:
+		validStates := strings.Join([]string{pd.BuildStatusCreated, pd.BuildStatusOrdered, pd.BuildStatusStarted, pd.BuildStatusSuccessful, pd.BuildStatusFailed, pd.BuildStatusCancelled}, ", ")
+		appendError(pmErrorList, "2002", "filter[state]: valid values: "+validStates, "")
+	}
+
+	for _, name := range []string{"filter[createdafter]", "filter[createdbefore]"} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		date, err := parseDate(value)
+		if err != nil {
+			appendError(pmErrorList, "2002", name+": valid formats: 2006-01-02 or 2006-01-02T15:04:05Z07:00", "")
+			continue
+		}
+		if name == "filter[createdafter]" {
+			filter.createdAfter = date
+		} else {
+			filter.createdBefore = date
+		}
+	}
+
+	switch query.Get("sort") {
+	case "", "-date":
+		filter.ascending = false
+	case "date":
+		filter.ascending = true
+	default:
+		appendError(pmErrorList, "2002", "sort: valid values: date, -date", "")
+	}
+
+	if value := query.Get("page[number]"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || number > maxPageNumber {
+			appendError(pmErrorList, "2002", fmt.Sprintf("page[number]: valid values: 1 ... %d", maxPageNumber), "")
+		} else {
+			filter.pageNumber = number
+		}
+	}
+
+	if value := query.Get("page[size]"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > maxPageSize {
+			appendError(pmErrorList, "2002", fmt.Sprintf("page[size]: valid values: 1 ... %d", maxPageSize), "")
+		} else {
+			filter.pageSize = size
+		}
+	}
+
+	return filter
+}
+
+/*
+parseDate parses a date (2006-01-02) or a timestamp (RFC3339).
+*/
+func parseDate(value string) (time.Time, error) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+/*
+collectMaps walks through the maps directory and collects all maps matching the filter.
+*/
+func collectMaps(filter mapListFilter) ([]mapListEntry, error) {
+	var entries []mapListEntry
+
+	path := filepath.Join(pd.PathWorkdir, pd.PathMaps)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Printf("error <%v> at ioutil.ReadDir(), path = <%v>", err, path)
+		return nil, err
+	}
+
+	for _, fileInfo := range files {
+		if !fileInfo.IsDir() {
+			continue
+		}
+		id := fileInfo.Name()
+		if _, err := uuid.FromString(id); err != nil {
+			continue
+		}
+
+		var pmData pd.PrintmapsData
+		var pmState pd.PrintmapsState
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			// map deleted in the meantime or incomplete
+			continue
+		}
+		if err := pd.ReadMapstate(&pmState, id); err != nil {
+			continue
+		}
+
+		entry := mapListEntry{id: id}
+		attributes := pmData.Data.Attributes
+		entry.summary = pd.MapSummary{
+			Fileformat:  attributes.Fileformat,
+			Scale:       attributes.Scale,
+			PrintWidth:  attributes.PrintWidth,
+			PrintHeight: attributes.PrintHeight,
+			Latitude:    attributes.Latitude,
+			Longitude:   attributes.Longitude,
+			Style:       attributes.Style,
+			Owner:       attributes.Owner,
+			BuildStatus: pd.BuildStatus(pmState.Data.Attributes),
+			Mapstate:    pmState.Data.Attributes,
+		}
+
+		// maps created before the creation date was recorded: use the date of the first meta data write
+		created := pmState.Data.Attributes.MapCreated
+		if created == "" {
+			created = pmState.Data.Attributes.MapMetadataWritten
+		}
+		entry.created, _ = time.Parse(time.RFC3339, created)
+
+		if filter.style != "" && filter.style != entry.summary.Style {
+			continue
+		}
+		if filter.buildStatus != "" && filter.buildStatus != entry.summary.BuildStatus {
+			continue
+		}
+		if filter.owner != "" && filter.owner != entry.summary.Owner {
+			continue
+		}
+		if !filter.createdAfter.IsZero() && entry.created.Before(filter.createdAfter) {
+			continue
+		}
+		if !filter.createdBefore.IsZero() && !entry.created.Before(filter.createdBefore) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+/*
+pageLink builds the link to the given page of a list request.
+*/
+func pageLink(requestURL *url.URL, pageNumber int) string {
+	query := requestURL.Query()
+	query.Set("page[number]", strconv.Itoa(pageNumber))
+	return requestURL.Path + "?" + query.Encode()
+}
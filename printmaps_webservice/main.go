@@ -54,25 +54,63 @@ Primary workflows (abstracted):
   server resonses with 'id' and accepted 'meta data'
 - step 2: client sends 'build order' request (identified by 'id')
   server verifies 'build order'
+  server checks all references of the map (user files, layers, srs, hidden layers, markers)
   server places 'build order' for (parallel running) build service
   server responses with 'accepted'
 - build service (running as parallel process) builds the map:
-  build service fetches 'build order'
+  build service fetches 'build order' (claimed under a lease, interrupted builds are requeued)
   build service builds the map
   build service stores the map in 'directory'
   build service updates 'map state'
 - step 3: client requests 'map state' (identified by 'id')
   server responses with 'map state'
+  (alternative: client subscribes to 'map state events', server pushes each 'map state' change)
 - step 4 (if 'map state' includes 'build ok'): client requests 'download'
   server responses with 'map'
 
 Optional workflows (abstracted):
+- list maps request
+  client requests 'list of maps' (filtered by style, build state, owner, creation date)
+  server responses with 'list of map summaries' (paginated)
 - meta data request
   client requests 'meta data' (identified by 'id')
-  server responses with 'meta data'
+  server responses with 'meta data' (ETag = revision of the 'meta data')
 - meta data update
-  client sends updated 'meta data' (identified by 'id')
+  client sends changed 'meta data' elements (identified by 'id', JSON Merge Patch or JSON Patch)
+  or the complete 'meta data' (JSON:API document, replaces the stored 'meta data')
+  (optional: client sends known revision as 'If-Match', server rejects update of modified 'meta data')
+  server applies the changes to the stored 'meta data', verifies the result
   server responses with updated 'meta data'
+- clone map request
+  client requests 'clone' of a map (identified by 'id', optional with changed 'meta data' elements)
+  server copies 'meta data' and 'user files' to a new map (new 'id', fresh 'map state')
+  server responses with 'meta data' of the new map
+- revision history request
+  client (owner or admin) requests 'revisions' of the 'meta data' (identified by 'id', each change is archived)
+  server responses with 'revisions' (time, author, client ip for admins only) or 'differences' between two revisions
+- rollback request
+  client requests 'rollback' to an older revision (identified by 'id' and 'revision')
+  server restores the 'meta data' of the revision as new revision, resets 'map state'
+  server responses with restored 'meta data'
+- resumable upload request (large user files)
+  client starts 'upload' (identified by 'id', file name, size and checksum)
+  client sends the file in chunks (Content-Range), resumes at the 'offset' after interruptions
+  server verifies the complete file (checksum) and stores it as 'user file'
+- archive upload request (e.g. shapefile bundle)
+  client uploads a zip archive (identified by 'id')
+  server extracts the accepted files as 'user files' (shapefiles must be complete: .shp, .shx, .dbf, .prj)
+  server responses with the extracted files and the layers usable by 'user objects'
+- user files request
+  client requests 'user files' (identified by 'id')
+  server responses with 'user files' (name, size, checksum, type, upload time)
+  (single 'user file' can be downloaded, replaced or deleted, replacing is atomic)
+- callbacks request
+  client requests 'callback delivery attempts' (identified by 'id')
+  server responses with 'callback delivery attempts' (logged by build service)
+- cancel build request
+  client requests 'cancel' of the map build (identified by 'id')
+  server removes a waiting 'build order' or signals the build service to kill the running build
+  'map state' records the cancelled build
 - delete map request
   client request 'delete' map (meta, state, map data) (identified by 'id')
   server deletes all artifacts
@@ -100,7 +138,6 @@ Logging:
 - It only contains service state and error informations.
 
 ToDo:
-- metrics
 
 Links:
 - http://www.printmaps-osm.de
@@ -112,10 +149,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
 	"os"
 	"os/signal"
@@ -132,13 +169,21 @@ import (
 
 // Config defines all program settings
 type Config struct {
-	Logfile         string
-	Workdir         string
-	Addr            string
-	Capafile        string
-	Polyfile        string
-	Maintenancefile string
-	Maintenancemode bool
+	Logfile          string
+	Workdir          string
+	Addr             string
+	Capafile         string
+	Polyfile         string
+	Markersdir       string
+	Maintenancefile  string
+	Maintenancemode  bool
+	Apikeys          []ConfigAPIKey
+	Apikeyfile       string
+	Apikeyrequired   bool
+	Ratelimitsip     ConfigRateLimits
+	Ratelimitsapikey ConfigRateLimits
+	Quotas           ConfigQuotas
+	Uploads          ConfigUploads
 }
 
 var config Config
@@ -228,6 +273,10 @@ func main() {
 		log.Fatalf("fatal error <%v> at ioutil.ReadFile(), file = <%s>", err, configfile)
 	}
 
+	// upload limit of former releases (if not configured)
+	config.Uploads.Maxfilesize = 224
+	config.Uploads.Maxuploads = 5
+
 	if err = yaml.Unmarshal(source, &config); err != nil {
 		log.Fatalf("fatal error <%v> at yaml.Unmarshal()", err)
 	}
@@ -251,9 +300,16 @@ func main() {
 	log.Printf("config addr = %s", config.Addr)
 	log.Printf("config capafile  = %s", config.Capafile)
 	log.Printf("config polyfile = %s", config.Polyfile)
+	log.Printf("config markersdir = %s", config.Markersdir)
 	log.Printf("config logfile = %s", config.Logfile)
 	log.Printf("config maintenancefile = %s", config.Maintenancefile)
 	log.Printf("config maintenancemode = %t", config.Maintenancemode)
+	log.Printf("config apikeyfile = %s", config.Apikeyfile)
+	log.Printf("config apikeyrequired = %t", config.Apikeyrequired)
+	log.Printf("config ratelimitsip = %+v", config.Ratelimitsip)
+	log.Printf("config ratelimitsapikey = %+v", config.Ratelimitsapikey)
+	log.Printf("config quotas = %+v", config.Quotas)
+	log.Printf("config uploads = %+v", config.Uploads)
 
 	// change into working directory
 	if err = os.Chdir(config.Workdir); err != nil {
@@ -284,6 +340,20 @@ func main() {
 		pPolygonBoundingBox = pip.GetBoundingBox(pPolygon)
 	}
 
+	// load api keys (authentication is disabled if no keys are configured)
+	if err := loadAPIKeys(); err != nil {
+		log.Fatalf("fatal error <%v> at loadAPIKeys(), file = <%v>", err, config.Apikeyfile)
+	}
+	log.Printf("api keys loaded = %d", len(apiKeys))
+
+	// load daily quota usages (counters of the current day survive a restart)
+	if err := pmLimiter.loadUsages(); err != nil {
+		log.Printf("error <%v> at loadUsages(), daily quota counters reset", err)
+	}
+
+	// remove expired (unfinished) chunked uploads of all maps
+	go sweepExpiredUploads()
+
 	// read capabilities file (describing the features of this service)
 	if err := readCapafile(config.Capafile, &pmFeature); err != nil {
 		log.Fatalf("fatal error <%v> at readCapafile(), file = <%v>", err, config.Capafile)
@@ -307,29 +377,72 @@ func main() {
 	if !config.Maintenancemode {
 		// production mode
 		// GET (fetch resource)
+		router.GET("/api/beta2/maps", middlewareHandler(listMaps))
 		router.GET("/api/beta2/maps/metadata/:id", middlewareHandler(fetchMetadata))
 		router.GET("/api/beta2/maps/mapstate/:id", middlewareHandler(fetchMapstate))
+		router.GET("/api/beta2/maps/mapstate/:id/events", middlewareHandler(streamMapstate))
 		router.GET("/api/beta2/maps/mapfile/:id", middlewareHandler(fetchMapfile))
+		router.HEAD("/api/beta2/maps/mapfile/:id", middlewareHandler(fetchMapfile))
 		router.GET("/api/beta2/maps/uidata/:id", middlewareHandler(fetchUIData))
+		router.GET("/api/beta2/maps/callbacks/:id", middlewareHandler(fetchCallbacks))
+		router.GET("/api/beta2/maps/revisions/:id", middlewareHandler(fetchRevisions))
+		router.GET("/api/beta2/maps/revisions/:id/diff", middlewareHandler(diffRevisions))
 
 		// POST (create resource)
-		router.POST("/api/beta2/maps/metadata", middlewareHandler(createMetadata))
-		router.POST("/api/beta2/maps/mapfile", middlewareHandler(createMapfile))
+		router.POST("/api/beta2/maps/metadata", middlewareHandler(rateLimitHandler("create", createMetadata)))
+		router.POST("/api/beta2/maps/mapfile", middlewareHandler(rateLimitHandler("order", createMapfile)))
+		router.POST("/api/beta2/maps/revisions/:id/rollback", middlewareHandler(rollbackRevision))
+		router.POST("/api/beta2/maps/clone/:id", middlewareHandler(rateLimitHandler("create", cloneMap))) // not /maps/:id/clone (router conflict)
 
 		// PATCH (update resource)
 		router.PATCH("/api/beta2/maps/metadata", middlewareHandler(updateMetadata))
 		router.POST("/api/beta2/maps/metadata/patch", middlewareHandler(updateMetadata)) // Post-as-Patch
+		router.PATCH("/api/beta2/maps/metadata/:id", middlewareHandler(updateMetadata))
+		router.POST("/api/beta2/maps/metadata/patch/:id", middlewareHandler(updateMetadata)) // Post-as-Patch
 
 		// DELETE (delete resource)
 		router.DELETE("/api/beta2/maps/:id", middlewareHandler(deleteMap))
 		router.POST("/api/beta2/maps/delete/:id", middlewareHandler(deleteMap)) // Post-as-Delete
+		// cancel build: not /maps/mapfile/:id (the router rejects the static path beside /maps/:id)
+		router.DELETE("/api/beta2/maps/:id/mapfile", middlewareHandler(cancelMapfile))
+		router.POST("/api/beta2/maps/mapfile/delete/:id", middlewareHandler(cancelMapfile)) // Post-as-Delete
 
 		// service / mapdata capabilities
 		router.GET("/api/beta2/maps/capabilities/service", middlewareHandler(revealCapaService))
 		router.GET("/api/beta2/maps/capabilities/mapdata", middlewareHandler(revealCapaMapdata))
 
 		// upload user data file
-		router.POST("/api/beta2/maps/upload/:id", middlewareHandler(uploadUserdata))
+		router.POST("/api/beta2/maps/upload/:id", middlewareHandler(rateLimitHandler("upload", uploadUserdata)))
+
+		// resumable (chunked) upload of user data file
+		router.POST("/api/beta2/maps/uploads/:id", middlewareHandler(rateLimitHandler("upload", createUpload)))
+		router.GET("/api/beta2/maps/uploads/:id/:upload", middlewareHandler(fetchUpload))
+		router.HEAD("/api/beta2/maps/uploads/:id/:upload", middlewareHandler(fetchUpload))
+		router.PUT("/api/beta2/maps/uploads/:id/:upload", middlewareHandler(writeUploadChunk))
+		router.POST("/api/beta2/maps/uploads/:id/:upload", middlewareHandler(writeUploadChunk)) // Post-as-Put
+		router.DELETE("/api/beta2/maps/:id/uploads/:upload", middlewareHandler(deleteUpload))
+
+		// manage user data files (the router rejects /maps/:id/files beside the static GET paths)
+		router.GET("/api/beta2/maps/files/:id", middlewareHandler(listUserFiles))
+		router.GET("/api/beta2/maps/files/:id/:name", middlewareHandler(downloadUserFile))
+		router.HEAD("/api/beta2/maps/files/:id/:name", middlewareHandler(downloadUserFile))
+		router.PUT("/api/beta2/maps/files/:id/:name", middlewareHandler(rateLimitHandler("upload", replaceUserFile)))
+		router.POST("/api/beta2/maps/files/replace/:id/:name", middlewareHandler(rateLimitHandler("upload", replaceUserFile))) // Post-as-Put
+		router.DELETE("/api/beta2/maps/:id/files/:name", middlewareHandler(deleteUserFile))
+		router.POST("/api/beta2/maps/files/delete/:id/:name", middlewareHandler(deleteUserFile)) // Post-as-Delete
+
+		// admin: current rate limit and quota counters
+		router.GET("/api/beta2/maps/admin/limits", middlewareHandler(revealLimits))
+
+		// api description (openapi)
+		router.GET("/api/beta2/openapi.json", middlewareHandler(revealOpenAPI))
+
+		// metrics (prometheus)
+		router.GET("/metrics", revealMetrics)
+
+		// liveness and readiness (process supervisor, load balancer)
+		router.GET("/healthz", revealHealth)
+		router.GET("/readyz", revealReadiness)
 	} else {
 		// maintenance mode (catches all requests)
 		log.Printf("--> MAINTENANCE MODE ACTIVATED <--")
@@ -343,7 +456,13 @@ func main() {
 	signal.Notify(stopChan, syscall.SIGTERM) // kill -SIGTERM pid -> terminated
 
 	// with CORS support (Cross Origin Resource Sharing)
-	pmWebservice := &http.Server{Addr: config.Addr, Handler: cors.Default().Handler(router)}
+	corsHandler := cors.New(cors.Options{
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Requested-With", "Authorization", "If-Match", "Content-Range"},
+		ExposedHeaders: []string{"ETag", "Location", "Upload-Offset"},
+	})
+	pmWebservice := &http.Server{Addr: config.Addr, Handler: corsHandler.Handler(router)}
+	pmWebservice.RegisterOnShutdown(func() { close(shutdownEventStreams) })
 	go func() {
 		log.Printf("Listen for requests on port %s ...", config.Addr)
 		if err := pmWebservice.ListenAndServe(); err != nil {
@@ -368,53 +487,169 @@ func main() {
 
 /*
 middlewareHandler is a wrapper to catch all client requests.
+The response is streamed directly to the client. Only the status code, the size and the latency
+of the response are captured. Bounded prefixes of the request and response bodies are recorded
+and logged in case of status code 500 ("internal server error").
 */
 func middlewareHandler(nextFunction httprouter.Handle) httprouter.Handle {
 	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-		// dump request before consuming
-		dumpedRequest := dumpRequest(request)
-		// log.Printf("Request %s", dumpedRequest)
+		start := time.Now()
 
-		// create response recorder and delegate request to the given handle
-		responseRecorder := httptest.NewRecorder()
-		nextFunction(responseRecorder, request, params)
-		// log.Printf("Response %s", dumpResponse(responseRecorder))
+		// record the beginning of the request body while it is consumed by the handler
+		requestBody := &prefixBuffer{limit: maxDumpedBodySize}
+		if request.Body != nil {
+			request.Body = &recordingReadCloser{ReadCloser: request.Body, recorder: requestBody}
+		}
+
+		// wrap response writer and delegate request to the given handle
+		responseWriter := &recordingResponseWriter{ResponseWriter: writer, statusCode: http.StatusOK}
+		responseWriter.body.limit = maxDumpedBodySize
+		nextFunction(responseWriter, request, params)
+		latency := time.Since(start)
+		observeRequest(request, params, responseWriter.statusCode, latency)
 
 		// log responses with status code 500 ("internal server error")
-		if responseRecorder.Code == http.StatusInternalServerError {
-			log.Printf("Request %s", dumpedRequest)
-			log.Printf("Response %s", dumpResponse(responseRecorder))
+		if responseWriter.statusCode == http.StatusInternalServerError {
+			log.Printf("Request %s", dumpRequest(request, requestBody))
+			log.Printf("Response %s", dumpResponse(responseWriter, latency))
 		}
+	}
+}
+
+// maximum number of body bytes dumped in case of an internal server error
+const maxDumpedBodySize = 4096
+
+/*
+prefixBuffer keeps the first bytes written to it and counts (but discards) the rest.
+*/
+type prefixBuffer struct {
+	limit int
+	data  []byte
+	total int64
+}
 
-		// copy everything from response recorder to actual response writer
-		for key, value := range responseRecorder.HeaderMap {
-			writer.Header()[key] = value
+/*
+Write implements the io.Writer interface (all data is accepted, only the prefix is kept).
+*/
+func (buffer *prefixBuffer) Write(data []byte) (int, error) {
+	buffer.total += int64(len(data))
+	if remaining := buffer.limit - len(buffer.data); remaining > 0 {
+		prefix := data
+		if len(prefix) > remaining {
+			prefix = prefix[:remaining]
 		}
-		writer.WriteHeader(responseRecorder.Code)
-		responseRecorder.Body.WriteTo(writer)
+		buffer.data = append(buffer.data, prefix...)
+	}
+	return len(data), nil
+}
+
+/*
+String returns the recorded bytes (with a hint if the data was truncated).
+*/
+func (buffer *prefixBuffer) String() string {
+	if buffer.total > int64(len(buffer.data)) {
+		return fmt.Sprintf("%s\n<truncated, %d of %d bytes shown>", buffer.data, len(buffer.data), buffer.total)
+	}
+	return string(buffer.data)
+}
+
+/*
+recordingReadCloser records the data read from the wrapped reader.
+*/
+type recordingReadCloser struct {
+	io.ReadCloser
+	recorder *prefixBuffer
+}
+
+/*
+Read implements the io.Reader interface.
+*/
+func (reader *recordingReadCloser) Read(data []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(data)
+	if n > 0 {
+		reader.recorder.Write(data[:n])
+	}
+	return n, err
+}
+
+/*
+recordingResponseWriter passes the response through and captures status code and size.
+*/
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        prefixBuffer
+}
+
+/*
+WriteHeader implements the http.ResponseWriter interface.
+*/
+func (writer *recordingResponseWriter) WriteHeader(statusCode int) {
+	if !writer.wroteHeader {
+		writer.statusCode = statusCode
+		writer.wroteHeader = true
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+/*
+Write implements the http.ResponseWriter interface.
+*/
+func (writer *recordingResponseWriter) Write(data []byte) (int, error) {
+	writer.wroteHeader = true
+	n, err := writer.ResponseWriter.Write(data)
+	writer.body.Write(data[:n])
+	return n, err
+}
+
+/*
+ReadFrom implements the io.ReaderFrom interface (keeps sendfile for file downloads).
+The data copied this way is counted but not recorded.
+*/
+func (writer *recordingResponseWriter) ReadFrom(reader io.Reader) (int64, error) {
+	writer.wroteHeader = true
+	var n int64
+	var err error
+	if readerFrom, ok := writer.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(reader)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{writer.ResponseWriter}, reader)
+	}
+	writer.body.total += n
+	return n, err
+}
+
+/*
+Flush implements the http.Flusher interface (required for streamed responses).
+*/
+func (writer *recordingResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		writer.wroteHeader = true
+		flusher.Flush()
 	}
 }
 
 /*
-dumpRequest dumps a http request.
+dumpRequest dumps a http request (header and recorded beginning of body).
 */
-func dumpRequest(request *http.Request) string {
-	dump, err := httputil.DumpRequest(request, true)
+func dumpRequest(request *http.Request, body *prefixBuffer) string {
+	dump, err := httputil.DumpRequest(request, false)
 	if err != nil {
 		return fmt.Sprintf("error <%v> at httputil.DumpRequest()", err)
 	}
-	return string(dump)
+	return string(dump) + body.String()
 }
 
 /*
 dumpResponse dumps a (recorded) http response.
 */
-func dumpResponse(responseRecorder *httptest.ResponseRecorder) string {
-	dump := fmt.Sprintf("%v (%s)\n", responseRecorder.Code, http.StatusText(responseRecorder.Code))
-	for key, value := range responseRecorder.HeaderMap {
+func dumpResponse(writer *recordingResponseWriter, latency time.Duration) string {
+	dump := fmt.Sprintf("%v (%s), %d bytes, %v\n", writer.statusCode, http.StatusText(writer.statusCode), writer.body.total, latency)
+	for key, value := range writer.Header() {
 		dump += fmt.Sprintf("%s %s\n", key, value)
 	}
-	dump += fmt.Sprintf("\n%s", responseRecorder.Body.String())
+	dump += fmt.Sprintf("\n%s", writer.body.String())
 	return dump
 }
 
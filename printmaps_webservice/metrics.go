@@ -0,0 +1,71 @@
+// Metrics (Prometheus text exposition format)
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// webservice metrics
+var (
+	metricsRequests = pd.NewCounter("printmaps_webservice_http_requests_total",
+		"Number of http requests by route, method and status code.", "route", "method", "status")
+	metricsRequestDuration = pd.NewHistogram("printmaps_webservice_http_request_duration_seconds",
+		"Latency of http requests by route and method.", pd.DurationBuckets, "route", "method")
+	metricsUploads = pd.NewCounter("printmaps_webservice_uploads_total",
+		"Number of user file uploads by result (accepted, rejected).", "result")
+	metricsUploadBytes = pd.NewCounter("printmaps_webservice_upload_bytes_total",
+		"Volume of accepted user file uploads in bytes.")
+	_ = pd.NewGaugeFunc("printmaps_webservice_build_orders_queued",
+		"Number of build orders waiting in the orders directory.", queuedBuildOrders)
+)
+
+/*
+observeRequest records the metrics of a finished http request.
+*/
+func observeRequest(request *http.Request, params httprouter.Params, statusCode int, latency time.Duration) {
+	route := routeLabel(request.URL.Path, params)
+	metricsRequests.Inc(route, request.Method, strconv.Itoa(statusCode))
+	metricsRequestDuration.Observe(latency.Seconds(), route, request.Method)
+}
+
+/*
+routeLabel derives the route (e.g. /api/beta2/maps/mapstate/:id) from the request path
+by replacing the parameter values with the parameter names (keeps the number of label values small).
+*/
+func routeLabel(path string, params httprouter.Params) string {
+	segments := strings.Split(path, "/")
+	for index, segment := range segments {
+		for _, param := range params {
+			if segment != "" && segment == param.Value {
+				segments[index] = ":" + param.Key
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+/*
+queuedBuildOrders returns the number of build orders waiting in the orders directory.
+*/
+func queuedBuildOrders() float64 {
+	count, err := pd.CountBuildOrders()
+	if err != nil {
+		return -1
+	}
+	return float64(count)
+}
+
+/*
+revealMetrics reveals the metrics of this service.
+*/
+func revealMetrics(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	pd.ServeMetrics(writer, request)
+}
@@ -0,0 +1,210 @@
+// OpenAPI description of this service
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// apiOperation describes a single operation (method + path) of the api
+type apiOperation struct {
+	method         string
+	path           string // OpenAPI notation ({id} instead of :id)
+	summary        string
+	requestSchema  string // name of the component schema of the request body (JSON:API)
+	status         int    // status code of the successful response
+	responseSchema string // name of the component schema of the response body
+	mediaType      string // media type of the response body (default: JSON:API)
+}
+
+// all operations of the api (keep in sync with the router)
+var apiOperations = []apiOperation{
+	{"get", "/api/beta2/maps", "list maps (api key required, own maps only except for admins; query: filter[style], filter[state], filter[owner], filter[createdafter], filter[createdbefore], sort, page[number], page[size])", "", 200, "PrintmapsList", ""},
+	{"post", "/api/beta2/maps/metadata", "create meta data (new map)", "PrintmapsData", 201, "PrintmapsData", ""},
+	{"patch", "/api/beta2/maps/metadata", "update meta data (JSON:API document: full replacement, JSON Merge Patch: partial)", "PrintmapsData", 200, "PrintmapsData", ""},
+	{"post", "/api/beta2/maps/metadata/patch", "update meta data (post-as-patch)", "PrintmapsData", 200, "PrintmapsData", ""},
+	{"patch", "/api/beta2/maps/metadata/{id}", "update meta data (partial: JSON Merge Patch or JSON Patch)", "", 200, "PrintmapsData", ""},
+	{"post", "/api/beta2/maps/metadata/patch/{id}", "update meta data (post-as-patch)", "", 200, "PrintmapsData", ""},
+	{"get", "/api/beta2/maps/metadata/{id}", "fetch meta data", "", 200, "PrintmapsData", ""},
+	{"get", "/api/beta2/maps/mapstate/{id}", "fetch map state", "", 200, "PrintmapsState", ""},
+	{"get", "/api/beta2/maps/mapstate/{id}/events", "subscribe to map state events (server-sent events, data = PrintmapsState)", "", 200, "", "text/event-stream"},
+	{"post", "/api/beta2/maps/mapfile", "order map build", "PrintmapsData", 202, "PrintmapsData", ""},
+	{"get", "/api/beta2/maps/mapfile/{id}", "download map (resumable, conditional)", "", 200, "", "application/zip"},
+	{"head", "/api/beta2/maps/mapfile/{id}", "map file information", "", 200, "", "application/zip"},
+	{"get", "/api/beta2/maps/uidata/{id}", "fetch ui data", "", 200, "", "application/json"},
+	{"post", "/api/beta2/maps/clone/{id}", "clone map incl. user files (optional overrides: JSON:API document, JSON Merge Patch or JSON Patch)", "", 201, "PrintmapsData", ""},
+	{"get", "/api/beta2/maps/revisions/{id}", "fetch revision history of the meta data (owner or admin only, client ip reported to admins)", "", 200, "PrintmapsRevisions", ""},
+	{"get", "/api/beta2/maps/revisions/{id}/diff", "differences between two revisions (owner or admin only; query: from, to)", "", 200, "PrintmapsRevisionDiff", ""},
+	{"post", "/api/beta2/maps/revisions/{id}/rollback", "restore revision as current meta data (query: revision)", "", 200, "PrintmapsData", ""},
+	{"get", "/api/beta2/maps/callbacks/{id}", "fetch callback delivery attempts", "", 200, "PrintmapsCallbacks", ""},
+	{"delete", "/api/beta2/maps/{id}", "delete map", "", 204, "", ""},
+	{"post", "/api/beta2/maps/delete/{id}", "delete map (post-as-delete)", "", 204, "", ""},
+	{"delete", "/api/beta2/maps/{id}/mapfile", "cancel map build (200: waiting order removed, 202: running build signaled)", "", 200, "PrintmapsState", ""},
+	{"post", "/api/beta2/maps/mapfile/delete/{id}", "cancel map build (post-as-delete)", "", 200, "PrintmapsState", ""},
+	{"get", "/api/beta2/maps/capabilities/service", "fetch service capabilities", "", 200, "PrintmapsFeature", "application/json"},
+	{"get", "/api/beta2/maps/capabilities/mapdata", "fetch map data capabilities (polygon)", "", 200, "", "application/json"},
+	{"post", "/api/beta2/maps/upload/{id}", "upload user file or zip archive (multipart/form-data, field 'file'), archives are extracted", "", 201, "", "text/plain"},
+	{"post", "/api/beta2/maps/uploads/{id}", "start resumable upload of user file (name, size, checksum)", "PrintmapsUpload", 201, "PrintmapsUpload", ""},
+	{"get", "/api/beta2/maps/uploads/{id}/{upload}", "fetch state of resumable upload (offset)", "", 200, "PrintmapsUpload", ""},
+	{"head", "/api/beta2/maps/uploads/{id}/{upload}", "offset of resumable upload (Upload-Offset)", "", 200, "", ""},
+	{"put", "/api/beta2/maps/uploads/{id}/{upload}", "send chunk (Content-Range, application/octet-stream), 201 after the last chunk", "", 200, "PrintmapsUpload", ""},
+	{"post", "/api/beta2/maps/uploads/{id}/{upload}", "send chunk (post-as-put)", "", 200, "PrintmapsUpload", ""},
+	{"delete", "/api/beta2/maps/{id}/uploads/{upload}", "cancel resumable upload", "", 204, "", ""},
+	{"get", "/api/beta2/maps/files/{id}", "list user files (name, size, checksum, type, upload time)", "", 200, "PrintmapsUserFiles", ""},
+	{"get", "/api/beta2/maps/files/{id}/{name}", "download user file", "", 200, "", "application/octet-stream"},
+	{"head", "/api/beta2/maps/files/{id}/{name}", "user file information", "", 200, "", "application/octet-stream"},
+	{"put", "/api/beta2/maps/files/{id}/{name}", "replace user file atomically (multipart/form-data, field 'file')", "", 200, "", "text/plain"},
+	{"post", "/api/beta2/maps/files/replace/{id}/{name}", "replace user file (post-as-put)", "", 200, "", "text/plain"},
+	{"delete", "/api/beta2/maps/{id}/files/{name}", "delete user file", "", 204, "", ""},
+	{"post", "/api/beta2/maps/files/delete/{id}/{name}", "delete user file (post-as-delete)", "", 204, "", ""},
+	{"get", "/api/beta2/maps/admin/limits", "fetch rate limit and quota counters (admin)", "", 200, "LimitsReport", "application/json"},
+	{"get", "/api/beta2/openapi.json", "fetch this api description", "", 200, "", "application/json"},
+	{"get", "/metrics", "fetch metrics (prometheus text format)", "", 200, "", "text/plain"},
+	{"get", "/healthz", "liveness report", "", 200, "HealthReport", "application/json"},
+	{"get", "/readyz", "readiness report", "", 200, "HealthReport", "application/json"},
+}
+
+// schemas of the data structures (generated)
+var apiSchemas = map[string]*pd.Schema{
+	"PrintmapsData":         pd.SchemaOf(reflect.TypeOf(pd.PrintmapsData{})),
+	"PrintmapsState":        pd.SchemaOf(reflect.TypeOf(pd.PrintmapsState{})),
+	"PrintmapsList":         pd.SchemaOf(reflect.TypeOf(pd.PrintmapsList{})),
+	"PrintmapsCallbacks":    pd.SchemaOf(reflect.TypeOf(pd.PrintmapsCallbacks{})),
+	"PrintmapsUserFiles":    pd.SchemaOf(reflect.TypeOf(pd.PrintmapsUserFiles{})),
+	"PrintmapsUpload":       pd.SchemaOf(reflect.TypeOf(pd.PrintmapsUpload{})),
+	"PrintmapsRevisions":    pd.SchemaOf(reflect.TypeOf(pd.PrintmapsRevisions{})),
+	"PrintmapsRevisionDiff": pd.SchemaOf(reflect.TypeOf(pd.PrintmapsRevisionDiff{})),
+	"PrintmapsErrorList":    pd.SchemaOf(reflect.TypeOf(pd.PrintmapsErrorList{})),
+	"PrintmapsFeature":      pd.SchemaOf(reflect.TypeOf(PrintmapsFeature{})),
+	"LimitsReport":          pd.SchemaOf(reflect.TypeOf(LimitsReport{})),
+	"HealthReport":          pd.SchemaOf(reflect.TypeOf(pd.HealthReport{})),
+}
+
+/*
+buildOpenAPIDocument builds the OpenAPI (3.0) description of this service.
+*/
+func buildOpenAPIDocument() map[string]interface{} {
+	paths := make(map[string]interface{})
+
+	for _, operation := range apiOperations {
+		pathItem, found := paths[operation.path].(map[string]interface{})
+		if !found {
+			pathItem = make(map[string]interface{})
+			paths[operation.path] = pathItem
+		}
+
+		mediaType := operation.mediaType
+		if mediaType == "" {
+			mediaType = "application/vnd.api+json"
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(operation.status)}
+		if operation.status != http.StatusNoContent && operation.method != "head" {
+			content := map[string]interface{}{}
+			if operation.responseSchema != "" {
+				content["schema"] = map[string]string{"$ref": "#/components/schemas/" + operation.responseSchema}
+			}
+			success["content"] = map[string]interface{}{mediaType: content}
+		}
+
+		operationObject := map[string]interface{}{
+			"summary": operation.summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(operation.status): success,
+				"default": map[string]interface{}{
+					"description": "error list",
+					"content": map[string]interface{}{
+						"application/vnd.api+json": map[string]interface{}{
+							"schema": map[string]string{"$ref": "#/components/schemas/PrintmapsErrorList"},
+						},
+					},
+				},
+			},
+		}
+
+		var parameters []map[string]interface{}
+		if strings.Contains(operation.path, "{id}") {
+			parameters = append(parameters, map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]string{"type": "string", "format": "uuid"}})
+		}
+		if strings.Contains(operation.path, "{name}") {
+			parameters = append(parameters, map[string]interface{}{"name": "name", "in": "path", "required": true, "schema": map[string]string{"type": "string"}})
+		}
+		if strings.Contains(operation.path, "{upload}") {
+			parameters = append(parameters, map[string]interface{}{"name": "upload", "in": "path", "required": true, "schema": map[string]string{"type": "string", "format": "uuid"}})
+		}
+		if len(parameters) > 0 {
+			operationObject["parameters"] = parameters
+		}
+
+		if operation.requestSchema != "" {
+			operationObject["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/vnd.api+json": map[string]interface{}{
+						"schema": map[string]string{"$ref": "#/components/schemas/" + operation.requestSchema},
+					},
+				},
+			}
+		}
+
+		if isAuthEnabled() {
+			operationObject["security"] = []map[string][]string{{"apiKey": {}}, {}}
+		}
+
+		pathItem[operation.method] = operationObject
+	}
+
+	components := map[string]interface{}{"schemas": apiSchemas}
+	if isAuthEnabled() {
+		components["securitySchemes"] = map[string]interface{}{
+			"apiKey": map[string]string{"type": "http", "scheme": "bearer"},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       progPurpose,
+			"description": progInfo,
+			"version":     progVersion,
+		},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+/*
+revealOpenAPI reveals the OpenAPI description of this service.
+*/
+func revealOpenAPI(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	content, err := json.MarshalIndent(buildOpenAPIDocument(), pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(content)
+}
+
+/*
+verifyBody validates the request body against the schema (reports unknown attributes and type mismatches).
+*/
+func verifyBody(body []byte, schemaName string, pmErrorList *pd.PrintmapsErrorList, mapID string) {
+	for _, violation := range pd.ValidateJSON(body, apiSchemas[schemaName]) {
+		appendError(pmErrorList, "2003", violation.Pointer+": "+violation.Message, mapID)
+	}
+}
@@ -0,0 +1,227 @@
+// Preflight check of a map before the build order
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// gpxLayers are the layers of a gpx file (ogr driver)
+var gpxLayers = []string{"waypoints", "routes", "tracks", "route_points", "track_points"}
+
+// regular expressions for preflight checks
+var (
+	markerReference = regexp.MustCompile(`file\s*=\s*(?:'([^']*)'|"([^"]*)")`)
+	srsCode         = regexp.MustCompile(`^(?i:epsg):[0-9]+$`)
+	srsParameter    = regexp.MustCompile(`^\+([a-zA-Z_][a-zA-Z0-9_]*)(?:=(\S+))?$`)
+	srsInit         = regexp.MustCompile(`^[a-zA-Z0-9_]+:[a-zA-Z0-9_]+$`)
+	srsName         = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+/*
+verifyPreflight verifies that all elements referenced by the map (user files, layers, spatial reference systems,
+hidden style layers, markers) exist. Each problem is reported as separate error.
+*/
+func verifyPreflight(pmData pd.PrintmapsData, pmErrorList *pd.PrintmapsErrorList) error {
+	id := pmData.Data.ID
+	attributes := pmData.Data.Attributes
+
+	files, err := pd.ListUserFiles(id)
+	if err != nil {
+		return err
+	}
+	userFiles := make(map[string]bool)
+	for _, file := range files {
+		userFiles[file.Name()] = true
+	}
+
+	for index, userObject := range attributes.UserObjects {
+		object := fmt.Sprintf("UserObjects[%d]", index)
+		if userObject.WellKnownText == "" {
+			// data object
+			verifyDataSource(object, userObject, userFiles, pmErrorList, id)
+			if err := parseSRS(userObject.SRS); err != nil {
+				appendError(pmErrorList, "5004", fmt.Sprintf("%s: SRS <%s> %v", object, userObject.SRS, err), id)
+			}
+		}
+		for _, marker := range markerReferences(userObject.Style) {
+			if reason := verifyMarker(marker, userFiles); reason != "" {
+				appendError(pmErrorList, "5006", fmt.Sprintf("%s: marker <%s> %s", object, marker, reason), id)
+			}
+		}
+	}
+
+	// the build service accepts the same values only (meta data stored by former releases)
+	if !pd.IsValidProjection(attributes.Projection) {
+		appendError(pmErrorList, "3014", fmt.Sprintf("projection <%s> must be an integer (EPSG code, max 6 digits)", attributes.Projection), id)
+	}
+	if !pd.IsValidHideLayers(attributes.HideLayers) {
+		appendError(pmErrorList, "3017", fmt.Sprintf("layers to hide <%s>: comma separated layer names without spaces", attributes.HideLayers), id)
+	} else if attributes.HideLayers != "" {
+		styleLayers := make(map[string]bool)
+		for _, style := range pmFeature.ConfigStyles {
+			if style.Name == attributes.Style {
+				for _, layer := range strings.Split(style.Layers, ",") {
+					styleLayers[strings.TrimSpace(layer)] = true
+				}
+			}
+		}
+		for _, layer := range strings.Split(attributes.HideLayers, ",") {
+			if !styleLayers[layer] {
+				appendError(pmErrorList, "5005", fmt.Sprintf("layer <%s> not part of style <%s>", layer, attributes.Style), id)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+verifyDataSource verifies the data source (type, file, layer) of a user data object.
+*/
+func verifyDataSource(object string, userObject pd.UserObject, userFiles map[string]bool, pmErrorList *pd.PrintmapsErrorList, id string) {
+	if !containsString(pd.DataSourceTypes, userObject.Type) {
+		message := fmt.Sprintf("%s: type <%s> not supported (allowed: %s)", object, userObject.Type, strings.Join(pd.DataSourceTypes, ", "))
+		appendError(pmErrorList, "5007", message, id)
+		return
+	}
+
+	file := userObject.File
+	if file == "" {
+		appendError(pmErrorList, "5002", object+": file missing", id)
+		return
+	}
+	// mapnik completes the name of shapefiles
+	if userObject.Type == "shape" && filepath.Ext(file) == "" {
+		file += ".shp"
+	}
+	if !isValidUserFileName(file) || !userFiles[file] {
+		appendError(pmErrorList, "5002", fmt.Sprintf("%s: file <%s> not uploaded", object, file), id)
+		return
+	}
+
+	extension := strings.ToLower(filepath.Ext(file))
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	if extension == ".shp" {
+		for _, part := range []string{".shx", ".dbf"} {
+			if !userFiles[base+part] && !userFiles[base+strings.ToUpper(part)] {
+				appendError(pmErrorList, "5002", fmt.Sprintf("%s: file <%s> of shapefile not uploaded", object, base+part), id)
+			}
+		}
+	}
+
+	if userObject.Type != "ogr" {
+		return
+	}
+	if userObject.Layer == "" {
+		appendError(pmErrorList, "5003", object+": layer missing (required for type ogr)", id)
+		return
+	}
+
+	// layers of the file (ogr driver)
+	var layers []string
+	switch extension {
+	case ".gpx":
+		layers = gpxLayers
+	case ".shp", ".csv":
+		layers = []string{base}
+	case ".geojson", ".json":
+		layers = []string{base, "OGRGeoJSON"}
+	default:
+		// layers defined by the content (e.g. kml folders)
+		return
+	}
+	if !containsString(layers, userObject.Layer) {
+		message := fmt.Sprintf("%s: layer <%s> not found in <%s> (available: %s)", object, userObject.Layer, file, strings.Join(layers, ", "))
+		appendError(pmErrorList, "5003", message, id)
+	}
+}
+
+/*
+parseSRS parses a spatial reference system (proj.4 definition, e.g. '+init=epsg:4326', or 'epsg:4326').
+*/
+func parseSRS(srs string) error {
+	srs = strings.TrimSpace(srs)
+	if srs == "" {
+		return fmt.Errorf("missing")
+	}
+	if srsCode.MatchString(srs) {
+		return nil
+	}
+
+	defined := false
+	for _, parameter := range strings.Fields(srs) {
+		elements := srsParameter.FindStringSubmatch(parameter)
+		if elements == nil {
+			return fmt.Errorf("invalid parameter '%s'", parameter)
+		}
+		switch elements[1] {
+		case "init":
+			if !srsInit.MatchString(elements[2]) {
+				return fmt.Errorf("invalid init '%s'", elements[2])
+			}
+			defined = true
+		case "proj":
+			if !srsName.MatchString(elements[2]) {
+				return fmt.Errorf("invalid projection '%s'", elements[2])
+			}
+			defined = true
+		}
+	}
+	if !defined {
+		return fmt.Errorf("neither +proj nor +init defined")
+	}
+	return nil
+}
+
+/*
+markerReferences returns the files referenced by a style (e.g. file='MyPin.svg').
+*/
+func markerReferences(style string) []string {
+	var markers []string
+	for _, match := range markerReference.FindAllStringSubmatch(style, -1) {
+		markers = append(markers, match[1]+match[2])
+	}
+	return markers
+}
+
+/*
+verifyMarker verifies that a marker exists (predefined marker or user file), returns the reason if not.
+*/
+func verifyMarker(marker string, userFiles map[string]bool) string {
+	if marker == "" || marker != filepath.Base(marker) {
+		return "invalid (plain file name expected)"
+	}
+	if strings.HasPrefix(marker, "Printmaps") {
+		// predefined marker (verifiable if the markers directory is configured)
+		if config.Markersdir == "" {
+			return ""
+		}
+		if _, err := os.Stat(filepath.Join(config.Markersdir, marker)); err != nil {
+			return "not a predefined marker"
+		}
+		return ""
+	}
+	if !userFiles[marker] {
+		return "not uploaded"
+	}
+	return ""
+}
+
+/*
+containsString checks if a list contains the string.
+*/
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
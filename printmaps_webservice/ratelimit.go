@@ -0,0 +1,413 @@
+// Rate limits (token buckets) and daily build quotas
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// ConfigRateLimit describes a token bucket (rate = requests per minute, burst = bucket size)
+type ConfigRateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ConfigRateLimits describes the rate limits for all limited actions (rate 0 = unlimited)
+type ConfigRateLimits struct {
+	Create ConfigRateLimit
+	Upload ConfigRateLimit
+	Order  ConfigRateLimit
+}
+
+// ConfigQuotas describes the daily build quotas per client (0 = unlimited)
+type ConfigQuotas struct {
+	Ordersperday int     // number of build orders per day
+	Areaperday   float64 // sum of map areas (in square kilometers) per day
+}
+
+// tokenBucket represents the rate limit state of a single client and action
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// clientUsage represents the daily quota usage of a single client
+type clientUsage struct {
+	Orders int
+	Area   float64
+}
+
+// quotaUsages represents the daily quota usage of all clients (persisted in the working directory)
+type quotaUsages struct {
+	Day    string
+	Usages map[string]*clientUsage // key = client
+}
+
+// limiter holds the state of all rate limits and quotas
+type limiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket // key = action + " " + client
+	quota   quotaUsages
+}
+
+// file holding the daily quota usages (relative to the working directory, survives a restart)
+const fileQuotaUsages = "quotas.json"
+
+// maximum number of buckets before full buckets are purged
+const maxTokenBuckets = 10000
+
+var pmLimiter = limiter{
+	buckets: make(map[string]*tokenBucket),
+	quota:   quotaUsages{Usages: make(map[string]*clientUsage)},
+}
+
+// LimitsReport is used to report the current rate limit and quota counters (admin response object)
+type LimitsReport struct {
+	Date         string
+	RateLimits   map[string]ConfigRateLimits
+	Quotas       ConfigQuotas
+	TokenBuckets []LimitsBucket
+	Usages       []LimitsUsage
+}
+
+// LimitsBucket describes the current state of a token bucket
+type LimitsBucket struct {
+	Action string
+	Client string
+	Tokens float64
+}
+
+// LimitsUsage describes the current daily quota usage of a client
+type LimitsUsage struct {
+	Client string
+	Orders int
+	Area   float64
+}
+
+/*
+requestClient identifies the client of a request (owner of a valid api key or ip address)
+and returns the rate limits applicable to the client.
+*/
+func requestClient(request *http.Request) (string, ConfigRateLimits) {
+	if key := requestAPIKey(request); key != "" {
+		if apiKey, found := lookupAPIKey(key); found {
+			return "key:" + apiKey.Owner, config.Ratelimitsapikey
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "ip:" + host, config.Ratelimitsip
+}
+
+/*
+allow takes a token from the bucket of the client and action. If the bucket is empty,
+the request is rejected and the duration until the next token is available is returned.
+*/
+func (l *limiter) allow(action string, client string, rateLimit ConfigRateLimit) (bool, time.Duration) {
+	if rateLimit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(rateLimit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	ratePerSecond := rateLimit.Rate / 60.0
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > maxTokenBuckets {
+		l.purgeBuckets(now)
+	}
+
+	key := action + " " + client
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	// refill bucket
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*ratePerSecond)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / ratePerSecond * float64(time.Second))
+	return false, wait
+}
+
+/*
+purgeBuckets removes all buckets which have been idle for a long time (and are therefore full).
+*/
+func (l *limiter) purgeBuckets(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+/*
+purgeUsages removes the quota usages of the previous days (the counters are reset at midnight).
+*/
+func (l *limiter) purgeUsages(today string) {
+	if l.quota.Day != today {
+		l.quota.Day = today
+		l.quota.Usages = make(map[string]*clientUsage)
+	}
+}
+
+/*
+reserveBuildQuota books a build order with the given map area (square kilometers) on the
+daily quota of the client. If the quota is exhausted, the duration until midnight is returned.
+*/
+func (l *limiter) reserveBuildQuota(client string, area float64) (bool, string, time.Duration) {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.purgeUsages(now.Format("2006-01-02"))
+	usage, found := l.quota.Usages[client]
+	if !found {
+		usage = &clientUsage{}
+		l.quota.Usages[client] = usage
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	if config.Quotas.Ordersperday > 0 && usage.Orders+1 > config.Quotas.Ordersperday {
+		return false, fmt.Sprintf("max build orders per day = %d", config.Quotas.Ordersperday), midnight.Sub(now)
+	}
+	if config.Quotas.Areaperday > 0 && usage.Area+area > config.Quotas.Areaperday {
+		message := fmt.Sprintf("max map area per day = %.1f km², already used = %.1f km², requested = %.1f km²", config.Quotas.Areaperday, usage.Area, area)
+		return false, message, midnight.Sub(now)
+	}
+
+	usage.Orders++
+	usage.Area += area
+	l.saveUsages()
+	return true, "", 0
+}
+
+/*
+refundBuildQuota gives back a booked build order (order could not be created).
+*/
+func (l *limiter) refundBuildQuota(client string, area float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.purgeUsages(time.Now().Format("2006-01-02"))
+	usage, found := l.quota.Usages[client]
+	if !found {
+		// booked on the previous day
+		return
+	}
+	usage.Orders = int(math.Max(0, float64(usage.Orders-1)))
+	usage.Area = math.Max(0, usage.Area-area)
+	l.saveUsages()
+}
+
+/*
+saveUsages writes the daily quota usages into the working directory (atomic, called with locked mutex).
+*/
+func (l *limiter) saveUsages() {
+	data, err := json.MarshalIndent(l.quota, pd.IndentPrefix, pd.IndexString)
+	if err != nil {
+		log.Printf("error <%v> at json.MarshalIndent()", err)
+		return
+	}
+
+	file := filepath.Join(pd.PathWorkdir, fileQuotaUsages)
+	if err := ioutil.WriteFile(file+".tmp", data, 0666); err != nil {
+		log.Printf("error <%v> at ioutil.WriteFile(), file = <%s>", err, file+".tmp")
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Printf("error <%v> at os.Rename(), file = <%s>", err, file)
+	}
+}
+
+/*
+loadUsages reads the daily quota usages (saved before a restart) from the working directory.
+*/
+func (l *limiter) loadUsages() error {
+	data, err := ioutil.ReadFile(filepath.Join(pd.PathWorkdir, fileQuotaUsages))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	quota := quotaUsages{}
+	if err := json.Unmarshal(data, &quota); err != nil {
+		return err
+	}
+	if quota.Usages == nil {
+		quota.Usages = make(map[string]*clientUsage)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.quota = quota
+	l.purgeUsages(time.Now().Format("2006-01-02"))
+	return nil
+}
+
+/*
+report creates a snapshot of all counters.
+*/
+func (l *limiter) report() LimitsReport {
+	var limitsReport LimitsReport
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limitsReport.Date = time.Now().Format(time.RFC3339)
+	limitsReport.RateLimits = map[string]ConfigRateLimits{"ip": config.Ratelimitsip, "apikey": config.Ratelimitsapikey}
+	limitsReport.Quotas = config.Quotas
+
+	l.purgeUsages(time.Now().Format("2006-01-02"))
+	for key, bucket := range l.buckets {
+		entries := strings.SplitN(key, " ", 2)
+		limitsReport.TokenBuckets = append(limitsReport.TokenBuckets, LimitsBucket{Action: entries[0], Client: entries[1], Tokens: bucket.tokens})
+	}
+	for client, usage := range l.quota.Usages {
+		limitsReport.Usages = append(limitsReport.Usages, LimitsUsage{Client: client, Orders: usage.Orders, Area: usage.Area})
+	}
+
+	sort.Slice(limitsReport.TokenBuckets, func(i, j int) bool {
+		return limitsReport.TokenBuckets[i].Client+limitsReport.TokenBuckets[i].Action < limitsReport.TokenBuckets[j].Client+limitsReport.TokenBuckets[j].Action
+	})
+	sort.Slice(limitsReport.Usages, func(i, j int) bool { return limitsReport.Usages[i].Client < limitsReport.Usages[j].Client })
+
+	return limitsReport
+}
+
+/*
+mapArea calculates the area (in square kilometers) covered by the map.
+*/
+func mapArea(pmData pd.PrintmapsData) float64 {
+	scale := float64(pmData.Data.Attributes.Scale)
+	width := pmData.Data.Attributes.PrintWidth * scale / 1000000.0
+	height := pmData.Data.Attributes.PrintHeight * scale / 1000000.0
+	return width * height
+}
+
+/*
+setRetryAfter sets the http header field "Retry-After" (in seconds, rounded up).
+*/
+func setRetryAfter(writer http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+/*
+rateLimitHandler is a wrapper to rate limit the given action (per client).
+*/
+func rateLimitHandler(action string, nextFunction httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var pmErrorList pd.PrintmapsErrorList
+
+		client, rateLimits := requestClient(request)
+		rateLimit := rateLimits.Create
+		switch action {
+		case "upload":
+			rateLimit = rateLimits.Upload
+		case "order":
+			rateLimit = rateLimits.Order
+		}
+
+		allowed, wait := pmLimiter.allow(action, client, rateLimit)
+		if allowed {
+			nextFunction(writer, request, params)
+			return
+		}
+
+		log.Printf("rate limit for action <%s> exceeded, client = <%s>", action, client)
+		message := fmt.Sprintf("max %s requests = %.1f per minute (burst %d)", action, rateLimit.Rate, rateLimit.Burst)
+		appendError(&pmErrorList, "9001", message, params.ByName("id"))
+
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		setRetryAfter(writer, wait)
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+revealLimits reveals the current rate limit and quota counters (admin api key required).
+*/
+func revealLimits(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+
+	apiKey := verifyAPIKey(request, &pmErrorList, "")
+	if len(pmErrorList.Errors) == 0 && !apiKey.Admin {
+		appendError(&pmErrorList, "8004", "admin api key required", "")
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		content, err := json.MarshalIndent(pmLimiter.report(), pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
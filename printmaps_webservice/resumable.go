@@ -0,0 +1,644 @@
+// Resumable (chunked) upload handlers
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/printmaps/printmaps/pd"
+)
+
+// unfinished uploads are discarded after this period of inactivity
+const uploadExpiration = 24 * time.Hour
+
+// interval of the removal of expired uploads (all maps)
+const uploadSweepInterval = time.Hour
+
+// locks serializing the chunks of an upload (key = upload ID)
+var uploadLocks lockStripes
+
+/*
+createUpload starts a chunked (resumable) upload of a user file (name, size, optional checksum).
+*/
+func createUpload(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmData pd.PrintmapsData
+	var pmUpload pd.PrintmapsUpload
+
+	verifyContentType(request, &pmErrorList)
+	verifyAccept(request, &pmErrorList)
+
+	id := params.ByName("id")
+
+	// verify ID
+	_, err := uuid.FromString(id)
+	if err != nil {
+		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
+	}
+
+	// map directory must exist
+	if len(pmErrorList.Errors) == 0 {
+		if !pd.IsExistMapDirectory(id) {
+			appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+		}
+	}
+
+	// process body
+	if len(pmErrorList.Errors) == 0 {
+		bodyBytes, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at ioutil.ReadAll()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		if err := json.Unmarshal(bodyBytes, &pmUpload); err != nil {
+			appendError(&pmErrorList, "2001", "error = "+err.Error(), id)
+		} else {
+			verifyBody(bodyBytes, "PrintmapsUpload", &pmErrorList, id)
+			verifyUploadSession(pmUpload, &pmErrorList, id)
+		}
+	}
+
+	// expired uploads don't count (the upload locks must not be taken within the metadata lock)
+	if len(pmErrorList.Errors) == 0 {
+		removeExpiredUploads(id)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	// reject early if the file will not fit
+	if len(pmErrorList.Errors) == 0 {
+		if err := verifyUploadCount(id, &pmErrorList); err != nil {
+			message := fmt.Sprintf("error <%v> at verifyUploadCount(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		if err := verifyStorageQuota(id, pmUpload.Data.Attributes.Name, pmUpload.Data.Attributes.Size, &pmErrorList); err != nil {
+			message := fmt.Sprintf("error <%v> at verifyStorageQuota(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		verifyDiskSpace(pmUpload.Data.Attributes.Size, &pmErrorList, id)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// request ok, response with (new) upload ID, persist upload state
+		universallyUniqueIdentifier, err := uuid.NewV4()
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at uuid.NewV4()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		now := time.Now()
+		pmUpload.Data.ID = universallyUniqueIdentifier.String()
+		pmUpload.Data.Attributes.MapID = id
+		pmUpload.Data.Attributes.Offset = 0
+		pmUpload.Data.Attributes.Created = now.Format(time.RFC3339)
+		pmUpload.Data.Attributes.Expires = now.Add(uploadExpiration).Format(time.RFC3339)
+
+		if err := pd.WriteUploadSession(pmUpload); err != nil {
+			message := fmt.Sprintf("error <%v> at pd.WriteUploadSession()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		content, err := json.MarshalIndent(pmUpload, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("Location", "/api/beta2/maps/uploads/"+id+"/"+pmUpload.Data.ID)
+		writer.Header().Set("Upload-Offset", "0")
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write(content)
+		log.Printf("createUpload(): upload %s of file <%s, %d bytes> started", pmUpload.Data.ID, pmUpload.Data.Attributes.Name, pmUpload.Data.Attributes.Size)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+fetchUpload reveals the state of a chunked upload (the offset is the resume position).
+*/
+func fetchUpload(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmUpload pd.PrintmapsUpload
+
+	id := params.ByName("id")
+	uploadID := params.ByName("upload")
+
+	if !readUploadSession(writer, &pmUpload, id, uploadID, &pmErrorList) {
+		return
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		content, err := json.MarshalIndent(pmUpload, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("Upload-Offset", strconv.FormatInt(pmUpload.Data.Attributes.Offset, 10))
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+writeUploadChunk appends a chunk (Content-Range: bytes start-end/size) to a chunked upload.
+The last chunk completes the upload: the file is verified (incl. checksum) and stored as user file.
+*/
+func writeUploadChunk(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmData pd.PrintmapsData
+	var pmUpload pd.PrintmapsUpload
+	var userFile pd.UserFile
+
+	id := params.ByName("id")
+	uploadID := params.ByName("upload")
+	completed := false
+
+	if !readUploadSession(writer, &pmUpload, id, uploadID, &pmErrorList) {
+		return
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	// the chunk must continue the upload
+	var start, end int64
+	if len(pmErrorList.Errors) == 0 {
+		var size int64
+		var err error
+		start, end, size, err = parseContentRange(request.Header.Get("Content-Range"))
+		if err != nil {
+			appendError(&pmErrorList, "7004", err.Error(), id)
+		} else if size != pmUpload.Data.Attributes.Size {
+			appendError(&pmErrorList, "7004", fmt.Sprintf("upload size = %d bytes", pmUpload.Data.Attributes.Size), id)
+		} else if start != pmUpload.Data.Attributes.Offset {
+			appendError(&pmErrorList, "7004", fmt.Sprintf("chunk must start at offset %d", pmUpload.Data.Attributes.Offset), id)
+		} else if request.ContentLength >= 0 && request.ContentLength != end-start+1 {
+			appendError(&pmErrorList, "7004", fmt.Sprintf("Content-Length %d doesn't match Content-Range", request.ContentLength), id)
+		} else {
+			verifyDiskSpace(end-start+1, &pmErrorList, id)
+		}
+	}
+
+	// the chunk is received without holding the lock of the upload (slow uploads must not block other uploads)
+	var chunkname string
+	if len(pmErrorList.Errors) == 0 {
+		path := filepath.Join(pd.PathWorkdir, pd.PathMaps, id)
+		out, err := ioutil.TempFile(path, ".upload-*")
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at ioutil.TempFile(), path = <%s>", err, path)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		chunkname = out.Name()
+		defer os.Remove(chunkname)
+		bytesWritten, err := io.CopyN(out, request.Body, end-start+1)
+		out.Close()
+		if err != nil {
+			if err != io.EOF {
+				message := fmt.Sprintf("error <%v> at io.CopyN(), file = <%s>", err, chunkname)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			appendError(&pmErrorList, "7004", fmt.Sprintf("incomplete chunk (%d of %d bytes)", bytesWritten, end-start+1), id)
+		}
+	}
+
+	// chunks of an upload must not interleave
+	if len(pmErrorList.Errors) == 0 {
+		unlockUpload := uploadLocks.lock(uploadID)
+		defer unlockUpload()
+
+		// current state (chunks received in the meantime by other requests)
+		if !readUploadSession(writer, &pmUpload, id, uploadID, &pmErrorList) {
+			return
+		}
+		if len(pmErrorList.Errors) == 0 && start != pmUpload.Data.Attributes.Offset {
+			appendError(&pmErrorList, "7004", fmt.Sprintf("chunk must start at offset %d", pmUpload.Data.Attributes.Offset), id)
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		// append chunk (all or nothing)
+		filename := pd.UploadDataFile(id, uploadID)
+		if err := appendUploadChunk(filename, chunkname); err != nil {
+			if errTruncate := os.Truncate(filename, start); errTruncate != nil && !os.IsNotExist(errTruncate) {
+				log.Printf("unexpected error <%s> os.Truncate(), file = <%s>", errTruncate, filename)
+			}
+			message := fmt.Sprintf("error <%v> at appendUploadChunk(), file = <%s>", err, filename)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		pmUpload.Data.Attributes.Offset = end + 1
+		pmUpload.Data.Attributes.Expires = time.Now().Add(uploadExpiration).Format(time.RFC3339)
+		completed = pmUpload.Data.Attributes.Offset == pmUpload.Data.Attributes.Size
+	}
+
+	if len(pmErrorList.Errors) == 0 && !completed {
+		if err := pd.WriteUploadSession(pmUpload); err != nil {
+			message := fmt.Sprintf("error <%v> at pd.WriteUploadSession()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 && completed {
+		// last chunk received, store user file (the meta data is modified)
+		unlock := lockMetadata(id)
+		defer unlock()
+
+		// current revision (modified in the meantime by other requests)
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		attributes := pmUpload.Data.Attributes
+		var err error
+		userFile, err = commitUserFile(pd.UploadDataFile(id, uploadID), id, attributes.Name, attributes.Checksum, &pmErrorList)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at commitUserFile(), id = <%s>", err, id)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		// the upload is finished (stored or rejected)
+		if err := pd.RemoveUploadSession(id, uploadID); err != nil {
+			log.Printf("unexpected error <%s> at pd.RemoveUploadSession(), upload = <%s>", err, uploadID)
+		}
+
+		if len(pmErrorList.Errors) == 0 {
+			pmData.Data.Attributes.UserFiles = nil
+			pmData.Data.Attributes.Revision++
+			if err := writeMetadata(request, pmData, "upload", "file "+userFile.Name); err != nil {
+				message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			metricsUploads.Inc("accepted")
+			metricsUploadBytes.Add(float64(userFile.Size))
+		} else {
+			metricsUploads.Inc("rejected")
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		content, err := json.MarshalIndent(pmUpload, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("Upload-Offset", strconv.FormatInt(pmUpload.Data.Attributes.Offset, 10))
+		if completed {
+			writer.Header().Set("ETag", metadataETag(pmData))
+			writer.WriteHeader(http.StatusCreated)
+			log.Printf("writeUploadChunk(): file <%s, %d bytes> successfully uploaded", userFile.Name, userFile.Size)
+		} else {
+			writer.WriteHeader(http.StatusOK)
+		}
+		writer.Write(content)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("Upload-Offset", strconv.FormatInt(pmUpload.Data.Attributes.Offset, 10))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+deleteUpload cancels a chunked upload (the received data is discarded).
+*/
+func deleteUpload(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var pmErrorList pd.PrintmapsErrorList
+	var pmData pd.PrintmapsData
+	var pmUpload pd.PrintmapsUpload
+
+	id := params.ByName("id")
+	uploadID := params.ByName("upload")
+
+	unlockUpload := uploadLocks.lock(uploadID)
+	defer unlockUpload()
+
+	if !readUploadSession(writer, &pmUpload, id, uploadID, &pmErrorList) {
+		return
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if err := pd.RemoveUploadSession(id, uploadID); err != nil {
+			message := fmt.Sprintf("error <%v> at pd.RemoveUploadSession(), upload = <%s>", err, uploadID)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.WriteHeader(http.StatusNoContent)
+	} else {
+		// request not ok, response with error list
+		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.WriteHeader(errorListStatus(pmErrorList))
+		writer.Write(content)
+	}
+}
+
+/*
+appendUploadChunk appends a received chunk to the data of a chunked upload.
+*/
+func appendUploadChunk(filename string, chunkname string) error {
+	in, err := os.Open(chunkname)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+/*
+readUploadSession verifies the IDs and reads the state of a chunked upload.
+Returns false if an internal error was already responded.
+*/
+func readUploadSession(writer http.ResponseWriter, pmUpload *pd.PrintmapsUpload, id string, uploadID string, pmErrorList *pd.PrintmapsErrorList) bool {
+	// verify IDs
+	if _, err := uuid.FromString(id); err != nil {
+		appendError(pmErrorList, "4001", "error = "+err.Error(), "")
+		return true
+	}
+	if _, err := uuid.FromString(uploadID); err != nil {
+		appendError(pmErrorList, "4006", "upload ID invalid: "+uploadID, id)
+		return true
+	}
+
+	if err := pd.ReadUploadSession(pmUpload, id, uploadID); err != nil {
+		if os.IsNotExist(err) {
+			appendError(pmErrorList, "4006", "requested upload not found: "+uploadID, id)
+			return true
+		}
+		message := fmt.Sprintf("error <%v> at pd.ReadUploadSession(), upload = <%s>", err, uploadID)
+		http.Error(writer, message, http.StatusInternalServerError)
+		log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+		return false
+	}
+	return true
+}
+
+/*
+verifyUploadSession verifies the requested chunked upload (file name, size, checksum).
+*/
+func verifyUploadSession(pmUpload pd.PrintmapsUpload, pmErrorList *pd.PrintmapsErrorList, mapID string) {
+	if pmUpload.Data.Type != "uploads" {
+		appendError(pmErrorList, "3001", "valid value: uploads", mapID)
+	}
+
+	attributes := pmUpload.Data.Attributes
+	if !isValidUserFileName(attributes.Name) {
+		appendError(pmErrorList, "4005", "invalid user file name: "+attributes.Name, mapID)
+	}
+	if attributes.Size <= 0 {
+		appendError(pmErrorList, "2003", "/Data/Attributes/Size: positive integer expected", mapID)
+	} else {
+		verifyFileSize(attributes.Size, pmErrorList, mapID)
+	}
+	if attributes.Checksum != "" {
+		if checksum, err := hex.DecodeString(attributes.Checksum); err != nil || len(checksum) != 32 {
+			appendError(pmErrorList, "2003", "/Data/Attributes/Checksum: sha256 (64 hex digits) expected", mapID)
+		}
+	}
+}
+
+/*
+parseContentRange parses the header field "Content-Range" of a chunk (bytes start-end/size).
+*/
+func parseContentRange(contentRange string) (start int64, end int64, size int64, err error) {
+	invalid := errors.New("expected http header field = Content-Range: bytes start-end/size but received: " + contentRange)
+
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	var rest string
+	if _, err := fmt.Sscanf(strings.TrimPrefix(contentRange, "bytes "), "%d-%d/%s", &start, &end, &rest); err != nil {
+		return 0, 0, 0, invalid
+	}
+	size, err = strconv.ParseInt(rest, 10, 64)
+	if err != nil || start < 0 || end < start || end >= size {
+		return 0, 0, 0, invalid
+	}
+	return start, end, size, nil
+}
+
+/*
+removeExpiredUploads discards the unfinished uploads of a map after expiration.
+*/
+func removeExpiredUploads(id string) {
+	uploadIDs, err := pd.ListUploadSessions(id)
+	if err != nil {
+		log.Printf("unexpected error <%s> at pd.ListUploadSessions(), id = <%s>", err, id)
+		return
+	}
+
+	for _, uploadID := range uploadIDs {
+		removeExpiredUpload(id, uploadID)
+	}
+}
+
+/*
+removeExpiredUpload discards an unfinished upload after expiration (a chunk in progress is awaited).
+*/
+func removeExpiredUpload(id string, uploadID string) {
+	unlockUpload := uploadLocks.lock(uploadID)
+	defer unlockUpload()
+
+	var pmUpload pd.PrintmapsUpload
+	if err := pd.ReadUploadSession(&pmUpload, id, uploadID); err != nil {
+		return
+	}
+	expires, err := time.Parse(time.RFC3339, pmUpload.Data.Attributes.Expires)
+	if err != nil || time.Now().Before(expires) {
+		return
+	}
+	if err := pd.RemoveUploadSession(id, uploadID); err != nil {
+		log.Printf("unexpected error <%s> at pd.RemoveUploadSession(), upload = <%s>", err, uploadID)
+		return
+	}
+	log.Printf("removeExpiredUploads(): upload %s of file <%s> expired", uploadID, pmUpload.Data.Attributes.Name)
+}
+
+/*
+sweepExpiredUploads removes the expired uploads of all maps periodically.
+*/
+func sweepExpiredUploads() {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		path := filepath.Join(pd.PathWorkdir, pd.PathMaps)
+		maps, err := ioutil.ReadDir(path)
+		if err != nil {
+			log.Printf("error <%v> at ioutil.ReadDir(), path = <%s>", err, path)
+		}
+		for _, fileInfo := range maps {
+			if fileInfo.IsDir() {
+				removeExpiredUploads(fileInfo.Name())
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,97 @@
+// Revision (optimistic concurrency, history) handling
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// lockStripes is a fixed set of mutexes, keys are mapped to a mutex by hash (memory does not grow with the keys)
+type lockStripes [256]sync.Mutex
+
+// locks serializing the read-modify-write cycles of the meta data (key = map ID)
+var metadataLocks lockStripes
+
+/*
+lockMetadata locks the meta data of a map, returns the unlock function.
+*/
+func lockMetadata(id string) func() {
+	return metadataLocks.lock(id)
+}
+
+/*
+lock locks the mutex for the key, returns the unlock function.
+Keys sharing a mutex are serialized too, a request must not hold two keys of the same stripes at once
+and must not hold a lock while receiving a request body (a slow client would block the keys of other maps).
+*/
+func (locks *lockStripes) lock(key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	mutex := &locks[hash.Sum32()%uint32(len(locks))]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+/*
+metadataETag builds a strong entity tag for the meta data (map ID + revision).
+*/
+func metadataETag(pmData pd.PrintmapsData) string {
+	return fmt.Sprintf("\"%s-%d\"", pmData.Data.ID, pmData.Data.Attributes.Revision)
+}
+
+/*
+verifyIfMatch verifies the precondition "If-Match" (optional) against the current meta data.
+*/
+func verifyIfMatch(request *http.Request, pmData pd.PrintmapsData, pmErrorList *pd.PrintmapsErrorList) {
+	ifMatch := request.Header.Get("If-Match")
+	if ifMatch == "" {
+		return
+	}
+
+	currentETag := metadataETag(pmData)
+	for _, entityTag := range strings.Split(ifMatch, ",") {
+		entityTag = strings.TrimSpace(entityTag)
+		if entityTag == "*" || entityTag == currentETag {
+			return
+		}
+	}
+
+	detail := fmt.Sprintf("map modified in the meantime (current revision = %d, ETag = %s), fetch the meta data and reapply your changes",
+		pmData.Data.Attributes.Revision, currentETag)
+	appendError(pmErrorList, "4003", detail, pmData.Data.ID)
+}
+
+/*
+writeMetadata writes the meta data and archives it as revision (with author and client ip).
+*/
+func writeMetadata(request *http.Request, pmData pd.PrintmapsData, action string, detail string) error {
+	if err := pd.WriteMetadata(pmData); err != nil {
+		return err
+	}
+
+	revision := pd.MetadataRevision{
+		Revision: pmData.Data.Attributes.Revision,
+		Time:     time.Now().Format(time.RFC3339),
+		Author:   "anonymous",
+		Action:   action,
+		Detail:   detail,
+		Metadata: &pmData.Data.Attributes,
+	}
+	if apiKey, found := lookupAPIKey(requestAPIKey(request)); found {
+		revision.Author = apiKey.Owner
+	}
+	revision.ClientIP, _, _ = net.SplitHostPort(request.RemoteAddr)
+	if revision.ClientIP == "" {
+		revision.ClientIP = request.RemoteAddr
+	}
+
+	return pd.WriteRevision(pmData.Data.ID, revision)
+}
@@ -0,0 +1,171 @@
+// Upload limits, storage quotas per map and free disk space
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/printmaps/printmaps/pd"
+)
+
+// megabyte is the unit of all configured sizes
+const megabyte = int64(1024 * 1024)
+
+// ConfigUploads describes the limits for uploaded user files (0 = unlimited)
+type ConfigUploads struct {
+	Maxfilesize  int64 // max size of a single user file (MB)
+	Maxfiles     int   // max number of user files per map
+	Maxmapsize   int64 // max size of all user files per map (MB)
+	Mindiskspace int64 // min free disk space in the working directory (MB), uploads are rejected below
+	Maxuploads   int   // max number of unfinished chunked uploads per map
+}
+
+/*
+maxFileSize returns the max size of a single user file in bytes (0 = unlimited).
+*/
+func maxFileSize() int64 {
+	return config.Uploads.Maxfilesize * megabyte
+}
+
+/*
+verifyFileSize verifies the size of a user file against the upload limit.
+*/
+func verifyFileSize(size int64, pmErrorList *pd.PrintmapsErrorList, mapID string) {
+	if maxFileSize() > 0 && size > maxFileSize() {
+		message := fmt.Sprintf("max upload size = %d bytes", maxFileSize())
+		appendError(pmErrorList, "7001", message, mapID)
+	}
+}
+
+/*
+verifyStorageQuota verifies the quotas of the map (number of user files, size of all user files)
+for storing a user file with the given size (an existing file with the same name is replaced).
+*/
+func verifyStorageQuota(mapID string, name string, size int64, pmErrorList *pd.PrintmapsErrorList) error {
+	return verifyStorageQuotaFiles(mapID, pd.UserFiles{{Name: name, Size: size}}, pmErrorList)
+}
+
+/*
+verifyStorageQuotaFiles verifies the quotas of the map for storing a set of user files (existing files with
+the same names are replaced). Unfinished chunked uploads count with their declared size.
+*/
+func verifyStorageQuotaFiles(mapID string, newFiles pd.UserFiles, pmErrorList *pd.PrintmapsErrorList) error {
+	if config.Uploads.Maxfiles <= 0 && config.Uploads.Maxmapsize <= 0 {
+		return nil
+	}
+
+	userFiles, err := pd.DescribeUserFiles(mapID)
+	if err != nil {
+		return err
+	}
+
+	count := len(newFiles)
+	total := int64(0)
+	names := make(map[string]bool)
+	for _, newFile := range newFiles {
+		total += newFile.Size
+		names[newFile.Name] = true
+	}
+	for _, userFile := range userFiles {
+		if !names[userFile.Name] {
+			count++
+			total += userFile.Size
+		}
+	}
+	reserved, _, err := openUploads(mapID)
+	if err != nil {
+		return err
+	}
+	total += reserved
+
+	if config.Uploads.Maxfiles > 0 && count > config.Uploads.Maxfiles {
+		message := fmt.Sprintf("max user files per map = %d", config.Uploads.Maxfiles)
+		appendError(pmErrorList, "7005", message, mapID)
+	}
+	if config.Uploads.Maxmapsize > 0 && total > config.Uploads.Maxmapsize*megabyte {
+		message := fmt.Sprintf("max size of all user files per map = %d bytes", config.Uploads.Maxmapsize*megabyte)
+		appendError(pmErrorList, "7005", message, mapID)
+	}
+	return nil
+}
+
+/*
+openUploads returns the declared size and the number of the unfinished chunked uploads of a map.
+A complete upload (all data received) is being stored and therefore not counted.
+*/
+func openUploads(mapID string) (int64, int, error) {
+	uploadIDs, err := pd.ListUploadSessions(mapID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reserved := int64(0)
+	count := 0
+	for _, uploadID := range uploadIDs {
+		var pmUpload pd.PrintmapsUpload
+		if err := pd.ReadUploadSession(&pmUpload, mapID, uploadID); err != nil {
+			continue
+		}
+		attributes := pmUpload.Data.Attributes
+		if attributes.Offset < attributes.Size {
+			reserved += attributes.Size
+			count++
+		}
+	}
+	return reserved, count, nil
+}
+
+/*
+verifyUploadCount verifies the number of unfinished chunked uploads of the map for starting a new one.
+*/
+func verifyUploadCount(mapID string, pmErrorList *pd.PrintmapsErrorList) error {
+	if config.Uploads.Maxuploads <= 0 {
+		return nil
+	}
+
+	_, count, err := openUploads(mapID)
+	if err != nil {
+		return err
+	}
+	if count >= config.Uploads.Maxuploads {
+		message := fmt.Sprintf("max unfinished uploads per map = %d (finish or delete an upload)", config.Uploads.Maxuploads)
+		appendError(pmErrorList, "7008", message, mapID)
+	}
+	return nil
+}
+
+/*
+verifyDiskSpace verifies that the free disk space remains above the threshold after storing the given number of bytes
+(size unknown = -1).
+*/
+func verifyDiskSpace(size int64, pmErrorList *pd.PrintmapsErrorList, mapID string) {
+	if config.Uploads.Mindiskspace <= 0 {
+		return
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	free, err := freeDiskSpace(pd.PathWorkdir)
+	if err != nil {
+		log.Printf("error <%v> at freeDiskSpace(), path = <%s>", err, pd.PathWorkdir)
+		return
+	}
+	if free-size < config.Uploads.Mindiskspace*megabyte {
+		log.Printf("free disk space (%d bytes) below threshold, upload of %d bytes rejected", free, size)
+		appendError(pmErrorList, "7006", "not enough free disk space, please try again later", mapID)
+	}
+}
+
+/*
+freeDiskSpace returns the disk space (bytes) available to this process on the file system of path.
+*/
+func freeDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
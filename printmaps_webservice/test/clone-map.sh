@@ -0,0 +1,28 @@
+#!/bin/bash
+#
+# clone map (meta data and user files), override the print size of the copy
+
+postdata=$(cat <<EOS
+{
+    "Data": {
+        "Attributes": {
+            "PrintWidth": 594,
+            "PrintHeight": 841
+        }
+    }
+}
+EOS
+)
+
+echo "postdata =\n$postdata"
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Content-Type: application/merge-patch+json" \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--data "$postdata" \
+--request POST \
+http://printmaps-osm.de:8282/api/beta2/maps/clone/0ac04905-7c27-40cb-a667-e0f9dae61bd3
@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# delete single user file
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--request DELETE \
+http://printmaps-osm.de:8282/api/beta2/maps/0ac04905-7c27-40cb-a667-e0f9dae61bd3/files/aasee.gpx
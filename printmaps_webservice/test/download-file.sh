@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# download single user file
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--output aasee-download.gpx \
+--request GET \
+http://printmaps-osm.de:8282/api/beta2/maps/files/0ac04905-7c27-40cb-a667-e0f9dae61bd3/aasee.gpx
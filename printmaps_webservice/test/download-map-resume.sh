@@ -0,0 +1,18 @@
+#!/bin/bash
+#
+# download map (zip), resume a partial download
+# curl sends 'Range: bytes=<size of partial file>-'
+
+set -o verbose  #echo on
+
+curl \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--dump-header "response-header.txt" \
+--continue-at - \
+--output "printmap.zip" \
+http://printmaps-osm.de:8282/api/beta2/maps/mapfile/0ac04905-7c27-40cb-a667-e0f9dae61bd3
+
+set +o verbose # echo off from bash script
+echo
+
+cat 'response-header.txt'
@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# fetch list of uploaded user files (name, size, checksum, type, upload time)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--request GET \
+http://printmaps-osm.de:8282/api/beta2/maps/files/0ac04905-7c27-40cb-a667-e0f9dae61bd3
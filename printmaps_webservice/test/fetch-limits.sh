@@ -0,0 +1,13 @@
+#!/bin/bash
+#
+# fetch current rate limit and quota counters (admin api key required)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--header "Authorization: Bearer $PRINTMAPS_APIKEY" \
+http://printmaps-osm.de:8282/api/beta2/maps/admin/limits
+
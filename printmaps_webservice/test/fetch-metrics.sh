@@ -0,0 +1,10 @@
+#!/bin/bash
+#
+# fetch service metrics (prometheus text format)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+http://printmaps-osm.de:8282/metrics
@@ -0,0 +1,10 @@
+#!/bin/bash
+#
+# fetch api description (openapi)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+http://printmaps-osm.de:8282/api/beta2/openapi.json
@@ -0,0 +1,10 @@
+#!/bin/bash
+#
+# fetch readiness report (status code 503 if a check fails)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+http://printmaps-osm.de:8282/readyz
@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# subscribe to map state events (stream ends after build completion)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--no-buffer \
+--header "Accept: text/event-stream" \
+http://printmaps-osm.de:8282/api/beta2/maps/mapstate/0ac04905-7c27-40cb-a667-e0f9dae61bd3/events
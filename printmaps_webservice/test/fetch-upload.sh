@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# fetch state of resumable upload (offset = resume position)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--request GET \
+http://printmaps-osm.de:8282/api/beta2/maps/uploads/0ac04905-7c27-40cb-a667-e0f9dae61bd3/5f0c5cb1-53a4-4bd1-9a51-4b1a4b7f0a3e
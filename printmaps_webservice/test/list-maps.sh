@@ -0,0 +1,12 @@
+#!/bin/bash
+#
+# list maps (filtered, sorted, paginated)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--globoff \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+"http://printmaps-osm.de:8282/api/beta2/maps?filter[state]=successful&sort=-date&page[number]=1&page[size]=20"
@@ -0,0 +1,13 @@
+#!/bin/bash
+#
+# replace single user file (atomically)
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--request PUT \
+--form "file=@aasee.gpx" \
+http://printmaps-osm.de:8282/api/beta2/maps/files/0ac04905-7c27-40cb-a667-e0f9dae61bd3/aasee.gpx
@@ -0,0 +1,33 @@
+#!/bin/bash
+#
+# start resumable (chunked) upload of user data file
+
+size=$(stat --format=%s aasee.gpx)
+checksum=$(sha256sum aasee.gpx | cut -d ' ' -f 1)
+
+postdata=$(cat <<EOS
+{
+    "Data": {
+        "Type": "uploads",
+        "Attributes": {
+            "Name": "aasee.gpx",
+            "Size": $size,
+            "Checksum": "$checksum"
+        }
+    }
+}
+EOS
+)
+
+echo "postdata =\n$postdata"
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Content-Type: application/vnd.api+json; charset=utf-8" \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--data "$postdata" \
+--request POST \
+http://printmaps-osm.de:8282/api/beta2/maps/uploads/0ac04905-7c27-40cb-a667-e0f9dae61bd3
@@ -0,0 +1,28 @@
+#!/bin/bash
+#
+# update map meta data only if unmodified since revision 1 (If-Match, 412 on conflict)
+
+postdata=$(cat <<EOF
+{
+    "Data": {
+        "Attributes": {
+            "Scale": 25000
+        }
+    }
+}
+EOF
+)
+
+echo "postdata =\n$postdata"
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Content-Type: application/merge-patch+json" \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--header "If-Match: \"0ac04905-7c27-40cb-a667-e0f9dae61bd3-1\"" \
+--data "$postdata" \
+--request PATCH \
+http://printmaps-osm.de:8282/api/beta2/maps/metadata/0ac04905-7c27-40cb-a667-e0f9dae61bd3
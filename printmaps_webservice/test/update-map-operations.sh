@@ -0,0 +1,25 @@
+#!/bin/bash
+#
+# update map meta data with operations (JSON Patch)
+
+postdata=$(cat <<EOF
+[
+    { "op": "test", "path": "/Data/Attributes/Style", "value": "osm-carto" },
+    { "op": "replace", "path": "/Data/Attributes/Style", "value": "osm-carto-mono" },
+    { "op": "remove", "path": "/Data/Attributes/UserObjects/0" }
+]
+EOF
+)
+
+echo "postdata =\n$postdata"
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Content-Type: application/json-patch+json" \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--data "$postdata" \
+--request PATCH \
+http://printmaps-osm.de:8282/api/beta2/maps/metadata/0ac04905-7c27-40cb-a667-e0f9dae61bd3
@@ -15,17 +15,16 @@ postdata=$(cat <<EOF
             "Latitude": 51.9505,
             "Longitude": 7.6049,
             "Style": "osm-carto",
+            "Projection": "3857",
             "HideLayers": "admin-low-zoom,admin-mid-zoom,admin-high-zoom,admin-text",
-            "UserData": [
+            "UserObjects": [
                 {
                     "Style": "<LineSymbolizer stroke='crimson' stroke-width='10' stroke-opacity='0.75' stroke-linecap='round' />",
                     "SRS": "+init=epsg:4326",
                     "Type": "ogr",
                     "File": "aasee.gpx",
                     "Layer": "tracks"
-                }
-            ],
-            "UserItems": [
+                },
                 {
                     "Style": "<PolygonSymbolizer fill='white' fill-opacity='0.75' />",
                     "WellKnownText": "POLYGON((0.0 0.0, 0.0 600.0, 600.0 600.0, 600.0 0.0, 0.0 0.0), (15.0 15.0, 15.0 585.0, 585.0 585.0, 585.0 15.0, 15.0 15.0))"
@@ -49,14 +48,12 @@ postdata=$(cat <<EOF
                 {
                     "Style": "<TextSymbolizer fontset-name='fontset-1' size='16' fill='firebrick' halo-radius='1' halo-fill='white' allow-overlap='true'>'500 Meter'</TextSymbolizer>",
                     "WellKnownText": "POINT(40.0 36.0)"
+                },
+                {
+                    "Style": "<LineSymbolizer stroke='firebrick' stroke-width='8' stroke-linecap='butt' />",
+                    "WellKnownText": "LINESTRING(30.0 30.0, 80.0 30.0)"
                 }
-            ],
-            "UserScalebar": {
-                "Style": "<LineSymbolizer stroke='firebrick' stroke-width='8' stroke-linecap='butt' />",
-                "NatureLength": 500,
-                "XPos": 30,
-                "YPos": 30
-            }
+            ]
         }
     }
 }
@@ -74,5 +71,5 @@ curl \
 --header "Accept: application/vnd.api+json; charset=utf-8" \
 --data "$postdata" \
 --request PATCH \
-http://printmaps-osm.de:8282/api/beta/maps/metadata
+http://printmaps-osm.de:8282/api/beta2/maps/metadata
 
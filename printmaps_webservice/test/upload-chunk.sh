@@ -0,0 +1,19 @@
+#!/bin/bash
+#
+# send first chunk (64 KiB) of resumable upload (upload ID from start-upload.sh)
+
+size=$(stat --format=%s aasee.gpx)
+head --bytes=65536 aasee.gpx > aasee.chunk
+end=$(($(stat --format=%s aasee.chunk) - 1))
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Content-Type: application/octet-stream" \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--header "Content-Range: bytes 0-$end/$size" \
+--data-binary "@aasee.chunk" \
+--request PUT \
+http://printmaps-osm.de:8282/api/beta2/maps/uploads/0ac04905-7c27-40cb-a667-e0f9dae61bd3/5f0c5cb1-53a4-4bd1-9a51-4b1a4b7f0a3e
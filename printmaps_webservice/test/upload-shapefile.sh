@@ -0,0 +1,13 @@
+#!/bin/bash
+#
+# upload zipped shapefile bundle (.shp, .shx, .dbf, .prj), extracted as user files
+
+set -o verbose
+
+curl \
+--silent \
+--include \
+--header "Accept: application/vnd.api+json; charset=utf-8" \
+--request POST \
+--form "file=@roads.zip" \
+http://printmaps-osm.de:8282/api/beta2/maps/upload/0ac04905-7c27-40cb-a667-e0f9dae61bd3
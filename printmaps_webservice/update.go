@@ -18,15 +18,19 @@ import (
 )
 
 /*
-updateMetadata updates (patches) the meta data for a given map ID.
+updateMetadata updates (patches) the meta data for a given map ID. Depending on the media type:
+- JSON:API document: replaces the stored meta data (the data set must contain all elements, changed + unchanged)
+- JSON Merge Patch (RFC 7396): sent attributes are changed, null removes an attribute
+- JSON Patch (RFC 6902): list of operations (map ID as path parameter)
 */
-func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+func updateMetadata(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 	var pmErrorList pd.PrintmapsErrorList
 	var pmDataPost pd.PrintmapsData
+	var pmDataStored pd.PrintmapsData
 	var pmData pd.PrintmapsData
-	var pmState pd.PrintmapsState
+	var mergedBytes []byte
 
-	verifyContentType(request, &pmErrorList)
+	mediaType := verifyPatchContentType(request, &pmErrorList)
 	verifyAccept(request, &pmErrorList)
 
 	bodyBytes, err := ioutil.ReadAll(request.Body)
@@ -37,16 +41,20 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 		return
 	}
 
-	if err = json.Unmarshal(bodyBytes, &pmDataPost); err != nil {
-		appendError(&pmErrorList, "2001", "error = "+err.Error(), "")
+	// map ID from path or from body
+	id := params.ByName("id")
+	if id == "" && mediaType != pd.JSONPatchMediaType {
+		if err = json.Unmarshal(bodyBytes, &pmDataPost); err != nil {
+			appendError(&pmErrorList, "2001", "error = "+err.Error(), "")
+		}
+		id = pmDataPost.Data.ID
 	}
-
-	id := pmDataPost.Data.ID
-	userFiles := ""
+	var userFiles pd.UserFiles
 
 	// verify ID
-	_, err = uuid.FromString(id)
-	if err != nil {
+	if id == "" && mediaType == pd.JSONPatchMediaType {
+		appendError(&pmErrorList, "4001", "map ID missing (JSON Patch requires path /api/beta2/maps/metadata/:id)", "")
+	} else if _, err = uuid.FromString(id); err != nil {
 		appendError(&pmErrorList, "4001", "error = "+err.Error(), "")
 	}
 
@@ -57,18 +65,80 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 		}
 	}
 
-	// the update data set must contains all map elements (changed + unchanged)
+	// read-modify-write cycle of the meta data must not interleave
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+	}
+
+	// verify access (owner of the stored map) and revision (If-Match)
 	if len(pmErrorList.Errors) == 0 {
-		if err = json.Unmarshal(bodyBytes, &pmData); err != nil {
+		if err := pd.ReadMetadata(&pmDataStored, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		} else {
+			verifyOwner(request, pmDataStored, &pmErrorList)
+		}
+		if len(pmErrorList.Errors) == 0 {
+			verifyIfMatch(request, pmDataStored, &pmErrorList)
+		}
+	}
+
+	// apply the update to the stored meta data (partial update: unchanged elements are kept)
+	if len(pmErrorList.Errors) == 0 {
+		userFiles = pmDataStored.Data.Attributes.UserFiles
+		pmDataStored.Data.Attributes.UserFiles = nil
+		storedBytes, err := json.Marshal(pmDataStored)
+		if err != nil {
+			message := fmt.Sprintf("error <%v> at json.Marshal()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+		switch mediaType {
+		case pd.JSONPatchMediaType:
+			mergedBytes, err = pd.ApplyJSONPatch(storedBytes, bodyBytes)
+		case pd.MergePatchMediaType:
+			mergedBytes, err = pd.MergePatch(storedBytes, bodyBytes)
+		default:
+			// full document: omitted elements are removed (e.g. callback url)
+			mergedBytes = bodyBytes
+		}
+		if err != nil {
+			appendError(&pmErrorList, "2004", "error = "+err.Error(), id)
+		}
+	}
+
+	// the updated data set is verified as a whole
+	if len(pmErrorList.Errors) == 0 {
+		verifyBody(mergedBytes, "PrintmapsData", &pmErrorList, id)
+		if err = json.Unmarshal(mergedBytes, &pmData); err != nil {
 			appendError(&pmErrorList, "2001", "error = "+err.Error(), id)
 		} else {
+			if pmData.Data.ID != id {
+				appendError(&pmErrorList, "2004", "the map ID can't be changed", id)
+			}
 			verifyMetadata(pmData, &pmErrorList)
 		}
+		// the owner can't be changed
+		pmData.Data.Attributes.Owner = pmDataStored.Data.Attributes.Owner
+		// the (hidden) callback secret is kept if sent back unchanged
+		if pmData.Data.Attributes.CallbackSecret == hiddenSecret {
+			pmData.Data.Attributes.CallbackSecret = pmDataStored.Data.Attributes.CallbackSecret
+		}
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision = pmDataStored.Data.Attributes.Revision + 1
 	}
 
 	if len(pmErrorList.Errors) == 0 {
 		// request ok, response with updated data, persist data
-		if err := pd.WriteMetadata(pmData); err != nil {
+		if err := writeMetadata(request, pmData, "update", ""); err != nil {
 			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
 			http.Error(writer, message, http.StatusInternalServerError)
 			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
@@ -76,6 +146,7 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 		}
 
 		pmData.Data.Attributes.UserFiles = userFiles
+		hideCallbackSecret(&pmData)
 		content, err := json.MarshalIndent(pmData, pd.IndentPrefix, pd.IndexString)
 		if err != nil {
 			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
@@ -84,29 +155,9 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 			return
 		}
 
-		// read state
-		if err := pd.ReadMapstate(&pmState, id); err != nil {
-			if !os.IsNotExist(err) {
-				message := fmt.Sprintf("error <%v> at readMapstate(), id = <%s>", err, id)
-				http.Error(writer, message, http.StatusInternalServerError)
-				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
-				return
-			}
-		}
-
-		// write (update) state
-		pmState.Data.Attributes.MapMetadataWritten = time.Now().Format(time.RFC3339)
-		pmState.Data.Attributes.MapOrderSubmitted = ""
-		pmState.Data.Attributes.MapBuildStarted = ""
-		pmState.Data.Attributes.MapBuildCompleted = ""
-		pmState.Data.Attributes.MapBuildSuccessful = ""
-		pmState.Data.Attributes.MapBuildMessage = ""
-		pmState.Data.Attributes.MapBuildBoxMillimeter = pd.BoxMillimeter{}
-		pmState.Data.Attributes.MapBuildBoxPixel = pd.BoxPixel{}
-		pmState.Data.Attributes.MapBuildBoxProjection = pd.BoxProjection{}
-		pmState.Data.Attributes.MapBuildBoxWGS84 = pd.BoxWGS84{}
-		if err = pd.WriteMapstate(pmState); err != nil {
-			message := fmt.Sprintf("error <%v> at updateMapstate()", err)
+		// reset state (the map must be rebuild)
+		if err = resetMapstate(id); err != nil {
+			message := fmt.Sprintf("error <%v> at resetMapstate(), id = <%s>", err, id)
 			http.Error(writer, message, http.StatusInternalServerError)
 			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
 			return
@@ -114,6 +165,7 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		writer.Header().Set("ETag", metadataETag(pmData))
 		writer.WriteHeader(http.StatusOK)
 		writer.Write(content)
 	} else {
@@ -128,7 +180,34 @@ func updateMetadata(writer http.ResponseWriter, request *http.Request, _ httprou
 
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
+
+/*
+resetMapstate resets the state of the map after a change of the meta data (build results are obsolete).
+*/
+func resetMapstate(id string) error {
+	var pmState pd.PrintmapsState
+
+	// read state
+	if err := pd.ReadMapstate(&pmState, id); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// write (update) state
+	pmState.Data.Attributes.MapMetadataWritten = time.Now().Format(time.RFC3339)
+	pmState.Data.Attributes.MapOrderSubmitted = ""
+	pmState.Data.Attributes.MapBuildStarted = ""
+	pmState.Data.Attributes.MapBuildCompleted = ""
+	pmState.Data.Attributes.MapBuildSuccessful = ""
+	pmState.Data.Attributes.MapBuildMessage = ""
+	pmState.Data.Attributes.MapBuildBoxMillimeter = pd.BoxMillimeter{}
+	pmState.Data.Attributes.MapBuildBoxPixel = pd.BoxPixel{}
+	pmState.Data.Attributes.MapBuildBoxProjection = pd.BoxProjection{}
+	pmState.Data.Attributes.MapBuildBoxWGS84 = pd.BoxWGS84{}
+	return pd.WriteMapstate(pmState)
+}
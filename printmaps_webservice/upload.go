@@ -4,9 +4,7 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -54,71 +52,143 @@ func uploadUserdata(writer http.ResponseWriter, request *http.Request, params ht
 		}
 	}
 
-	userfileName := ""
-	userfileSize := int64(-1)
+	if len(pmErrorList.Errors) == 0 {
+		verifyOwner(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	var userfileName string
+	var tempname string
+	var archiveFiles []archiveFile
+	var userFiles []pd.UserFile
+	var skipped []string
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyDiskSpace(request.ContentLength, &pmErrorList, id)
+	}
 
+	// the file is received without holding the lock of the meta data (slow uploads must not block the map)
 	if len(pmErrorList.Errors) == 0 {
-		// input file
-		file, header, err := request.FormFile("file")
+		// input file (streamed)
+		file, err := openFilePart(writer, request)
 		if err != nil {
 			fmt.Fprintln(writer, err)
 			return
 		}
 		defer file.Close()
-		_, userfileName = filepath.Split(header.Filename)
+		_, userfileName = filepath.Split(file.FileName())
 
-		filename := filepath.Join(pd.PathWorkdir, pd.PathMaps, pmData.Data.ID, userfileName)
-		out, err := os.Create(filename)
-		if err != nil {
-			message := fmt.Sprintf("error <%v> at os.Create(), file = <%s>", err, filename)
+		// file name must not collide with the files of the service
+		if !isValidUserFileName(userfileName) {
+			appendError(&pmErrorList, "4005", "invalid user file name: "+userfileName, id)
+		} else if isArchive(userfileName) {
+			// zip archive (e.g. shapefile bundle), extracted into the map directory
+			archiveFiles, skipped, err = receiveUserArchive(file, id, userfileName, &pmErrorList)
+			if err != nil {
+				message := fmt.Sprintf("error <%v> at receiveUserArchive(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+			defer removeArchiveFiles(archiveFiles)
+		} else if err := verifyStorageQuota(id, userfileName, 0, &pmErrorList); err != nil {
+			message := fmt.Sprintf("error <%v> at verifyStorageQuota(), id = <%s>", err, id)
 			http.Error(writer, message, http.StatusInternalServerError)
 			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
 			return
 		}
 
-		// write content from POST to file
-		bytesWritten, err := io.Copy(out, file)
-		out.Close()
-		if err != nil {
-			message := fmt.Sprintf("error <%v> at io.Copy(), file = <%s>", err, filename)
-			http.Error(writer, message, http.StatusInternalServerError)
-			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
-			return
-		}
-		userfileSize = bytesWritten
-
-		filelimit := int64(224 * 1024 * 1024)
-		removeUserfile := false
-		if userfileSize > filelimit {
-			log.Printf("user file <%s> (%d bytes) exceeds upload limit", filename, userfileSize)
-			message := fmt.Sprintf("max upload size = %d bytes", filelimit)
-			appendError(&pmErrorList, "7001", message, id)
-			removeUserfile = true
-		} else {
-			// verify security of uploaded file
-			err := verifyUploadedFile(filename)
+		if len(pmErrorList.Errors) == 0 && !isArchive(userfileName) {
+			tempname, err = receiveUserFile(file, id)
 			if err != nil {
-				log.Printf("insecure user file <%s> rejected", err)
-				appendError(&pmErrorList, "7002", "only data or image files are accepted", id)
-				removeUserfile = true
+				message := fmt.Sprintf("error <%v> at receiveUserFile(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
 			}
+			defer os.Remove(tempname)
 		}
-		if removeUserfile {
-			err := os.Remove(filename)
+	}
+
+	// store the received file (the meta data is modified)
+	if len(pmErrorList.Errors) == 0 {
+		unlock := lockMetadata(id)
+		defer unlock()
+
+		// current revision (modified in the meantime by other requests)
+		if err := pd.ReadMetadata(&pmData, id); err != nil {
+			if os.IsNotExist(err) {
+				appendError(&pmErrorList, "4002", "requested ID not found: "+id, id)
+			} else {
+				message := fmt.Sprintf("error <%v> at readMetadata(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		}
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		verifyIfMatch(request, pmData, &pmErrorList)
+	}
+
+	if len(pmErrorList.Errors) == 0 {
+		if isArchive(userfileName) {
+			userFiles, err = commitUserArchive(archiveFiles, id, &pmErrorList)
+			if err != nil {
+				message := fmt.Sprintf("error <%v> at commitUserArchive(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
+			}
+		} else {
+			userFile, err := commitUserFile(tempname, id, userfileName, "", &pmErrorList)
+			userFiles = append(userFiles, userFile)
 			if err != nil {
-				log.Printf("unexpected error <%s> os.Remove(), file = <%s>", err, filename)
+				message := fmt.Sprintf("error <%v> at commitUserFile(), id = <%s>", err, id)
+				http.Error(writer, message, http.StatusInternalServerError)
+				log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+				return
 			}
 		}
 	}
 
 	if len(pmErrorList.Errors) == 0 {
-		// upload request ok (user data file created)
+		// upload request ok (user data file created), the set of user files is part of the revision
+		pmData.Data.Attributes.UserFiles = nil
+		pmData.Data.Attributes.Revision++
+		var names []string
+		var size int64
+		for _, userFile := range userFiles {
+			names = append(names, userFile.Name)
+			size += userFile.Size
+		}
+		if err := writeMetadata(request, pmData, "upload", "file "+strings.Join(names, ", ")); err != nil {
+			message := fmt.Sprintf("error <%v> at writeMetadata()", err)
+			http.Error(writer, message, http.StatusInternalServerError)
+			log.Printf("Response %d - %s", http.StatusInternalServerError, message)
+			return
+		}
+
+		metricsUploads.Inc("accepted")
+		metricsUploadBytes.Add(float64(size))
+		writer.Header().Set("ETag", metadataETag(pmData))
 		writer.WriteHeader(http.StatusCreated)
-		message := fmt.Sprintf("file <%s, %d bytes> successfully uploaded", userfileName, userfileSize)
-		writer.Write([]byte(message))
+		message := fmt.Sprintf("file <%s, %d bytes> successfully uploaded", strings.Join(names, ", "), size)
 		log.Printf("uploadUserdata(): %s", message)
+		if len(skipped) > 0 {
+			message += fmt.Sprintf("\nskipped (format not accepted): %s", strings.Join(skipped, ", "))
+		}
+		if layers := describeLayers(userFiles); len(layers) > 0 {
+			message += "\nlayers (for UserObjects):\n" + strings.Join(layers, "\n")
+		}
+		writer.Write([]byte(message))
 	} else {
 		// request not ok, response with error list
+		metricsUploads.Inc("rejected")
 		content, err := json.MarshalIndent(pmErrorList, pd.IndentPrefix, pd.IndexString)
 		if err != nil {
 			message := fmt.Sprintf("error <%v> at json.MarshalIndent()", err)
@@ -128,29 +198,7 @@ func uploadUserdata(writer http.ResponseWriter, request *http.Request, params ht
 		}
 		writer.Header().Set("Content-Type", pd.JSONAPIMediaType)
 		writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(errorListStatus(pmErrorList))
 		writer.Write(content)
 	}
 }
-
-/*
-verifyUploadedFile verifies if a file is 'secure' (using linux file command).
-*/
-func verifyUploadedFile(filename string) error {
-	command := fmt.Sprintf("file %s", filename)
-	commandExitStatus, commandOutput, err := runCommand(command)
-	if err != nil {
-		log.Printf("error <%v> at runCommand()", err)
-		log.Printf("command = <%v>", command)
-		log.Printf("command exit status = <%d>", commandExitStatus)
-		if len(commandOutput) > 0 {
-			log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
-		}
-		message := fmt.Sprintf("error <%v> at runCommand()", err)
-		return errors.New(message)
-	}
-	if strings.Contains(string(commandOutput), "executable") {
-		return errors.New(strings.TrimSpace(string(commandOutput)))
-	}
-	return nil
-}
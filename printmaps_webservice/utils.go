@@ -6,13 +6,12 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
 
 	pip "github.com/JamesMilnerUK/pip-go"
 	"github.com/printmaps/printmaps/pd"
@@ -41,6 +40,33 @@ func createMapOrder(pmData pd.PrintmapsData) error {
 	return ioutil.WriteFile(file, data, 0666)
 }
 
+/*
+copyFile copies a file (content and permissions).
+*/
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fileInfo, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 /*
 readPolyfile reads the polygon file (osmosis poly(gon) format).
 Spec: http://wiki.openstreetmap.org/wiki/Osmosis/Polygon_Filter_File_Format
@@ -126,40 +152,3 @@ func readCapafile(filename string, pmFeature *PrintmapsFeature) error {
 
 	return nil
 }
-
-/*
-runCommand runs a command / program.
-*/
-func runCommand(command string) (commandExitStatus int, commandOutput []byte, err error) {
-	program := "/bin/bash"
-	args := []string{"-c", command}
-	cmd := exec.Command(program, args...)
-
-	commandOutput, err = cmd.CombinedOutput()
-
-	var waitStatus syscall.WaitStatus
-	if err != nil {
-		// command was not successful
-		if exitError, ok := err.(*exec.ExitError); ok {
-			// command fails because of an unsuccessful exit code
-			waitStatus = exitError.Sys().(syscall.WaitStatus)
-			log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
-		}
-		log.Printf("error <%v> at cmd.CombinedOutput()", err)
-		log.Printf("command (not successful) = <%s>", strings.Join(cmd.Args, " "))
-		if len(commandOutput) > 0 {
-			log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
-		}
-	} else {
-		// command was successful
-		waitStatus = cmd.ProcessState.Sys().(syscall.WaitStatus)
-		// log.Printf("command (successful) = <%s>", strings.Join(cmd.Args, " "))
-		// log.Printf("command exit code = <%d>", waitStatus.ExitStatus())
-		// if len(commandOutput) > 0 {
-		// 	log.Printf("command output (stdout, stderr) =\n%s", string(commandOutput))
-		// }
-	}
-
-	commandExitStatus = waitStatus.ExitStatus()
-	return
-}
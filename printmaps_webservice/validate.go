@@ -0,0 +1,586 @@
+// Content verification of uploaded user files
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileFormat describes an accepted format of user files
+type fileFormat struct {
+	Name        string                                 // name of format (for messages)
+	ContentType string                                 // content type reported for user files
+	Extensions  []string                               // file extensions (lower case) belonging to the format
+	Verify      func(file *os.File, size int64) string // verifies the content, returns the reason for a rejection
+	Sniff       func(head []byte) bool                 // detects the format by its magic bytes (nil = detection by extension)
+}
+
+// fileFormats is the allowlist of accepted user files
+var fileFormats = []fileFormat{
+	{"PNG", "image/png", []string{".png"}, verifyPNG, hasPrefix("\x89PNG\r\n\x1a\n")},
+	{"JPEG", "image/jpeg", []string{".jpg", ".jpeg"}, verifyJPEG, hasPrefix("\xff\xd8\xff")},
+	{"GeoTIFF", "image/tiff", []string{".tif", ".tiff"}, verifyTIFF, hasPrefix("II*\x00", "MM\x00*", "II+\x00", "MM\x00+")},
+	{"Shapefile", "application/x-esri-shape", []string{".shp", ".shx"}, verifyShape, hasPrefix("\x00\x00\x27\x0a")},
+	{"GPX", "application/gpx+xml", []string{".gpx"}, verifyXMLRoot("gpx"), isXML("gpx")},
+	{"KML", "application/vnd.google-earth.kml+xml", []string{".kml"}, verifyXMLRoot("kml"), isXML("kml")},
+	{"SVG", "image/svg+xml", []string{".svg"}, verifySVG, isXML("svg")},
+	{"GeoJSON", "application/geo+json", []string{".geojson", ".json"}, verifyGeoJSON, isJSON},
+	{"dBASE", "application/x-dbf", []string{".dbf"}, verifyDBF, nil},
+	{"CSV", "text/csv", []string{".csv"}, verifyCSV, nil},
+	{"PRJ/CPG", "text/plain", []string{".prj", ".cpg"}, verifyShapeText, nil},
+}
+
+// sniffLength is the number of bytes considered for detecting the format
+const sniffLength = 4096
+
+// geoJSONTypes are the valid values of the GeoJSON member 'type'
+var geoJSONTypes = map[string]bool{
+	"FeatureCollection": true, "Feature": true, "GeometryCollection": true,
+	"Point": true, "MultiPoint": true, "LineString": true, "MultiLineString": true, "Polygon": true, "MultiPolygon": true,
+}
+
+// shapeTypes are the valid shape types of shapefiles
+var shapeTypes = map[int32]bool{0: true, 1: true, 3: true, 5: true, 8: true, 11: true, 13: true, 15: true, 18: true, 21: true, 23: true, 25: true, 28: true, 31: true}
+
+// geoTIFFTags are the TIFF tags defining the georeference (ModelPixelScale, ModelTiepoint, ModelTransformation, GeoKeyDirectory)
+var geoTIFFTags = map[uint16]bool{33550: true, 33922: true, 34264: true, 34735: true}
+
+/*
+verifyUploadedFile verifies the content of an uploaded file (name = name of user file) against the allowlist of
+accepted formats. It returns the content type of the file or the reason for the rejection.
+*/
+func verifyUploadedFile(filename string, name string) (contentType string, reason string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("error <%v> at os.Open(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		log.Printf("error <%v> at file.Stat(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	if fileInfo.Size() == 0 {
+		return "", "empty file", nil
+	}
+
+	head := make([]byte, sniffLength)
+	count, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("error <%v> at io.ReadFull(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	head = head[:count]
+
+	// detect format by content, formats without magic bytes by extension
+	extension := strings.ToLower(filepath.Ext(name))
+	var format *fileFormat
+	for index := range fileFormats {
+		if fileFormats[index].Sniff != nil && fileFormats[index].Sniff(head) {
+			format = &fileFormats[index]
+			break
+		}
+	}
+	if format == nil {
+		for index := range fileFormats {
+			if fileFormats[index].Sniff == nil && hasExtension(fileFormats[index], extension) {
+				format = &fileFormats[index]
+				break
+			}
+		}
+	}
+	if format == nil {
+		return "", "content not accepted (allowed: " + acceptedFormats() + ")", nil
+	}
+
+	// content and extension must fit together
+	for _, other := range fileFormats {
+		if other.Name != format.Name && hasExtension(other, extension) {
+			return "", fmt.Sprintf("content (%s) doesn't match file extension %s", format.Name, extension), nil
+		}
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("error <%v> at file.Seek(), file = <%s>", err, filename)
+		return "", "", err
+	}
+	if reason = format.Verify(file, fileInfo.Size()); reason != "" {
+		return "", format.Name + ": " + reason, nil
+	}
+
+	return format.ContentType, "", nil
+}
+
+/*
+acceptedFormats returns the names of all accepted formats.
+*/
+func acceptedFormats() string {
+	var names []string
+	for _, format := range fileFormats {
+		names = append(names, format.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+/*
+hasExtension checks if the extension belongs to the format.
+*/
+func hasExtension(format fileFormat, extension string) bool {
+	for _, item := range format.Extensions {
+		if item == extension {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+hasPrefix returns a sniffer detecting one of the given magic byte sequences.
+*/
+func hasPrefix(magics ...string) func(head []byte) bool {
+	return func(head []byte) bool {
+		for _, magic := range magics {
+			if bytes.HasPrefix(head, []byte(magic)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+/*
+trimHead removes a byte order mark and leading white space.
+*/
+func trimHead(head []byte) []byte {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	return bytes.TrimLeft(head, " \t\r\n")
+}
+
+/*
+isXML returns a sniffer detecting a XML document with the given root element.
+*/
+func isXML(root string) func(head []byte) bool {
+	return func(head []byte) bool {
+		if !bytes.HasPrefix(trimHead(head), []byte("<")) {
+			return false
+		}
+		// the root element follows the XML declaration, comments and the document type declaration
+		decoder := newXMLDecoder(bytes.NewReader(head))
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				return false
+			}
+			if element, ok := token.(xml.StartElement); ok {
+				return element.Name.Local == root
+			}
+		}
+	}
+}
+
+/*
+newXMLDecoder creates a strict XML decoder supporting the encodings UTF-8, US-ASCII and ISO-8859-1.
+*/
+func newXMLDecoder(reader io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(reader)
+	decoder.Strict = true
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "us-ascii", "iso-8859-1", "latin1":
+			return &latin1Reader{reader: bufio.NewReader(input)}, nil
+		}
+		return nil, fmt.Errorf("unsupported encoding %s", charset)
+	}
+	return decoder
+}
+
+// latin1Reader converts ISO-8859-1 to UTF-8
+type latin1Reader struct {
+	reader  *bufio.Reader
+	pending []byte
+}
+
+/*
+Read reads ISO-8859-1 encoded bytes and returns them as UTF-8.
+*/
+func (latin1 *latin1Reader) Read(buffer []byte) (int, error) {
+	count := 0
+	for count < len(buffer) {
+		if len(latin1.pending) > 0 {
+			buffer[count] = latin1.pending[0]
+			latin1.pending = latin1.pending[1:]
+			count++
+			continue
+		}
+		char, err := latin1.reader.ReadByte()
+		if err != nil {
+			if count > 0 {
+				return count, nil
+			}
+			return 0, err
+		}
+		encoded := make([]byte, utf8.UTFMax)
+		latin1.pending = encoded[:utf8.EncodeRune(encoded, rune(char))]
+	}
+	return count, nil
+}
+
+/*
+isJSON detects a JSON object.
+*/
+func isJSON(head []byte) bool {
+	return bytes.HasPrefix(trimHead(head), []byte("{"))
+}
+
+/*
+verifyPNG verifies the header of a PNG image.
+*/
+func verifyPNG(file *os.File, size int64) string {
+	if _, err := png.DecodeConfig(bufio.NewReader(file)); err != nil {
+		return fmt.Sprintf("invalid image (%v)", err)
+	}
+	return ""
+}
+
+/*
+verifyJPEG verifies the header of a JPEG image.
+*/
+func verifyJPEG(file *os.File, size int64) string {
+	if _, err := jpeg.DecodeConfig(bufio.NewReader(file)); err != nil {
+		return fmt.Sprintf("invalid image (%v)", err)
+	}
+	return ""
+}
+
+// max number of entries of a TIFF image directory (real images have less than 100)
+const maxTIFFEntries = 4096
+
+/*
+verifyTIFF verifies the structure of the first image directory of a (Big)TIFF image and the existence of
+GeoTIFF tags.
+*/
+func verifyTIFF(file *os.File, size int64) string {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return "truncated header"
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if header[0] == 'M' {
+		order = binary.BigEndian
+	}
+	bigTIFF := order.Uint16(header[2:4]) == 43
+
+	// position of first image directory, size of entry count and entries
+	offset := int64(order.Uint32(header[4:8]))
+	countSize, entrySize := int64(2), int64(12)
+	if bigTIFF {
+		offset = int64(order.Uint64(header[8:16]))
+		countSize, entrySize = 8, 20
+	}
+	if offset < 8 || offset > size-countSize {
+		return "image directory outside of file"
+	}
+
+	buffer := make([]byte, countSize)
+	if _, err := file.ReadAt(buffer, offset); err != nil {
+		return "unreadable image directory"
+	}
+	count := int64(order.Uint16(buffer))
+	if bigTIFF {
+		count = int64(order.Uint64(buffer))
+	}
+	// compared by division (a huge count must not overflow), the count of entries is limited
+	if count <= 0 || count > (size-offset-countSize)/entrySize || count > maxTIFFEntries {
+		return "invalid image directory"
+	}
+
+	entries := make([]byte, count*entrySize)
+	if _, err := file.ReadAt(entries, offset+countSize); err != nil {
+		return "unreadable image directory"
+	}
+	for index := int64(0); index < count; index++ {
+		if geoTIFFTags[order.Uint16(entries[index*entrySize:])] {
+			return ""
+		}
+	}
+	return "no georeference (GeoTIFF tags) found"
+}
+
+/*
+verifyShape verifies the header of a shapefile (main file or index file).
+*/
+func verifyShape(file *os.File, size int64) string {
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return "truncated header"
+	}
+	if binary.LittleEndian.Uint32(header[28:32]) != 1000 {
+		return "unsupported version"
+	}
+	// file length is given in 16-bit words
+	if int64(binary.BigEndian.Uint32(header[24:28]))*2 != size {
+		return "file length in header doesn't match size of file"
+	}
+	if !shapeTypes[int32(binary.LittleEndian.Uint32(header[32:36]))] {
+		return "unknown shape type"
+	}
+	return ""
+}
+
+/*
+verifyDBF verifies the header of a dBASE file (attributes of a shapefile).
+*/
+func verifyDBF(file *os.File, size int64) string {
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return "truncated header"
+	}
+	switch header[0] {
+	case 0x02, 0x03, 0x04, 0x05, 0x30, 0x31, 0x32, 0x43, 0x63, 0x83, 0x8b, 0x8e, 0xcb, 0xf5, 0xfb:
+	default:
+		return "unknown version"
+	}
+	records := int64(binary.LittleEndian.Uint32(header[4:8]))
+	headerLength := int64(binary.LittleEndian.Uint16(header[8:10]))
+	recordLength := int64(binary.LittleEndian.Uint16(header[10:12]))
+	if headerLength < 33 || recordLength == 0 {
+		return "invalid header"
+	}
+	if headerLength+records*recordLength > size {
+		return "file shorter than declared records"
+	}
+	return ""
+}
+
+/*
+verifyShapeText verifies a small text file belonging to a shapefile (projection, codepage).
+*/
+func verifyShapeText(file *os.File, size int64) string {
+	if size > 64*1024 {
+		return "file too large"
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "unreadable file"
+	}
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return "no text file"
+	}
+	return ""
+}
+
+/*
+verifyCSV verifies that all records of a CSV file are well-formed and have the same number of fields.
+*/
+func verifyCSV(file *os.File, size int64) string {
+	buffered := bufio.NewReader(file)
+	if magic, _ := buffered.Peek(2); string(magic) == "#!" {
+		return "script not accepted"
+	}
+	reader := csv.NewReader(buffered)
+	reader.ReuseRecord = true
+	for number := 1; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return ""
+		}
+		if err != nil {
+			return fmt.Sprintf("malformed (%v)", err)
+		}
+		for _, field := range record {
+			if !utf8.ValidString(field) || strings.IndexByte(field, 0) >= 0 {
+				return fmt.Sprintf("no text in record %d", number)
+			}
+		}
+	}
+}
+
+/*
+verifyGeoJSON verifies that a file is well-formed JSON and a GeoJSON object.
+*/
+func verifyGeoJSON(file *os.File, size int64) string {
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	depth := 0
+	complete := false
+	expectKey := true
+	captureType := false
+	geoJSONType := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("malformed (%v)", err)
+		}
+		if complete {
+			return "data after end of object"
+		}
+		switch value := token.(type) {
+		case json.Delim:
+			if value == '{' || value == '[' {
+				depth++
+			} else {
+				depth--
+			}
+			// members of the top level object alternate between key and value
+			expectKey = depth == 1
+			captureType = false
+			complete = depth == 0
+		default:
+			if depth == 1 {
+				if expectKey {
+					captureType = token == "type"
+				} else if captureType {
+					geoJSONType, _ = value.(string)
+					captureType = false
+				}
+				expectKey = !expectKey
+			}
+		}
+	}
+	if !complete {
+		return "malformed (unexpected end of data)"
+	}
+	if !geoJSONTypes[geoJSONType] {
+		return "no GeoJSON object (invalid or missing member 'type')"
+	}
+	return ""
+}
+
+/*
+verifyXMLRoot returns a verifier for a well-formed XML document with the given root element.
+*/
+func verifyXMLRoot(root string) func(file *os.File, size int64) string {
+	return func(file *os.File, size int64) string {
+		return verifyXML(file, root, nil)
+	}
+}
+
+/*
+verifySVG verifies that a SVG image is well-formed and contains neither scripts nor external references.
+*/
+func verifySVG(file *os.File, size int64) string {
+	return verifyXML(file, "svg", verifySVGToken)
+}
+
+/*
+verifyXML verifies that a file is a well-formed XML document with the given root element. Entity declarations
+and style sheet instructions are rejected. The optional function verifies each element and text (element =
+name of enclosing element).
+*/
+func verifyXML(file *os.File, root string, verifyToken func(token xml.Token, element string) string) string {
+	decoder := newXMLDecoder(bufio.NewReader(file))
+	var elements []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("malformed (%v)", err)
+		}
+		switch value := token.(type) {
+		case xml.StartElement:
+			if len(elements) == 0 && value.Name.Local != root {
+				return fmt.Sprintf("root element <%s> found, <%s> expected", value.Name.Local, root)
+			}
+			elements = append(elements, value.Name.Local)
+		case xml.EndElement:
+			elements = elements[:len(elements)-1]
+		case xml.Directive:
+			if bytes.Contains(value, []byte("ENTITY")) {
+				return "entity declarations not allowed"
+			}
+		case xml.ProcInst:
+			if value.Target == "xml-stylesheet" {
+				return "style sheet instructions not allowed"
+			}
+		case xml.CharData:
+			if len(elements) == 0 && len(bytes.TrimSpace(value)) > 0 {
+				return "text outside of root element"
+			}
+		}
+		if verifyToken != nil && len(elements) > 0 {
+			if reason := verifyToken(token, elements[len(elements)-1]); reason != "" {
+				return reason
+			}
+		}
+	}
+	if len(elements) > 0 {
+		return "malformed (unexpected end of data)"
+	}
+	return ""
+}
+
+/*
+verifySVGToken verifies a SVG element or text: scripts, event handlers and external references are rejected.
+*/
+func verifySVGToken(token xml.Token, element string) string {
+	switch value := token.(type) {
+	case xml.StartElement:
+		switch strings.ToLower(value.Name.Local) {
+		case "script", "foreignobject", "iframe", "embed", "object":
+			return fmt.Sprintf("element <%s> not allowed", value.Name.Local)
+		}
+		for _, attr := range value.Attr {
+			name := strings.ToLower(attr.Name.Local)
+			if strings.HasPrefix(name, "on") {
+				return fmt.Sprintf("event handler '%s' not allowed", attr.Name.Local)
+			}
+			if name == "href" || name == "src" {
+				reference := strings.ToLower(strings.TrimSpace(attr.Value))
+				if !strings.HasPrefix(reference, "#") && !strings.HasPrefix(reference, "data:image/") {
+					return fmt.Sprintf("external reference '%s' not allowed", attr.Value)
+				}
+			}
+			if reason := verifySVGStyle(attr.Value); reason != "" {
+				return fmt.Sprintf("attribute '%s': %s", attr.Name.Local, reason)
+			}
+		}
+	case xml.CharData:
+		if strings.ToLower(element) == "style" {
+			if reason := verifySVGStyle(string(value)); reason != "" {
+				return "style element: " + reason
+			}
+		}
+	}
+	return ""
+}
+
+/*
+verifySVGStyle verifies a style (attribute value or content of style element) for external references and scripts.
+*/
+func verifySVGStyle(style string) string {
+	style = strings.ToLower(strings.Join(strings.Fields(style), ""))
+	if strings.Contains(style, "javascript:") {
+		return "script not allowed"
+	}
+	if strings.Contains(style, "@import") {
+		return "external reference (@import) not allowed"
+	}
+	for index := strings.Index(style, "url("); index >= 0; index = strings.Index(style, "url(") {
+		style = style[index+len("url("):]
+		reference := strings.TrimLeft(style, "'\"")
+		if !strings.HasPrefix(reference, "#") && !strings.HasPrefix(reference, "data:image/") {
+			return "external reference (url) not allowed"
+		}
+	}
+	return ""
+}
@@ -4,7 +4,9 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -22,6 +24,26 @@ func verifyContentType(request *http.Request, pmErrorList *pd.PrintmapsErrorList
 	}
 }
 
+/*
+verifyPatchContentType verifies the media type for header field "Content-Type" of an update
+(JSON:API document, JSON Merge Patch or JSON Patch), returns the media type without parameters.
+*/
+func verifyPatchContentType(request *http.Request, pmErrorList *pd.PrintmapsErrorList) string {
+	mediaType := request.Header.Get("Content-Type")
+	if strings.EqualFold(pd.JSONAPIMediaType, mediaType) {
+		return "application/vnd.api+json"
+	}
+
+	baseType, _, err := mime.ParseMediaType(mediaType)
+	if err == nil && (baseType == pd.MergePatchMediaType || baseType == pd.JSONPatchMediaType) {
+		return baseType
+	}
+
+	appendError(pmErrorList, "1001", "expected http header field = Content-Type: "+pd.JSONAPIMediaType+
+		" or "+pd.MergePatchMediaType+" or "+pd.JSONPatchMediaType+" but received: "+mediaType, "")
+	return ""
+}
+
 /*
 verifyAccept verifies the media type for header field "Accept".
 */
@@ -126,11 +148,31 @@ func verifyMetadata(pmData pd.PrintmapsData, pmErrorList *pd.PrintmapsErrorList)
 		}
 	}
 
-	// projection must be an integer
+	// projection must be an EPSG code (same check as in the build service)
 	if pmData.Data.Attributes.Projection != "" {
-		_, err := strconv.Atoi(pmData.Data.Attributes.Projection)
-		if err != nil {
-			appendError(pmErrorList, "3014", "projection must be an integer", pmData.Data.ID)
+		if !pd.IsValidProjection(pmData.Data.Attributes.Projection) {
+			appendError(pmErrorList, "3014", "projection must be an integer (EPSG code, max 6 digits)", pmData.Data.ID)
+		}
+	}
+
+	// layers to hide: comma separated names (same check as in the build service)
+	if !pd.IsValidHideLayers(pmData.Data.Attributes.HideLayers) {
+		appendError(pmErrorList, "3017", "valid format: comma separated layer names (a-z, A-Z, 0-9, _, - not leading) without spaces", pmData.Data.ID)
+	}
+
+	// callback url must be an absolute http(s) url
+	if pmData.Data.Attributes.CallbackURL != "" {
+		callbackURL, err := url.Parse(pmData.Data.Attributes.CallbackURL)
+		if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") || callbackURL.Host == "" {
+			appendError(pmErrorList, "3015", "valid values: absolute http or https url", pmData.Data.ID)
+		}
+	}
+
+	// style of user objects: allowed mapnik symbolizers only
+	for index, userObject := range pmData.Data.Attributes.UserObjects {
+		_, violations := pd.SanitizeStyle(userObject.Style)
+		for _, violation := range violations {
+			appendError(pmErrorList, "3016", fmt.Sprintf("UserObjects[%d]: %s", index, violation), pmData.Data.ID)
 		}
 	}
 
@@ -206,6 +248,18 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 		jaError.Status = strconv.Itoa(http.StatusBadRequest) + " " + http.StatusText(http.StatusBadRequest)
 		jaError.Source.Pointer = "body"
 		jaError.Title = "missing or undecodable http body (json)"
+	case "2002":
+		jaError.Status = strconv.Itoa(http.StatusBadRequest) + " " + http.StatusText(http.StatusBadRequest)
+		jaError.Source.Parameter = "query"
+		jaError.Title = "invalid query parameter"
+	case "2003":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "body"
+		jaError.Title = "unknown or invalid attribute (see api description /api/beta2/openapi.json)"
+	case "2004":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "body"
+		jaError.Title = "patch not applicable"
 	case "3001":
 		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
 		jaError.Source.Pointer = "data.type"
@@ -246,6 +300,18 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
 		jaError.Source.Pointer = "data.attributes.projection"
 		jaError.Title = "invalid attribute projection"
+	case "3015":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "data.attributes.callbackURL"
+		jaError.Title = "invalid attribute callbackURL"
+	case "3016":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "data.attributes.userObjects.style"
+		jaError.Title = "invalid attribute style of user object (allowed: mapnik symbolizers, see documentation)"
+	case "3017":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "data.attributes.hideLayers"
+		jaError.Title = "invalid attribute hideLayers"
 	case "4001":
 		jaError.Status = strconv.Itoa(http.StatusNotFound) + " " + http.StatusText(http.StatusNotFound)
 		jaError.Source.Pointer = "id"
@@ -254,10 +320,50 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 		jaError.Status = strconv.Itoa(http.StatusNotFound) + " " + http.StatusText(http.StatusNotFound)
 		jaError.Source.Pointer = "id"
 		jaError.Title = "id not found"
+	case "4003":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "If-Match"
+		jaError.Title = "revision conflict, map modified in the meantime"
+	case "4004":
+		jaError.Status = strconv.Itoa(http.StatusNotFound) + " " + http.StatusText(http.StatusNotFound)
+		jaError.Source.Pointer = "revision"
+		jaError.Title = "revision not found"
+	case "4005":
+		jaError.Status = strconv.Itoa(http.StatusNotFound) + " " + http.StatusText(http.StatusNotFound)
+		jaError.Source.Pointer = "name"
+		jaError.Title = "user file not found"
+	case "4006":
+		jaError.Status = strconv.Itoa(http.StatusNotFound) + " " + http.StatusText(http.StatusNotFound)
+		jaError.Source.Pointer = "upload"
+		jaError.Title = "upload not found (completed, cancelled or expired)"
 	case "5001":
 		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
 		jaError.Source.Pointer = "data.attributes"
 		jaError.Title = "map build rejected, required attributes missing"
+	case "5002":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.userObjects.file"
+		jaError.Title = "map build rejected, referenced user file not uploaded"
+	case "5003":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.userObjects.layer"
+		jaError.Title = "map build rejected, layer not found"
+	case "5004":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.userObjects.srs"
+		jaError.Title = "map build rejected, invalid spatial reference system"
+	case "5005":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.hideLayers"
+		jaError.Title = "map build rejected, layer to hide not part of style"
+	case "5006":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.userObjects.style"
+		jaError.Title = "map build rejected, marker not found"
+	case "5007":
+		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
+		jaError.Source.Pointer = "data.attributes.userObjects.type"
+		jaError.Title = "map build rejected, data source type not supported"
 	case "6001":
 		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
 		jaError.Source.Pointer = "POST: api/beta2/maps/mapfile"
@@ -274,6 +380,10 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 		jaError.Status = strconv.Itoa(http.StatusPreconditionFailed) + " " + http.StatusText(http.StatusPreconditionFailed)
 		jaError.Source.Pointer = "SERVER: map build process"
 		jaError.Title = "map build process not successful"
+	case "6005":
+		jaError.Status = strconv.Itoa(http.StatusConflict) + " " + http.StatusText(http.StatusConflict)
+		jaError.Source.Pointer = "SERVER: asynchronous build process"
+		jaError.Title = "no map build to cancel (not ordered or already completed)"
 	case "7001":
 		jaError.Status = strconv.Itoa(http.StatusRequestEntityTooLarge) + " " + http.StatusText(http.StatusRequestEntityTooLarge)
 		jaError.Source.Pointer = "POST: api/beta2/maps/upload"
@@ -281,7 +391,55 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 	case "7002":
 		jaError.Status = strconv.Itoa(http.StatusUnsupportedMediaType) + " " + http.StatusText(http.StatusUnsupportedMediaType)
 		jaError.Source.Pointer = "POST: api/beta2/maps/upload"
-		jaError.Title = "insecure file rejected"
+		jaError.Title = "file content rejected (not an accepted format)"
+	case "7003":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "data.attributes.checksum"
+		jaError.Title = "checksum mismatch, uploaded file damaged"
+	case "7004":
+		jaError.Status = strconv.Itoa(http.StatusConflict) + " " + http.StatusText(http.StatusConflict)
+		jaError.Source.Pointer = "Content-Range"
+		jaError.Title = "chunk doesn't continue the upload (see Upload-Offset)"
+	case "7005":
+		jaError.Status = strconv.Itoa(http.StatusRequestEntityTooLarge) + " " + http.StatusText(http.StatusRequestEntityTooLarge)
+		jaError.Source.Pointer = "POST: api/beta2/maps/upload"
+		jaError.Title = "storage quota of the map exceeded"
+	case "7006":
+		jaError.Status = strconv.Itoa(http.StatusInsufficientStorage) + " " + http.StatusText(http.StatusInsufficientStorage)
+		jaError.Source.Pointer = "SERVER: disk space"
+		jaError.Title = "insufficient storage"
+	case "7007":
+		jaError.Status = strconv.Itoa(http.StatusUnprocessableEntity) + " " + http.StatusText(http.StatusUnprocessableEntity)
+		jaError.Source.Pointer = "POST: api/beta2/maps/upload"
+		jaError.Title = "shapefile incomplete (.shp, .shx, .dbf and .prj required)"
+	case "7008":
+		jaError.Status = strconv.Itoa(http.StatusConflict) + " " + http.StatusText(http.StatusConflict)
+		jaError.Source.Pointer = "POST: api/beta2/maps/uploads"
+		jaError.Title = "too many unfinished uploads"
+	case "8001":
+		jaError.Status = strconv.Itoa(http.StatusUnauthorized) + " " + http.StatusText(http.StatusUnauthorized)
+		jaError.Source.Pointer = "Authorization"
+		jaError.Title = "missing api key"
+	case "8002":
+		jaError.Status = strconv.Itoa(http.StatusUnauthorized) + " " + http.StatusText(http.StatusUnauthorized)
+		jaError.Source.Pointer = "Authorization"
+		jaError.Title = "invalid api key"
+	case "8003":
+		jaError.Status = strconv.Itoa(http.StatusForbidden) + " " + http.StatusText(http.StatusForbidden)
+		jaError.Source.Pointer = "id"
+		jaError.Title = "access to map denied"
+	case "8004":
+		jaError.Status = strconv.Itoa(http.StatusForbidden) + " " + http.StatusText(http.StatusForbidden)
+		jaError.Source.Pointer = "Authorization"
+		jaError.Title = "access to admin resource denied"
+	case "9001":
+		jaError.Status = strconv.Itoa(http.StatusTooManyRequests) + " " + http.StatusText(http.StatusTooManyRequests)
+		jaError.Source.Pointer = "SERVER: rate limit"
+		jaError.Title = "too many requests, rate limit exceeded"
+	case "9002":
+		jaError.Status = strconv.Itoa(http.StatusTooManyRequests) + " " + http.StatusText(http.StatusTooManyRequests)
+		jaError.Source.Pointer = "POST: api/beta2/maps/mapfile"
+		jaError.Title = "map build rejected, daily quota exceeded"
 	default:
 		jaError.Status = strconv.Itoa(http.StatusInternalServerError) + " " + http.StatusText(http.StatusInternalServerError)
 		jaError.Source.Pointer = "unknown error code"
@@ -293,3 +451,49 @@ func appendError(pmErrorList *pd.PrintmapsErrorList, code string, detail string,
 	jaError.Detail = detail
 	pmErrorList.Errors = append(pmErrorList.Errors, jaError)
 }
+
+/*
+errorListStatus determines the http status code for an error list.
+Authentication, authorization and rate limit errors are reported with their own status code,
+all other errors with status code 400 (Bad Request).
+*/
+func errorListStatus(pmErrorList pd.PrintmapsErrorList) int {
+	status := http.StatusBadRequest
+	for _, jaError := range pmErrorList.Errors {
+		switch jaError.Code {
+		case "8001", "8002":
+			return http.StatusUnauthorized
+		case "8003", "8004":
+			status = http.StatusForbidden
+		case "9001", "9002":
+			if status == http.StatusBadRequest {
+				status = http.StatusTooManyRequests
+			}
+		case "4003":
+			if status == http.StatusBadRequest {
+				status = http.StatusPreconditionFailed
+			}
+		case "7004", "6005", "7008":
+			if status == http.StatusBadRequest {
+				status = http.StatusConflict
+			}
+		case "7002":
+			if status == http.StatusBadRequest {
+				status = http.StatusUnsupportedMediaType
+			}
+		case "7007":
+			if status == http.StatusBadRequest {
+				status = http.StatusUnprocessableEntity
+			}
+		case "7001", "7005":
+			if status == http.StatusBadRequest {
+				status = http.StatusRequestEntityTooLarge
+			}
+		case "7006":
+			if status == http.StatusBadRequest {
+				status = http.StatusInsufficientStorage
+			}
+		}
+	}
+	return status
+}